@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"log"
 	"net/http"
 	"time"
@@ -9,6 +10,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/user/debt-optimization-engine/config"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
 	"github.com/user/debt-optimization-engine/internal/handlers"
 	"github.com/user/debt-optimization-engine/internal/repositories"
 	"github.com/user/debt-optimization-engine/internal/services"
@@ -38,8 +40,31 @@ func main() {
 
 	// 3. Initialize Layers
 	repo := repositories.NewPostgresRepo(pool)
-	settlementSvc := services.NewSettlementService(repo)
-	h := handlers.NewHandler(repo, settlementSvc)
+	fxSvc := services.NewFXService(repo)
+	expenseSvc := services.NewExpenseService(repo, fxSvc)
+	settlementSvc := services.NewSettlementService(repo, fxSvc)
+	permissionSvc := services.NewPermissionService(repo)
+
+	secret := []byte(cfg.AuthSecret)
+	if len(secret) == 0 {
+		log.Println("AUTH_SECRET is not set; using a random one, so logins won't survive a restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Could not generate an auth secret: %v", err)
+		}
+	}
+	var codes services.CodeSender
+	switch {
+	case cfg.SMTPAddr != "":
+		codes = services.SMTPCodeSender{Addr: cfg.SMTPAddr, From: cfg.SMTPFrom, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword}
+	case cfg.LogLoginCodes:
+		log.Println("LOG_LOGIN_CODES is set; login codes go to this log, so anyone who can read it can log in")
+		codes = services.LogCodeSender{}
+	default:
+		log.Fatal("Set SMTP_ADDR and SMTP_FROM to email login codes, or LOG_LOGIN_CODES=true to log them in development")
+	}
+	authSvc := services.NewAuthService(repo, secret, cfg.SessionTTL, codes)
+	h := handlers.NewHandler(repo, expenseSvc, settlementSvc, fxSvc, permissionSvc, authSvc)
 
 	// 4. Setup Router
 	r := gin.New() // Use New() to manually add middleware
@@ -53,24 +78,76 @@ func main() {
 			if err := recover(); err != nil {
 				log.Printf("PANIC RECOVERED: %v", err)
 				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-					"error": "internal server error",
-					"status": 500,
+					"error": handlers.ErrorBody{Code: apperrors.CodeInternal, Message: "internal server error"},
 				})
 			}
 		}()
 		c.Next()
 	})
 
+	// Who is calling, from the Authorization header
+	r.Use(handlers.Authenticate(authSvc))
+
 	// Routes
-	api := r.Group("")
+	// Signing up and logging in are open to everyone
+	public := r.Group("")
+	{
+		public.POST("/users", h.CreateUser)
+		public.POST("/auth/login", h.Login)
+		public.POST("/auth/code", h.RequestLoginCode)
+		public.POST("/auth/code/verify", h.VerifyLoginCode)
+	}
+
+	// Everything else needs a logged-in user
+	api := r.Group("", handlers.RequireUser())
 	{
-		api.POST("/users", h.CreateUser)
+		api.GET("/me", h.GetMe)
+		api.PUT("/me/password", h.SetPassword)
+		api.GET("/me/tokens", h.ListAPITokens)
+		api.POST("/me/tokens", h.CreateAPIToken)
+		api.DELETE("/me/tokens/:tokenId", h.RevokeAPIToken)
+		api.GET("/users", h.SearchUsers)
+		api.GET("/users/:id", h.GetUser)
+		api.GET("/users/:id/groups", h.GetUserGroups)
+		api.GET("/users/:id/settlement", h.GetUserSettlement)
+		api.POST("/users/:id/settlement", h.RecordUserSettlement)
+		api.GET("/users/:id/payment-methods", h.GetPaymentMethods)
+		api.PUT("/users/:id/payment-methods", h.SetPaymentMethods)
 		api.POST("/groups", h.CreateGroup)
+		api.GET("/groups/:id", h.GetGroup)
+		api.PATCH("/groups/:id", h.UpdateGroupSettings)
+		api.POST("/groups/:id/close", h.CloseGroup)
+		api.POST("/groups/:id/reopen", h.ReopenGroup)
+		api.GET("/groups/:id/status-history", h.GetGroupStatusHistory)
+		api.GET("/groups/:id/members", h.GetMembers)
 		api.POST("/groups/:id/members", h.AddMember)
+		api.PATCH("/groups/:id/members/:userId", h.SetMemberRole)
+		api.DELETE("/groups/:id/members/:userId", h.RemoveMember)
+		api.POST("/groups/:id/leave", h.LeaveGroup)
 		api.POST("/groups/:id/expenses", h.CreateExpense)
+		api.GET("/groups/:id/expenses", h.ListExpenses)
+		api.GET("/groups/:id/expenses/:expenseId", h.GetExpense)
+		api.PUT("/groups/:id/expenses/:expenseId", h.UpdateExpense)
+		api.DELETE("/groups/:id/expenses/:expenseId", h.DeleteExpense)
+		api.POST("/groups/:id/expenses/:expenseId/restore", h.RestoreExpense)
+		api.GET("/groups/:id/expenses/:expenseId/revisions", h.GetExpenseRevisions)
+		api.GET("/groups/:id/expenses/:expenseId/diff", h.DiffExpense)
+		api.GET("/groups/:id/expenses/:expenseId/items", h.GetExpenseItems)
+		api.POST("/groups/:id/payments", h.RecordPayment)
+		api.GET("/groups/:id/payments", h.ListPayments)
 		api.GET("/groups/:id/balances", h.GetBalances)
+		api.GET("/groups/:id/balances/:userId/breakdown", h.GetBalanceBreakdown)
 		api.GET("/groups/:id/settlement", h.GetSettlement)
 		api.GET("/groups/:id/settlement/compare", h.CompareStrategies)
+		api.GET("/groups/:id/settlement/explain", h.ExplainSettlement)
+		api.POST("/groups/:id/settlement/plans", h.CreateSettlementPlan)
+		api.GET("/groups/:id/settlement/plans/current", h.GetCurrentSettlementPlan)
+		api.GET("/groups/:id/settlement/plans/:planId", h.GetSettlementPlan)
+		api.PATCH("/groups/:id/settlement/plans/:planId/transfers/:transferId", h.UpdatePlanTransfer)
+		api.GET("/groups/:id/constraints", h.GetPaymentConstraints)
+		api.PUT("/groups/:id/constraints", h.SetPaymentConstraints)
+		api.POST("/fx-rates", handlers.RequireOperator(cfg.Operators), h.LoadFXRates)
+		api.GET("/fx-rates", h.ListFXRates)
 	}
 
 	// Health Check
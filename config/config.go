@@ -3,13 +3,24 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	DBURL string
-	Port  string
+	DBURL         string
+	Port          string
+	AuthSecret    string        // Signs session tokens; a random one is used when unset
+	SessionTTL    time.Duration // How long a login lasts
+	SMTPAddr      string        // host:port of the mail server login codes are sent through
+	SMTPFrom      string
+	SMTPUsername  string
+	SMTPPassword  string
+	LogLoginCodes bool        // Write login codes to the log instead of emailing them, for development
+	Operators     []uuid.UUID // Users who may change server-wide data such as exchange rates
 }
 
 func LoadConfig() (*Config, error) {
@@ -25,10 +36,36 @@ func LoadConfig() (*Config, error) {
 	dbURL := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s",
 		dbUser, dbPass, dbHost, dbPort, dbName, dbSSL)
 
-	return &Config{
-		DBURL: dbURL,
-		Port:  getEnv("PORT", "8080"),
-	}, nil
+	sessionTTL, err := time.ParseDuration(getEnv("SESSION_TTL", "12h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SESSION_TTL: %w", err)
+	}
+
+	cfg := &Config{
+		DBURL:         dbURL,
+		Port:          getEnv("PORT", "8080"),
+		AuthSecret:    getEnv("AUTH_SECRET", ""),
+		SessionTTL:    sessionTTL,
+		SMTPAddr:      getEnv("SMTP_ADDR", ""),
+		SMTPFrom:      getEnv("SMTP_FROM", ""),
+		SMTPUsername:  getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:  getEnv("SMTP_PASSWORD", ""),
+		LogLoginCodes: getEnv("LOG_LOGIN_CODES", "") == "true",
+	}
+	if cfg.SMTPAddr != "" && cfg.SMTPFrom == "" {
+		return nil, fmt.Errorf("SMTP_FROM must be set along with SMTP_ADDR")
+	}
+	for _, s := range strings.Split(getEnv("OPERATOR_USER_IDS", ""), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID %q in OPERATOR_USER_IDS: %w", s, err)
+		}
+		cfg.Operators = append(cfg.Operators, id)
+	}
+	return cfg, nil
 }
 
 func getEnv(key, fallback string) string {
@@ -0,0 +1,336 @@
+package algorithms
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// Network describes who may pay whom inside a group, and what it costs. Pair
+// constraints apply in both directions; the zero value allows every payment for free.
+type Network struct {
+	forbidden  map[[2]string]bool
+	preferred  map[[2]string]bool
+	receiveVia map[string]string
+	methods    map[string][]Method
+}
+
+func pairKey(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// Forbid stops a and b from paying each other directly.
+func (n *Network) Forbid(a, b string) {
+	if n.forbidden == nil {
+		n.forbidden = make(map[[2]string]bool)
+	}
+	n.forbidden[pairKey(a, b)] = true
+}
+
+// Prefer favours direct payments between a and b.
+func (n *Network) Prefer(a, b string) {
+	if n.preferred == nil {
+		n.preferred = make(map[[2]string]bool)
+	}
+	n.preferred[pairKey(a, b)] = true
+}
+
+// ReceiveVia makes user accept money only from hub, who forwards it.
+func (n *Network) ReceiveVia(user, hub string) {
+	if n.receiveVia == nil {
+		n.receiveVia = make(map[string]string)
+	}
+	n.receiveVia[user] = hub
+}
+
+// Empty reports whether the network has no constraints at all.
+func (n Network) Empty() bool {
+	return len(n.forbidden) == 0 && len(n.preferred) == 0 && len(n.receiveVia) == 0 && len(n.methods) == 0
+}
+
+// Allows reports whether from may pay to directly, which includes having a payment
+// method in common.
+func (n Network) Allows(from, to string) bool {
+	if from == to || n.forbidden[pairKey(from, to)] {
+		return false
+	}
+	if hub, ok := n.receiveVia[to]; ok && hub != from {
+		return false
+	}
+	return len(n.Methods(from, to)) > 0
+}
+
+// Prefers reports whether direct payments between a and b are favoured.
+func (n Network) Prefers(a, b string) bool {
+	return n.preferred[pairKey(a, b)]
+}
+
+// NetworkStrategy is a Strategy that can honour a group's payment network.
+type NetworkStrategy interface {
+	Strategy
+	SettleNetwork(balances map[string]decimal.Decimal, network Network) ([]Settlement, error)
+}
+
+// ErrNoValidPlan is returned (wrapped in a *NoValidPlanError) when the constraints
+// leave no way to settle every balance.
+var ErrNoValidPlan = errors.New("no settlement plan satisfies the payment constraints")
+
+// NoValidPlanError lists the balances that cannot be cleared under the constraints.
+type NoValidPlanError struct {
+	Unsettled map[string]decimal.Decimal
+}
+
+func (e *NoValidPlanError) Error() string {
+	users := make([]string, 0, len(e.Unsettled))
+	for user := range e.Unsettled {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	parts := make([]string, len(users))
+	for i, user := range users {
+		parts[i] = fmt.Sprintf("%s %s", user, e.Unsettled[user].String())
+	}
+	return fmt.Sprintf("%s (left unsettled: %s)", ErrNoValidPlan, strings.Join(parts, ", "))
+}
+
+func (e *NoValidPlanError) Is(target error) bool { return target == ErrNoValidPlan }
+
+// SettleConstrained settles the balances using only payments the network allows,
+// routing through other members when needed (e.g. via someone's receiving hub).
+//
+// It works like the greedy matcher, preferring preferred pairs and exact matches, but
+// only commits a direct transfer if a max-flow check shows the rest can still be
+// settled. Whatever cannot be settled directly is routed with min-cost flow, where
+// every hop costs extra, so plans stay short.
+func SettleConstrained(balances map[string]decimal.Decimal, network Network) ([]Settlement, error) {
+	users, units, places := minorUnits(balances)
+	n := len(users)
+	toDecimal := func(v int64) decimal.Decimal { return decimal.New(v, -places) }
+
+	remaining := append([]int64(nil), units...)
+	if left := unroutable(users, remaining, network); left != nil {
+		return nil, noValidPlan(users, left, places)
+	}
+
+	type transfer struct{ from, to int }
+	amounts := make(map[transfer]int64)
+	var order []transfer
+	pay := func(from, to int, v int64) {
+		t := transfer{from, to}
+		if _, ok := amounts[t]; !ok {
+			order = append(order, t)
+		}
+		amounts[t] += v
+		remaining[from] += v
+		remaining[to] -= v
+	}
+
+	for {
+		type candidate struct {
+			from, to  int
+			amount    int64
+			preferred bool
+			exact     bool
+		}
+		var candidates []candidate
+		for d := 0; d < n; d++ {
+			if remaining[d] >= 0 {
+				continue
+			}
+			for c := 0; c < n; c++ {
+				if remaining[c] <= 0 || !network.Allows(users[d], users[c]) {
+					continue
+				}
+				amt := min(-remaining[d], remaining[c])
+				candidates = append(candidates, candidate{
+					from: d, to: c, amount: amt,
+					preferred: network.Prefers(users[d], users[c]),
+					exact:     -remaining[d] == remaining[c],
+				})
+			}
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			a, b := candidates[i], candidates[j]
+			if a.preferred != b.preferred {
+				return a.preferred
+			}
+			if a.exact != b.exact {
+				return a.exact
+			}
+			return a.amount > b.amount
+		})
+
+		committed := false
+		for _, cand := range candidates {
+			pay(cand.from, cand.to, cand.amount)
+			if unroutable(users, remaining, network) == nil {
+				committed = true
+				break
+			}
+			// Undo: this transfer would strand someone else
+			amounts[transfer{cand.from, cand.to}] -= cand.amount
+			remaining[cand.from] -= cand.amount
+			remaining[cand.to] += cand.amount
+		}
+		if !committed {
+			break
+		}
+	}
+
+	// Anything left needs to be routed through intermediaries
+	g, source, sink, edgeOf := buildNetworkGraph(users, remaining, network)
+	g.minCostFlow(source, sink)
+	pairs := make([][2]int, 0, len(edgeOf))
+	for pair := range edgeOf {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	for _, pair := range pairs {
+		if f := g.edges[edgeOf[pair]].flow; f > 0 {
+			pay(pair[0], pair[1], f)
+		}
+	}
+
+	var settlements []Settlement
+	for _, t := range order {
+		if v := amounts[t]; v > 0 {
+			settlements = append(settlements, Settlement{From: users[t.from], To: users[t.to], Amount: toDecimal(v)})
+		}
+	}
+	return settlements, nil
+}
+
+// unroutable returns the balances that would be left after pushing as much as possible
+// from debtors to creditors over allowed payments, or nil if everything can be settled.
+func unroutable(users []string, remaining []int64, network Network) []int64 {
+	g, source, sink, _ := buildNetworkGraph(users, remaining, network)
+	flow, _ := g.minCostFlow(source, sink)
+	return leftover(g, source, sink, remaining, flow)
+}
+
+// leftover returns what each user still owes or is owed after a flow has been pushed
+// through g, or nil if the flow settled every debt.
+func leftover(g *flowGraph, source, sink int, remaining []int64, flow int64) []int64 {
+	var debt int64
+	for _, v := range remaining {
+		if v < 0 {
+			debt -= v
+		}
+	}
+	if flow == debt {
+		return nil
+	}
+
+	left := append([]int64(nil), remaining...)
+	for i := range remaining {
+		for _, id := range g.adj[source] {
+			if e := g.edges[id]; e.to == i && e.cap > 0 {
+				left[i] += e.flow
+			}
+		}
+		for _, id := range g.adj[i] {
+			if e := g.edges[id]; e.to == sink && e.cap > 0 {
+				left[i] -= e.flow
+			}
+		}
+	}
+	return left
+}
+
+func noValidPlan(users []string, left []int64, places int32) error {
+	unsettled := make(map[string]decimal.Decimal)
+	for i, v := range left {
+		if v != 0 {
+			unsettled[users[i]] = decimal.New(v, -places)
+		}
+	}
+	return &NoValidPlanError{Unsettled: unsettled}
+}
+
+// buildNetworkGraph connects a source to every debtor and every creditor to a sink,
+// with an edge for each allowed payment between members. Preferred payments are
+// cheaper than ordinary ones, and every hop costs something, so cheap flows use few
+// transfers.
+func buildNetworkGraph(users []string, remaining []int64, network Network) (*flowGraph, int, int, map[[2]int]int) {
+	n := len(users)
+	source, sink := n, n+1
+	g := newFlowGraph(n + 2)
+	for i, v := range remaining {
+		if v < 0 {
+			g.addEdge(source, i, -v, 0)
+		} else if v > 0 {
+			g.addEdge(i, sink, v, 0)
+		}
+	}
+
+	edgeOf := make(map[[2]int]int)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if !network.Allows(users[i], users[j]) {
+				continue
+			}
+			cost := int64(2)
+			if network.Prefers(users[i], users[j]) {
+				cost = 1
+			}
+			edgeOf[[2]int{i, j}] = g.addEdge(i, j, infCap, cost)
+		}
+	}
+	return g, source, sink, edgeOf
+}
+
+// minorUnits converts balances to integers in the finest precision present. Users are
+// returned sorted so results don't depend on map order.
+func minorUnits(balances map[string]decimal.Decimal) ([]string, []int64, int32) {
+	users := make([]string, 0, len(balances))
+	var places int32
+	for user, amount := range balances {
+		users = append(users, user)
+		if p := -amount.Exponent(); p > places {
+			places = p
+		}
+	}
+	sort.Strings(users)
+
+	units := make([]int64, len(users))
+	for i, user := range users {
+		units[i] = balances[user].Shift(places).IntPart()
+	}
+	return users, units, places
+}
+
+type constrainedStrategy struct{}
+
+func (constrainedStrategy) Name() string { return "constrained" }
+
+func (constrainedStrategy) Description() string {
+	return "Honours forbidden and preferred pairs and receiving hubs, routing through other members when needed."
+}
+
+func (s constrainedStrategy) Settle(balances map[string]decimal.Decimal) []Settlement {
+	// Without constraints every plan is valid, so this cannot fail
+	settlements, _ := s.SettleNetwork(balances, Network{})
+	return settlements
+}
+
+func (constrainedStrategy) SettleNetwork(balances map[string]decimal.Decimal, network Network) ([]Settlement, error) {
+	return SettleConstrained(balances, network)
+}
+
+func init() {
+	Register(constrainedStrategy{})
+}
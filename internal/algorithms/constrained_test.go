@@ -0,0 +1,101 @@
+package algorithms
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertAllowed(t *testing.T, network Network, txs []Settlement) {
+	for _, tx := range txs {
+		assert.True(t, network.Allows(tx.From, tx.To), "%s -> %s is not allowed", tx.From, tx.To)
+	}
+}
+
+func TestSettleConstrainedForbiddenPair(t *testing.T) {
+	balances := map[string]decimal.Decimal{
+		"Alice": decimal.NewFromInt(100),
+		"Bob":   decimal.NewFromInt(-60),
+		"Carol": decimal.NewFromInt(-40),
+		"Dan":   decimal.NewFromInt(0),
+	}
+	var network Network
+	network.Forbid("Bob", "Alice")
+
+	result, err := SettleConstrained(balances, network)
+	assert.NoError(t, err)
+	assertAllowed(t, network, result)
+	for user, left := range applySettlements(balances, result) {
+		assert.True(t, left.IsZero(), "%s still has %s", user, left)
+	}
+	// Bob pays Carol, who passes it on with her own share
+	assert.Equal(t, 2, len(result))
+}
+
+func TestSettleConstrainedPreferredPair(t *testing.T) {
+	balances := map[string]decimal.Decimal{
+		"Alice": decimal.NewFromInt(50),
+		"Bob":   decimal.NewFromInt(50),
+		"Carol": decimal.NewFromInt(-50),
+		"Dan":   decimal.NewFromInt(-50),
+	}
+	var network Network
+	network.Prefer("Carol", "Bob")
+
+	result, err := SettleConstrained(balances, network)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, "Carol", result[0].From)
+	assert.Equal(t, "Bob", result[0].To)
+}
+
+func TestSettleConstrainedReceiveViaHub(t *testing.T) {
+	balances := map[string]decimal.Decimal{
+		"Alice": decimal.NewFromInt(30),
+		"Bob":   decimal.NewFromInt(-30),
+		"Hub":   decimal.NewFromInt(0),
+	}
+	var network Network
+	network.ReceiveVia("Alice", "Hub")
+
+	result, err := SettleConstrained(balances, network)
+	assert.NoError(t, err)
+	assertAllowed(t, network, result)
+	assert.Equal(t, 2, len(result))
+	for user, left := range applySettlements(balances, result) {
+		assert.True(t, left.IsZero(), "%s still has %s", user, left)
+	}
+}
+
+func TestSettleConstrainedNoValidPlan(t *testing.T) {
+	balances := map[string]decimal.Decimal{
+		"Alice": decimal.NewFromInt(30),
+		"Bob":   decimal.NewFromInt(-30),
+	}
+	var network Network
+	network.Forbid("Alice", "Bob")
+
+	_, err := SettleConstrained(balances, network)
+	assert.True(t, errors.Is(err, ErrNoValidPlan))
+
+	var planErr *NoValidPlanError
+	assert.ErrorAs(t, err, &planErr)
+	assert.True(t, planErr.Unsettled["Bob"].Equal(decimal.NewFromInt(-30)))
+	assert.True(t, planErr.Unsettled["Alice"].Equal(decimal.NewFromInt(30)))
+}
+
+func TestSettleConstrainedUnconstrainedMatchesGreedyBound(t *testing.T) {
+	rng := rand.New(rand.NewSource(11))
+	for round := 0; round < 100; round++ {
+		balances := randomBalances(rng, 2+rng.Intn(7))
+		result, err := SettleConstrained(balances, Network{})
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(result), len(balances)-1)
+		for _, left := range applySettlements(balances, result) {
+			assert.True(t, left.IsZero())
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package algorithms
+
+import (
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// FeeModel prices a single transfer: a flat charge plus a percentage of whatever is
+// sent above a free allowance. Flat, percentage and free-up-to-a-limit methods are all
+// special cases of it.
+type FeeModel struct {
+	Flat     decimal.Decimal // Charged once per transfer
+	Percent  decimal.Decimal // Of the amount above FreeUpTo, e.g. 1.5 for 1.5%
+	FreeUpTo decimal.Decimal // Amount per transfer that the percentage is not charged on
+}
+
+var hundred = decimal.NewFromInt(100)
+
+// Fee returns what sending amount with this model costs.
+func (f FeeModel) Fee(amount decimal.Decimal) decimal.Decimal {
+	if !amount.IsPositive() {
+		return decimal.Zero
+	}
+	fee := f.Flat
+	if excess := amount.Sub(f.FreeUpTo); excess.IsPositive() {
+		fee = fee.Add(excess.Mul(f.Percent).Div(hundred))
+	}
+	return fee
+}
+
+// Method is a way a user can send money, such as a bank transfer or a wallet. Two
+// users can pay each other with a method if both have one of that name; the sender's
+// fee model applies. An unpriced method still connects people, but its fee is unknown,
+// so it is only chosen when no priced method is in common.
+type Method struct {
+	Name     string
+	Fee      FeeModel
+	Unpriced bool
+}
+
+// AddMethod registers a payment method for user. Users without any methods can pay and
+// be paid by any means, free of charge.
+func (n *Network) AddMethod(user string, m Method) {
+	if n.methods == nil {
+		n.methods = make(map[string][]Method)
+	}
+	n.methods[user] = append(n.methods[user], m)
+}
+
+// Methods lists the methods from can use to pay to, ordered by name. A sender without
+// methods gets a single free unnamed one.
+func (n Network) Methods(from, to string) []Method {
+	sent, ok := n.methods[from]
+	if !ok {
+		return []Method{{}}
+	}
+	received, ok := n.methods[to]
+	var usable []Method
+	for _, m := range sent {
+		if !ok || hasMethod(received, m.Name) {
+			usable = append(usable, m)
+		}
+	}
+	sort.SliceStable(usable, func(i, j int) bool { return usable[i].Name < usable[j].Name })
+	return usable
+}
+
+func hasMethod(methods []Method, name string) bool {
+	for _, m := range methods {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Quote returns the cheapest method from can use to send amount to, and its fee. ok is
+// false when the two have no method in common.
+func (n Network) Quote(from, to string, amount decimal.Decimal) (m Method, fee decimal.Decimal, ok bool) {
+	for i, candidate := range n.Methods(from, to) {
+		f := candidate.Fee.Fee(amount)
+		if i == 0 || m.Unpriced && !candidate.Unpriced || m.Unpriced == candidate.Unpriced && f.LessThan(fee) {
+			m, fee, ok = candidate, f, true
+		}
+	}
+	return m, fee, ok
+}
+
+// priced drops the unpriced methods from methods, unless that would leave none.
+func priced(methods []Method) []Method {
+	var out []Method
+	for _, m := range methods {
+		if !m.Unpriced {
+			out = append(out, m)
+		}
+	}
+	if len(out) == 0 {
+		return methods
+	}
+	return out
+}
+
+// SettleMinFee settles the balances with the lowest total fees, honouring the network's
+// constraints. Transfer count only breaks ties.
+//
+// Percentage fees are linear in the amount, so they are solved exactly as a min-cost
+// flow over the member graph: each method is an edge costing its percentage, with a
+// free parallel edge for any allowance. Flat fees are charged per transfer and can't
+// be expressed that way, so they are improved afterwards by repeatedly banning a
+// flat-fee transfer and re-solving while that lowers the total.
+func SettleMinFee(balances map[string]decimal.Decimal, network Network) ([]Settlement, error) {
+	users, units, places := minorUnits(balances)
+	banned := make(map[feeRoute]bool)
+
+	best, left := solveFees(users, units, places, network, banned)
+	if left != nil {
+		return nil, noValidPlan(users, left, places)
+	}
+
+	// A plan with fewer transfers is as good if it costs no more
+	if plan, err := SettleConstrained(balances, network); err == nil {
+		Price(plan, network)
+		if !TotalFees(best).LessThan(TotalFees(plan)) && len(plan) < len(best) {
+			best = plan
+		}
+	}
+
+	for improved := true; improved; {
+		improved = false
+		for _, tx := range best {
+			if !tx.Fee.IsPositive() {
+				continue
+			}
+			route := feeRoute{from: tx.From, to: tx.To, method: tx.Method}
+			banned[route] = true
+			plan, left := solveFees(users, units, places, network, banned)
+			if left == nil && cheaper(plan, best) {
+				best, improved = plan, true
+				break
+			}
+			delete(banned, route)
+		}
+	}
+	return best, nil
+}
+
+type feeRoute struct {
+	from, to, method string
+}
+
+// solveFees runs one min-cost flow with the banned routes left out. It returns the
+// plan, or what could not be settled.
+func solveFees(users []string, units []int64, places int32, network Network, banned map[feeRoute]bool) ([]Settlement, []int64) {
+	n := len(users)
+	source, sink := n, n+1
+	g := newFlowGraph(n + 2)
+	for i, v := range units {
+		if v < 0 {
+			g.addEdge(source, i, -v, 0)
+		} else if v > 0 {
+			g.addEdge(i, sink, v, 0)
+		}
+	}
+
+	// Fees dominate the cost. Below them, every hop costs a little so free routes stay
+	// short, and methods with a flat fee cost a little more than those without.
+	// Percentages are costed in millionths of a unit.
+	hop := int64(1)
+	scale := int64(2*n + 1)
+	type edgeRoute struct {
+		edge   int
+		route  feeRoute
+		method Method
+	}
+	var routes []edgeRoute
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if !network.Allows(users[i], users[j]) {
+				continue
+			}
+			cost := hop
+			if network.Prefers(users[i], users[j]) {
+				cost = 0
+			}
+			for _, m := range priced(network.Methods(users[i], users[j])) {
+				route := feeRoute{from: users[i], to: users[j], method: m.Name}
+				if banned[route] {
+					continue
+				}
+				base := cost
+				if m.Fee.Flat.IsPositive() {
+					base++
+				}
+				pct := m.Fee.Percent.Shift(4).IntPart()*scale + base
+				if free := m.Fee.FreeUpTo.Shift(places).IntPart(); free > 0 && pct > base {
+					routes = append(routes, edgeRoute{g.addEdge(i, j, free, base), route, m})
+				}
+				routes = append(routes, edgeRoute{g.addEdge(i, j, infCap, pct), route, m})
+			}
+		}
+	}
+
+	var debt int64
+	for _, v := range units {
+		if v < 0 {
+			debt -= v
+		}
+	}
+	flow, _ := g.minCostFlow(source, sink)
+	if flow != debt {
+		return nil, leftover(g, source, sink, units, flow)
+	}
+
+	amounts := make(map[feeRoute]int64)
+	methods := make(map[feeRoute]Method)
+	var order []feeRoute
+	for _, r := range routes {
+		f := g.edges[r.edge].flow
+		if f <= 0 {
+			continue
+		}
+		if _, ok := amounts[r.route]; !ok {
+			order = append(order, r.route)
+		}
+		amounts[r.route] += f
+		methods[r.route] = r.method
+	}
+
+	settlements := make([]Settlement, 0, len(order))
+	for _, r := range order {
+		amount := decimal.New(amounts[r], -places)
+		settlements = append(settlements, Settlement{
+			From:       r.from,
+			To:         r.to,
+			Amount:     amount,
+			Method:     r.method,
+			Fee:        methods[r].Fee.Fee(amount),
+			FeeUnknown: methods[r].Unpriced,
+		})
+	}
+	return settlements, nil
+}
+
+// Price fills in the cheapest method and its fee for every transfer that doesn't have
+// one yet.
+func Price(settlements []Settlement, network Network) {
+	for i := range settlements {
+		s := &settlements[i]
+		if s.Method != "" {
+			continue
+		}
+		if m, fee, ok := network.Quote(s.From, s.To, s.Amount); ok {
+			s.Method, s.Fee, s.FeeUnknown = m.Name, fee, m.Unpriced
+		}
+	}
+}
+
+// cheaper reports whether plan a costs less in fees than b, or the same with fewer
+// transfers.
+func cheaper(a, b []Settlement) bool {
+	fa, fb := TotalFees(a), TotalFees(b)
+	if !fa.Equal(fb) {
+		return fa.LessThan(fb)
+	}
+	return len(a) < len(b)
+}
+
+// TotalFees adds up the fees of a plan.
+func TotalFees(settlements []Settlement) decimal.Decimal {
+	total := decimal.Zero
+	for _, s := range settlements {
+		total = total.Add(s.Fee)
+	}
+	return total
+}
+
+type minFeeStrategy struct{}
+
+func (minFeeStrategy) Name() string { return "min_fee" }
+
+func (minFeeStrategy) Description() string {
+	return "Lowest total fees across members' payment methods via min-cost flow; honours payment constraints."
+}
+
+func (s minFeeStrategy) Settle(balances map[string]decimal.Decimal) []Settlement {
+	// Without methods or constraints every plan is valid and free, so this cannot fail
+	settlements, _ := s.SettleNetwork(balances, Network{})
+	return settlements
+}
+
+func (minFeeStrategy) SettleNetwork(balances map[string]decimal.Decimal, network Network) ([]Settlement, error) {
+	return SettleMinFee(balances, network)
+}
+
+func init() {
+	Register(minFeeStrategy{})
+}
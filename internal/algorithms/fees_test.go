@@ -0,0 +1,121 @@
+package algorithms
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func percent(p string) FeeModel {
+	return FeeModel{Percent: decimal.RequireFromString(p)}
+}
+
+func TestFeeModel(t *testing.T) {
+	flat := FeeModel{Flat: decimal.NewFromInt(5)}
+	assert.True(t, flat.Fee(decimal.NewFromInt(1000)).Equal(decimal.NewFromInt(5)))
+	assert.True(t, flat.Fee(decimal.Zero).IsZero())
+
+	assert.True(t, percent("1.5").Fee(decimal.NewFromInt(200)).Equal(decimal.NewFromInt(3)))
+
+	free := FeeModel{Percent: decimal.NewFromInt(2), FreeUpTo: decimal.NewFromInt(100)}
+	assert.True(t, free.Fee(decimal.NewFromInt(80)).IsZero())
+	assert.True(t, free.Fee(decimal.NewFromInt(150)).Equal(decimal.NewFromInt(1)))
+}
+
+func TestSettleMinFeeRoutesAroundExpensiveMethod(t *testing.T) {
+	// Alice owes Carol 100. Alice -> Carol only works over an expensive wire, but Bob
+	// has a cheap wallet in common with both of them.
+	balances := map[string]decimal.Decimal{
+		"Alice": decimal.NewFromInt(-100),
+		"Bob":   decimal.Zero,
+		"Carol": decimal.NewFromInt(100),
+	}
+	var network Network
+	network.AddMethod("Alice", Method{Name: "wire", Fee: percent("3")})
+	network.AddMethod("Alice", Method{Name: "wallet", Fee: percent("0.5")})
+	network.AddMethod("Bob", Method{Name: "wallet", Fee: percent("0.5")})
+	network.AddMethod("Bob", Method{Name: "upi", Fee: percent("0")})
+	network.AddMethod("Carol", Method{Name: "wire", Fee: percent("3")})
+	network.AddMethod("Carol", Method{Name: "upi", Fee: percent("0")})
+
+	result, err := SettleMinFee(balances, network)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(result))
+	assert.True(t, TotalFees(result).Equal(decimal.RequireFromString("0.5")), TotalFees(result).String())
+	for _, left := range applySettlements(balances, result) {
+		assert.True(t, left.IsZero())
+	}
+
+	greedy := SettleOptimized(balances)
+	Price(greedy, network)
+	assert.Equal(t, "wire", greedy[0].Method)
+	assert.True(t, TotalFees(greedy).Equal(decimal.NewFromInt(3)))
+}
+
+func TestSettleMinFeeUsesFreeAllowance(t *testing.T) {
+	// Splitting the payment between two creditors keeps each under the free limit
+	balances := map[string]decimal.Decimal{
+		"Alice": decimal.NewFromInt(-200),
+		"Bob":   decimal.NewFromInt(100),
+		"Carol": decimal.NewFromInt(100),
+	}
+	var network Network
+	network.AddMethod("Alice", Method{Name: "wise", Fee: FeeModel{Percent: decimal.NewFromInt(1), FreeUpTo: decimal.NewFromInt(100)}})
+
+	result, err := SettleMinFee(balances, network)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(result))
+	assert.True(t, TotalFees(result).IsZero())
+}
+
+func TestSettleMinFeeAvoidsFlatFees(t *testing.T) {
+	// Both Alice and Bob owe Carol, but Bob pays a flat fee to reach her and Alice
+	// doesn't. Routing Bob's share through Alice saves the flat fee.
+	balances := map[string]decimal.Decimal{
+		"Alice": decimal.NewFromInt(-50),
+		"Bob":   decimal.NewFromInt(-50),
+		"Carol": decimal.NewFromInt(100),
+	}
+	var network Network
+	network.AddMethod("Bob", Method{Name: "bank", Fee: FeeModel{Flat: decimal.NewFromInt(10)}})
+	network.AddMethod("Bob", Method{Name: "cash", Fee: FeeModel{}})
+	network.AddMethod("Alice", Method{Name: "cash", Fee: FeeModel{}})
+	network.AddMethod("Alice", Method{Name: "bank", Fee: FeeModel{}})
+	network.AddMethod("Carol", Method{Name: "bank", Fee: FeeModel{}})
+
+	result, err := SettleMinFee(balances, network)
+	assert.NoError(t, err)
+	assert.True(t, TotalFees(result).IsZero())
+	for _, left := range applySettlements(balances, result) {
+		assert.True(t, left.IsZero())
+	}
+}
+
+func TestSettleMinFeeNoCommonMethod(t *testing.T) {
+	balances := map[string]decimal.Decimal{
+		"Alice": decimal.NewFromInt(-10),
+		"Bob":   decimal.NewFromInt(10),
+	}
+	var network Network
+	network.AddMethod("Alice", Method{Name: "upi"})
+	network.AddMethod("Bob", Method{Name: "venmo"})
+
+	_, err := SettleMinFee(balances, network)
+	assert.True(t, errors.Is(err, ErrNoValidPlan))
+}
+
+func TestSettleMinFeeWithoutFeesIsShort(t *testing.T) {
+	rng := rand.New(rand.NewSource(12))
+	for round := 0; round < 100; round++ {
+		balances := randomBalances(rng, 2+rng.Intn(7))
+		result, err := SettleMinFee(balances, Network{})
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(result), len(balances)-1)
+		for _, left := range applySettlements(balances, result) {
+			assert.True(t, left.IsZero())
+		}
+	}
+}
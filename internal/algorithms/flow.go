@@ -0,0 +1,86 @@
+package algorithms
+
+import "math"
+
+// flowGraph is a small min-cost flow network on integer amounts (minor units). It is
+// sized for a group's members, not for large graphs.
+type flowGraph struct {
+	edges []flowEdge
+	adj   [][]int
+}
+
+type flowEdge struct {
+	from, to  int
+	cap, cost int64
+	flow      int64
+}
+
+const infCap = math.MaxInt64 / 4
+
+func newFlowGraph(n int) *flowGraph {
+	return &flowGraph{adj: make([][]int, n)}
+}
+
+// addEdge adds a directed edge and its residual twin, returning the forward edge index.
+func (g *flowGraph) addEdge(from, to int, cap, cost int64) int {
+	g.edges = append(g.edges, flowEdge{from: from, to: to, cap: cap, cost: cost})
+	g.adj[from] = append(g.adj[from], len(g.edges)-1)
+	g.edges = append(g.edges, flowEdge{from: to, to: from, cost: -cost})
+	g.adj[to] = append(g.adj[to], len(g.edges)-1)
+	return len(g.edges) - 2
+}
+
+// minCostFlow pushes as much flow as possible from s to t, always along the cheapest
+// augmenting path (successive shortest paths with Bellman-Ford, so negative residual
+// costs are fine). It returns the total flow and its cost.
+func (g *flowGraph) minCostFlow(s, t int) (flow, cost int64) {
+	n := len(g.adj)
+	for {
+		dist := make([]int64, n)
+		prev := make([]int, n)
+		inQueue := make([]bool, n)
+		for i := range dist {
+			dist[i] = math.MaxInt64
+			prev[i] = -1
+		}
+		dist[s] = 0
+		queue := []int{s}
+		inQueue[s] = true
+		for len(queue) > 0 {
+			u := queue[0]
+			queue = queue[1:]
+			inQueue[u] = false
+			for _, id := range g.adj[u] {
+				e := &g.edges[id]
+				if e.cap-e.flow <= 0 {
+					continue
+				}
+				if d := dist[u] + e.cost; d < dist[e.to] {
+					dist[e.to] = d
+					prev[e.to] = id
+					if !inQueue[e.to] {
+						queue = append(queue, e.to)
+						inQueue[e.to] = true
+					}
+				}
+			}
+		}
+		if dist[t] == math.MaxInt64 {
+			return flow, cost
+		}
+
+		push := int64(infCap)
+		for v := t; v != s; v = g.edges[prev[v]].from {
+			e := g.edges[prev[v]]
+			if r := e.cap - e.flow; r < push {
+				push = r
+			}
+		}
+		for v := t; v != s; v = g.edges[prev[v]].from {
+			g.edges[prev[v]].flow += push
+			g.edges[prev[v]^1].flow -= push
+		}
+		flow += push
+		cost += push * dist[t]
+	}
+}
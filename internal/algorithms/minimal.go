@@ -0,0 +1,120 @@
+package algorithms
+
+import (
+	"math/bits"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// MaxExactParticipants is the largest number of non-zero balances SettleMinimal solves
+// exactly. The search is O(n * 2^n), so above this it falls back to SettleOptimized.
+const MaxExactParticipants = 18
+
+// SettleMinimal returns a settlement with the fewest possible transfers.
+//
+// Any group of people whose balances sum to zero can settle among themselves in
+// (size - 1) transfers, so the minimum for N people is N minus the largest number of
+// disjoint zero-sum subsets the balances can be partitioned into. The partition is
+// found with a bitmask DP and each subset is then settled on its own.
+func SettleMinimal(balances map[string]decimal.Decimal) []Settlement {
+	var users []string
+	for user, amount := range balances {
+		if !amount.IsZero() {
+			users = append(users, user)
+		}
+	}
+	if len(users) > MaxExactParticipants {
+		return SettleOptimized(balances)
+	}
+	sort.Strings(users)
+
+	partition, ok := zeroSumPartition(users, balances)
+	if !ok {
+		return SettleOptimized(balances)
+	}
+
+	var settlements []Settlement
+	for _, subset := range partition {
+		part := make(map[string]decimal.Decimal, len(subset))
+		for _, user := range subset {
+			part[user] = balances[user]
+		}
+		settlements = append(settlements, SettleOptimized(part)...)
+	}
+	return settlements
+}
+
+// zeroSumPartition splits users into the largest number of disjoint groups whose
+// balances each sum to zero. It reports false if the balances don't sum to zero.
+func zeroSumPartition(users []string, balances map[string]decimal.Decimal) ([][]string, bool) {
+	n := len(users)
+	if n == 0 {
+		return nil, true
+	}
+
+	// Work in integer units of the finest precision present
+	subset := make(map[string]decimal.Decimal, n)
+	for _, user := range users {
+		subset[user] = balances[user]
+	}
+	_, units, _ := minorUnits(subset)
+
+	full := 1<<n - 1
+	sum := make([]int64, full+1)
+	best := make([]int8, full+1)
+	for mask := 1; mask <= full; mask++ {
+		low := mask & -mask
+		sum[mask] = sum[mask^low] + units[bits.TrailingZeros(uint(low))]
+
+		// best[mask]: most zero-sum groups when the members of mask are added one at a
+		// time; every time the running total hits zero another group is closed off.
+		var b int8
+		for rest := mask; rest != 0; rest &= rest - 1 {
+			bit := rest & -rest
+			if best[mask^bit] > b {
+				b = best[mask^bit]
+			}
+		}
+		if sum[mask] == 0 {
+			b++
+		}
+		best[mask] = b
+	}
+
+	if sum[full] != 0 {
+		return nil, false
+	}
+
+	// Walk back from the full set removing one member at a time along an optimal
+	// path; the sets where the running total is zero mark the group boundaries.
+	var boundaries []int
+	for mask := full; mask != 0; {
+		closed := int8(0)
+		if sum[mask] == 0 {
+			closed = 1
+			boundaries = append(boundaries, mask)
+		}
+		for rest := mask; rest != 0; rest &= rest - 1 {
+			bit := rest & -rest
+			if best[mask^bit] == best[mask]-closed {
+				mask ^= bit
+				break
+			}
+		}
+	}
+	boundaries = append(boundaries, 0)
+
+	var groups [][]string
+	for k := 0; k+1 < len(boundaries); k++ {
+		var group []string
+		diff := boundaries[k] &^ boundaries[k+1]
+		for i := 0; i < n; i++ {
+			if diff&(1<<i) != 0 {
+				group = append(group, users[i])
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, true
+}
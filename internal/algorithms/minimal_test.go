@@ -0,0 +1,97 @@
+package algorithms
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// applySettlements returns the balances left after every transfer has been made.
+func applySettlements(balances map[string]decimal.Decimal, txs []Settlement) map[string]decimal.Decimal {
+	left := make(map[string]decimal.Decimal, len(balances))
+	for user, amount := range balances {
+		left[user] = amount
+	}
+	for _, tx := range txs {
+		left[tx.From] = left[tx.From].Add(tx.Amount)
+		left[tx.To] = left[tx.To].Sub(tx.Amount)
+	}
+	return left
+}
+
+func randomBalances(rng *rand.Rand, n int) map[string]decimal.Decimal {
+	balances := make(map[string]decimal.Decimal, n)
+	total := decimal.Zero
+	for i := 0; i < n-1; i++ {
+		amount := decimal.New(int64(rng.Intn(4001)-2000), -2)
+		balances[string(rune('A'+i))] = amount
+		total = total.Add(amount)
+	}
+	balances[string(rune('A'+n-1))] = total.Neg()
+	return balances
+}
+
+func TestSettleMinimalBeatsGreedy(t *testing.T) {
+	balances := map[string]decimal.Decimal{
+		"A": decimal.NewFromInt(-6),
+		"B": decimal.NewFromInt(5),
+		"C": decimal.NewFromInt(1),
+		"D": decimal.NewFromInt(3),
+		"E": decimal.NewFromInt(-3),
+	}
+
+	assert.Equal(t, 4, len(SettleOptimized(balances)))
+
+	result := SettleMinimal(balances)
+	assert.Equal(t, 3, len(result))
+	for user, left := range applySettlements(balances, result) {
+		assert.True(t, left.IsZero(), "%s still has %s", user, left)
+	}
+}
+
+func TestSettleMinimalProperties(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+
+	for round := 0; round < 500; round++ {
+		n := 2 + rng.Intn(9)
+		balances := randomBalances(rng, n)
+
+		// Small integer amounts make zero-sum subsets common
+		if round%2 == 0 {
+			for user, amount := range balances {
+				balances[user] = amount.Div(decimal.NewFromInt(100)).Truncate(0)
+			}
+			total := decimal.Zero
+			for user, amount := range balances {
+				if user != "A" {
+					total = total.Add(amount)
+				}
+			}
+			balances["A"] = total.Neg()
+		}
+
+		minimal := SettleMinimal(balances)
+		greedy := SettleOptimized(balances)
+
+		assert.LessOrEqual(t, len(minimal), len(greedy), "balances %v", balances)
+		for _, tx := range minimal {
+			assert.True(t, tx.Amount.IsPositive())
+		}
+		for user, left := range applySettlements(balances, minimal) {
+			assert.True(t, left.IsZero(), "%s still has %s for %v", user, left, balances)
+		}
+	}
+}
+
+func TestSettleMinimalFallsBackForLargeGroups(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	balances := randomBalances(rng, MaxExactParticipants+5)
+
+	result := SettleMinimal(balances)
+	assert.LessOrEqual(t, len(result), len(balances)-1)
+	for _, left := range applySettlements(balances, result) {
+		assert.True(t, left.IsZero())
+	}
+}
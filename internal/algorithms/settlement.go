@@ -11,6 +11,9 @@ type Settlement struct {
 	From   string          `json:"from"`
 	To     string          `json:"to"`
 	Amount decimal.Decimal `json:"amount"`
+	Method     string          `json:"method,omitempty"`      // Payment method the fee was worked out for
+	Fee        decimal.Decimal `json:"fee"`                   // Expected fee, paid by the sender
+	FeeUnknown bool            `json:"fee_unknown,omitempty"` // The method's fee couldn't be priced, so Fee leaves it out
 }
 
 // Balance represents the net balance of a user.
@@ -32,10 +35,14 @@ func SettleOptimized(balances map[string]decimal.Decimal) []Settlement {
 		}
 	}
 
-	// Sort to match largest debtor with largest creditor (Greedy approach)
+	// Sort to match largest debtor with largest creditor (Greedy approach). Equal
+	// amounts are ordered by name so the plan doesn't depend on map order.
 	sortBalances := func(b []Balance) {
 		sort.Slice(b, func(i, j int) bool {
-			return b[i].Amount.GreaterThan(b[j].Amount)
+			if !b[i].Amount.Equal(b[j].Amount) {
+				return b[i].Amount.GreaterThan(b[j].Amount)
+			}
+			return b[i].User < b[j].User
 		})
 	}
 
@@ -58,7 +65,12 @@ func SettleNaive(balances map[string]decimal.Decimal) []Settlement {
 		}
 	}
 
-	// No sorting - just pure naive sequential matching
+	// No optimisation - just sequential matching, in name order so it is repeatable
+	byName := func(b []Balance) {
+		sort.Slice(b, func(i, j int) bool { return b[i].User < b[j].User })
+	}
+	byName(debtors)
+	byName(creditors)
 	return match(debtors, creditors)
 }
 
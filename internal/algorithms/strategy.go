@@ -0,0 +1,71 @@
+package algorithms
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// Strategy is a settlement algorithm that can be selected by name.
+type Strategy interface {
+	Name() string
+	Description() string
+	Settle(balances map[string]decimal.Decimal) []Settlement
+}
+
+// DefaultStrategy is used when a request doesn't name one.
+const DefaultStrategy = "greedy"
+
+// NewStrategy wraps a settle function as a Strategy.
+func NewStrategy(name, description string, settle func(map[string]decimal.Decimal) []Settlement) Strategy {
+	return funcStrategy{name: name, description: description, settle: settle}
+}
+
+type funcStrategy struct {
+	name        string
+	description string
+	settle      func(map[string]decimal.Decimal) []Settlement
+}
+
+func (s funcStrategy) Name() string        { return s.name }
+func (s funcStrategy) Description() string { return s.description }
+func (s funcStrategy) Settle(balances map[string]decimal.Decimal) []Settlement {
+	return s.settle(balances)
+}
+
+var registry = map[string]Strategy{}
+
+// Register makes a strategy available by name. It panics if the name is taken, since
+// that can only be a programming error.
+func Register(s Strategy) {
+	if _, dup := registry[s.Name()]; dup {
+		panic(fmt.Sprintf("algorithms: strategy %q registered twice", s.Name()))
+	}
+	registry[s.Name()] = s
+}
+
+// Lookup returns the strategy registered under name. An empty name selects the default.
+func Lookup(name string) (Strategy, bool) {
+	if name == "" {
+		name = DefaultStrategy
+	}
+	s, ok := registry[name]
+	return s, ok
+}
+
+// Strategies lists every registered strategy, ordered by name.
+func Strategies() []Strategy {
+	out := make([]Strategy, 0, len(registry))
+	for _, s := range registry {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out
+}
+
+func init() {
+	Register(NewStrategy("greedy", "Largest debtor pays largest creditor first; at most N-1 transfers.", SettleOptimized))
+	Register(NewStrategy("naive", "Debtors and creditors matched in arbitrary order with no optimisation.", SettleNaive))
+	Register(NewStrategy("minimal", fmt.Sprintf("Fewest possible transfers via zero-sum subset partitioning; greedy above %d people.", MaxExactParticipants), SettleMinimal))
+}
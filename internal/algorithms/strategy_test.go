@@ -0,0 +1,47 @@
+package algorithms
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrategyRegistry(t *testing.T) {
+	s, ok := Lookup("")
+	assert.True(t, ok)
+	assert.Equal(t, DefaultStrategy, s.Name())
+
+	_, ok = Lookup("quantum")
+	assert.False(t, ok)
+
+	var names []string
+	for _, s := range Strategies() {
+		names = append(names, s.Name())
+		assert.NotEmpty(t, s.Description())
+	}
+	assert.Equal(t, []string{"constrained", "greedy", "min_fee", "minimal", "naive"}, names)
+
+	assert.Panics(t, func() {
+		Register(NewStrategy("greedy", "duplicate", SettleOptimized))
+	})
+
+	balances := map[string]decimal.Decimal{"A": decimal.NewFromInt(10), "B": decimal.NewFromInt(-10)}
+	for _, s := range Strategies() {
+		assert.Equal(t, 1, len(s.Settle(balances)), s.Name())
+	}
+}
+
+func TestStrategiesAreDeterministic(t *testing.T) {
+	// Lots of equal amounts, so only the tie-breaking decides the order
+	balances := map[string]decimal.Decimal{
+		"A": decimal.NewFromInt(-10), "B": decimal.NewFromInt(-10), "C": decimal.NewFromInt(-10),
+		"D": decimal.NewFromInt(10), "E": decimal.NewFromInt(10), "F": decimal.NewFromInt(10),
+	}
+	for _, s := range Strategies() {
+		first := s.Settle(balances)
+		for i := 0; i < 20; i++ {
+			assert.Equal(t, first, s.Settle(balances), s.Name())
+		}
+	}
+}
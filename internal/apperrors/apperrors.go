@@ -0,0 +1,103 @@
+// Package apperrors defines the errors the API reports to clients. Each error has a
+// kind, which decides the HTTP status, and a stable code clients can match on instead
+// of the message.
+package apperrors
+
+import (
+	"errors"
+	"net/http"
+)
+
+type Kind int
+
+const (
+	KindInternal        Kind = iota // Something went wrong on our side
+	KindInvalid                     // The request itself is malformed or breaks a rule
+	KindNotFound                    // The record asked for does not exist
+	KindConflict                    // The request clashes with the current state, e.g. a duplicate
+	KindUnprocessable               // The request refers to records that do not exist
+	KindForbidden                   // The caller may not do this
+	KindUnauthenticated             // The caller hasn't said who they are, or couldn't prove it
+)
+
+// Status returns the HTTP status code for errors of this kind.
+func (k Kind) Status() int {
+	switch k {
+	case KindInvalid:
+		return http.StatusBadRequest
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindConflict:
+		return http.StatusConflict
+	case KindUnprocessable:
+		return http.StatusUnprocessableEntity
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindUnauthenticated:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Codes shared across the API. More specific codes, such as "username_taken", are
+// defined where the error is raised.
+const (
+	CodeInternal       = "internal"
+	CodeInvalidRequest = "invalid_request"
+	CodeNotFound       = "not_found"
+	CodeConflict       = "conflict"
+	CodeInvalidID      = "invalid_id"
+	CodeReference      = "reference_not_found"
+)
+
+// Error is an error with a kind and a stable code. Message is safe to show to clients;
+// Err, the underlying cause, is not.
+type Error struct {
+	Kind    Kind
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string { return e.Message }
+func (e *Error) Unwrap() error { return e.Err }
+
+func New(kind Kind, code, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+func Invalid(code, message string) *Error         { return New(KindInvalid, code, message) }
+func NotFound(code, message string) *Error        { return New(KindNotFound, code, message) }
+func Conflict(code, message string) *Error        { return New(KindConflict, code, message) }
+func Unprocessable(code, message string) *Error   { return New(KindUnprocessable, code, message) }
+func Forbidden(code, message string) *Error       { return New(KindForbidden, code, message) }
+func Unauthenticated(code, message string) *Error { return New(KindUnauthenticated, code, message) }
+
+// Wrap returns a copy of e with err recorded as its cause.
+func (e *Error) Wrap(err error) *Error {
+	c := *e
+	c.Err = err
+	return &c
+}
+
+// As returns the first *Error in err's chain.
+func As(err error) (*Error, bool) {
+	var e *Error
+	ok := errors.As(err, &e)
+	return e, ok
+}
+
+// KindOf returns the kind of the first *Error in err's chain, or KindInternal if
+// there is none.
+func KindOf(err error) Kind {
+	if e, ok := As(err); ok {
+		return e.Kind
+	}
+	return KindInternal
+}
+
+// IsNotFound reports whether err says a record does not exist.
+func IsNotFound(err error) bool {
+	return KindOf(err) == KindNotFound
+}
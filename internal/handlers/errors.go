@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/services"
+)
+
+// CodeValidationFailed is the code of a 400 that lists the rejected fields.
+const CodeValidationFailed = "validation_failed"
+
+// ErrorBody is the envelope every error response uses:
+//
+//	{"error": {"code": "group_not_found", "message": "group does not exist"}}
+//
+// Code is stable and meant for clients to match on; Message is for people.
+type ErrorBody struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message"`
+	Fields  services.FieldErrors `json:"fields,omitempty"`
+}
+
+// respondError writes err in the error envelope. Invalid client input is a 400, and
+// errors with an apperrors kind get that kind's status and code. Anything else is a
+// 500 whose details are logged rather than returned.
+func respondError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	body := ErrorBody{Code: apperrors.CodeInternal, Message: "internal server error"}
+
+	var verr *services.ValidationError
+	if errors.As(err, &verr) {
+		status, body.Code, body.Message = http.StatusBadRequest, apperrors.CodeInvalidRequest, err.Error()
+		if errors.As(err, &body.Fields) {
+			body.Code = CodeValidationFailed
+		}
+	} else if e, ok := apperrors.As(err); ok && e.Kind != apperrors.KindInternal {
+		status, body.Code, body.Message = e.Kind.Status(), e.Code, err.Error()
+	} else {
+		_ = c.Error(err)
+	}
+	c.JSON(status, gin.H{"error": body})
+}
+
+// invalidRequest reports a request that could not be read, such as malformed JSON.
+func invalidRequest(c *gin.Context, err error) {
+	respondError(c, apperrors.Invalid(apperrors.CodeInvalidRequest, err.Error()))
+}
+
+func errUnknownRoundingPolicy() error {
+	return apperrors.Invalid("unknown_rounding_policy",
+		"unknown rounding policy; available: "+strings.Join(services.RoundingPolicyNames(), ", "))
+}
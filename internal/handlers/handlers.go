@@ -1,10 +1,15 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
 	"github.com/user/debt-optimization-engine/internal/models"
 	"github.com/user/debt-optimization-engine/internal/repositories"
 	"github.com/user/debt-optimization-engine/internal/services"
@@ -12,139 +17,1050 @@ import (
 
 type Handler struct {
 	repo              repositories.Repository
+	expenseService    *services.ExpenseService
 	settlementService *services.SettlementService
+	fxService         *services.FXService
+	permissions       *services.PermissionService
+	auth              *services.AuthService
 }
 
-func NewHandler(repo repositories.Repository, ss *services.SettlementService) *Handler {
-	return &Handler{repo: repo, settlementService: ss}
+func NewHandler(repo repositories.Repository, es *services.ExpenseService, ss *services.SettlementService, fx *services.FXService, ps *services.PermissionService, as *services.AuthService) *Handler {
+	return &Handler{repo: repo, expenseService: es, settlementService: ss, fxService: fx, permissions: ps, auth: as}
 }
 
+// authorize checks that the user making the request may take action in the group named
+// by the :id parameter, and returns them. On failure the error has been written.
+func (h *Handler) authorize(c *gin.Context, action services.Action) (uuid.UUID, bool) {
+	by, err := actor(c)
+	if err == nil {
+		_, err = h.permissions.Authorize(c.Request.Context(), c.Param("id"), by, action)
+	}
+	if err != nil {
+		respondError(c, err)
+		return uuid.Nil, false
+	}
+	return by, true
+}
+
+// CreateUser signs a new user up. Without a password they log in with emailed codes.
 func (h *Handler) CreateUser(c *gin.Context) {
-	var user models.User
-	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	var req struct {
+		models.User
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
 		return
 	}
-	if err := h.repo.CreateUser(c.Request.Context(), &user); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	user := req.User
+	if err := h.auth.SignUp(c.Request.Context(), &user, req.Password); err != nil {
+		respondError(c, err)
 		return
 	}
 	c.JSON(http.StatusCreated, user)
 }
 
+// Login exchanges a username or email and password for a session token.
+func (h *Handler) Login(c *gin.Context) {
+	var req struct {
+		Login    string `json:"login" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	session, err := h.auth.Login(c.Request.Context(), req.Login, req.Password)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// RequestLoginCode emails a one-time login code. It answers the same whether or not
+// the email is registered.
+func (h *Handler) RequestLoginCode(c *gin.Context) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	if err := h.auth.RequestLoginCode(c.Request.Context(), req.Email); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "if the email is registered, a login code is on its way"})
+}
+
+// VerifyLoginCode exchanges an emailed code for a session token.
+func (h *Handler) VerifyLoginCode(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required"`
+		Code  string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	session, err := h.auth.VerifyLoginCode(c.Request.Context(), req.Email, req.Code)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// GetMe returns the logged-in user.
+func (h *Handler) GetMe(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		respondError(c, errAuthRequired)
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// SetPassword gives the logged-in user a new password. Sessions already issued stay
+// valid until they expire.
+func (h *Handler) SetPassword(c *gin.Context) {
+	by, err := actor(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	var req struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	if err := h.auth.SetPassword(c.Request.Context(), by, req.Password); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// CreateAPIToken makes a personal API token for scripts. The token is only shown in
+// this response.
+func (h *Handler) CreateAPIToken(c *gin.Context) {
+	by, err := actor(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	var req struct {
+		Name      string     `json:"name"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	token, err := h.auth.CreateAPIToken(c.Request.Context(), by, req.Name, req.ExpiresAt)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, token)
+}
+
+func (h *Handler) ListAPITokens(c *gin.Context) {
+	by, err := actor(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	tokens, err := h.auth.ListAPITokens(c.Request.Context(), by)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (h *Handler) RevokeAPIToken(c *gin.Context) {
+	by, err := actor(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := h.auth.RevokeAPIToken(c.Request.Context(), by, c.Param("tokenId")); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) GetUser(c *gin.Context) {
+	user, err := h.repo.GetUser(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// Page sizes for user search.
+const (
+	defaultUserSearchLimit = 20
+	maxUserSearchLimit     = 100
+)
+
+// SearchUsers finds users by part of their username or by their exact email (?q=), so
+// that clients can look up the IDs of people they want to add to a group.
+func (h *Handler) SearchUsers(c *gin.Context) {
+	text := strings.TrimSpace(c.Query("q"))
+	if text == "" {
+		respondError(c, services.Required("q"))
+		return
+	}
+	limit := defaultUserSearchLimit
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxUserSearchLimit {
+			respondError(c, apperrors.Invalid(apperrors.CodeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxUserSearchLimit)))
+			return
+		}
+		limit = n
+	}
+
+	users, err := h.repo.SearchUsers(c.Request.Context(), text, limit)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// GetUserGroups lists the groups the user making the request belongs to, oldest first.
+// Archived groups are only listed with ?include_archived=true.
+func (h *Handler) GetUserGroups(c *gin.Context) {
+	uid, err := self(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	groups, err := h.repo.GetGroupsByUser(c.Request.Context(), uid.String(), c.Query("include_archived") == "true")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+// CreateGroup creates a group owned by the user making the request.
 func (h *Handler) CreateGroup(c *gin.Context) {
+	owner, err := actor(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 	var group models.Group
 	if err := c.ShouldBindJSON(&group); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		invalidRequest(c, err)
 		return
 	}
-	if err := h.repo.CreateGroup(c.Request.Context(), &group); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if _, ok := services.LookupRoundingPolicy(group.RoundingPolicy); !ok {
+		respondError(c, errUnknownRoundingPolicy())
+		return
+	}
+	if group.RoundingPolicy == "" {
+		group.RoundingPolicy = services.DefaultRoundingPolicy
+	}
+	group.BaseCurrency = models.NormalizeCurrency(group.BaseCurrency)
+	if _, ok := models.CurrencyExponent(group.BaseCurrency); !ok {
+		respondError(c, apperrors.Invalid("unknown_currency", "unknown base currency"))
+		return
+	}
+	if err := h.repo.CreateGroup(c.Request.Context(), &group, owner); err != nil {
+		respondError(c, err)
 		return
 	}
 	c.JSON(http.StatusCreated, group)
 }
 
+func (h *Handler) GetGroup(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	group, err := h.repo.GetGroup(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, group)
+}
+
+// GetMembers lists the group's members and when each joined. With ?include_former=true
+// it is the group's whole membership history, including who left and when.
+func (h *Handler) GetMembers(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	members, err := h.repo.GetMemberships(c.Request.Context(), c.Param("id"), c.Query("include_former") == "true")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, members)
+}
+
+// UpdateGroupSettings changes group-level settings such as the rounding policy.
+func (h *Handler) UpdateGroupSettings(c *gin.Context) {
+	groupID := c.Param("id")
+	if _, ok := h.authorize(c, services.ActionManageGroup); !ok {
+		return
+	}
+	var req struct {
+		RoundingPolicy *string `json:"rounding_policy"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+
+	group, err := h.repo.GetGroup(c.Request.Context(), groupID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if req.RoundingPolicy != nil {
+		if _, ok := services.LookupRoundingPolicy(*req.RoundingPolicy); !ok || *req.RoundingPolicy == "" {
+			respondError(c, errUnknownRoundingPolicy())
+			return
+		}
+		group.RoundingPolicy = *req.RoundingPolicy
+	}
+
+	if err := h.repo.UpdateGroup(c.Request.Context(), group); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, group)
+}
+
+// AddMember adds a user to the group, as a MEMBER unless another role is given.
 func (h *Handler) AddMember(c *gin.Context) {
 	groupID := c.Param("id")
+	if _, ok := h.authorize(c, services.ActionManageMembers); !ok {
+		return
+	}
 	var req struct {
-		UserID string `json:"user_id" binding:"required"`
+		UserID string      `json:"user_id" binding:"required"`
+		Role   models.Role `json:"role"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		invalidRequest(c, err)
+		return
+	}
+	role, err := services.JoiningRole(req.Role)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	group, err := h.repo.GetGroup(c.Request.Context(), groupID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := services.RequireActive(group); err != nil {
+		respondError(c, err)
 		return
 	}
-	if err := h.repo.AddMemberToGroup(c.Request.Context(), groupID, req.UserID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := h.repo.AddMemberToGroup(c.Request.Context(), groupID, req.UserID, role); err != nil {
+		respondError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "user added to group"})
 }
 
+// CloseGroup freezes the group's expenses and creates its final settlement plan.
+func (h *Handler) CloseGroup(c *gin.Context) {
+	by, ok := h.authorize(c, services.ActionManageGroup)
+	if !ok {
+		return
+	}
+	closure, err := h.settlementService.CloseGroup(c.Request.Context(), c.Param("id"), by)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, closure)
+}
+
+// ReopenGroup makes a closed group active again. A reason is required and logged.
+func (h *Handler) ReopenGroup(c *gin.Context) {
+	by, ok := h.authorize(c, services.ActionManageGroup)
+	if !ok {
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	group, err := h.settlementService.ReopenGroup(c.Request.Context(), c.Param("id"), by, req.Reason)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, group)
+}
+
+func (h *Handler) GetGroupStatusHistory(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	changes, err := h.settlementService.GroupHistory(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, changes)
+}
+
+// RemoveMember takes a member out of the group. See removalOptions for what happens to
+// their balance.
+func (h *Handler) RemoveMember(c *gin.Context) {
+	by, err := actor(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	h.removeMember(c, c.Param("userId"), by)
+}
+
+// LeaveGroup takes the logged-in user out of the group.
+func (h *Handler) LeaveGroup(c *gin.Context) {
+	by, err := actor(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	h.removeMember(c, by.String(), by)
+}
+
+func (h *Handler) removeMember(c *gin.Context, userID string, by uuid.UUID) {
+	target, err := services.ParseID("user_id", userID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := h.permissions.AuthorizeRemoval(c.Request.Context(), c.Param("id"), by, target); err != nil {
+		respondError(c, err)
+		return
+	}
+	opts, err := removalOptions(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	removed, err := h.settlementService.RemoveMember(c.Request.Context(), c.Param("id"), userID, by, opts)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, removed)
+}
+
+// SetMemberRole changes a member's role. Making someone the OWNER hands ownership on.
+func (h *Handler) SetMemberRole(c *gin.Context) {
+	by, err := actor(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	var req struct {
+		Role models.Role `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	member, err := h.permissions.SetRole(c.Request.Context(), c.Param("id"), c.Param("userId"), by, req.Role)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, member)
+}
+
+// removalOptions reads what to do with a leaving member's balance: ?transfer_to= a
+// member who takes it over, or ?write_off=true to share it between everyone staying.
+func removalOptions(c *gin.Context) (models.MemberRemoval, error) {
+	var opts models.MemberRemoval
+	if v := c.Query("transfer_to"); v != "" {
+		id, err := services.ParseID("transfer_to", v)
+		if err != nil {
+			return opts, err
+		}
+		opts.TransferTo = &id
+	}
+	opts.WriteOff = c.Query("write_off") == "true"
+	return opts, nil
+}
+
+// CreateExpense adds an expense, recording the logged-in user as who added it. They
+// need not be the one who paid.
 func (h *Handler) CreateExpense(c *gin.Context) {
 	groupID := c.Param("id")
+	by, ok := h.authorize(c, services.ActionAddExpense)
+	if !ok {
+		return
+	}
 	var expense models.Expense
 	if err := c.ShouldBindJSON(&expense); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		invalidRequest(c, err)
+		return
+	}
+
+	gid, err := services.ParseID("group_id", groupID)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
-	
-	gid, _ := models.ParseUUID(groupID) 
 	expense.GroupID = gid
 
-	// Logic for equal splits if only user IDs are provided without amounts
-	if expense.SplitType == models.SplitEqual && len(expense.Splits) > 0 {
-		userIDs := make([]string, len(expense.Splits))
-		for i, s := range expense.Splits {
-			userIDs[i] = s.UserID.String()
-		}
-		amounts := services.CalculateEqualSplits(expense.Amount, userIDs)
-		for i := range expense.Splits {
-			expense.Splits[i].Amount = amounts[i]
-		}
+	if err := h.expenseService.CreateExpense(c.Request.Context(), &expense, &by); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, expense)
+}
+
+// ListExpenses returns a page of the group's expenses, newest first. See
+// services.ExpenseQuery for the filters.
+func (h *Handler) ListExpenses(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	var q services.ExpenseQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		invalidRequest(c, err)
+		return
 	}
+	page, err := h.expenseService.ListExpenses(c.Request.Context(), c.Param("id"), q)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
 
-	if err := services.ValidateSplits(&expense); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// authorizeExpenseEdit checks that the user making the request may change the expense
+// named by :expenseId, and returns them. On failure the error has been written.
+func (h *Handler) authorizeExpenseEdit(c *gin.Context) (uuid.UUID, bool) {
+	by, err := actor(c)
+	if err == nil {
+		err = h.permissions.AuthorizeExpenseEdit(c.Request.Context(), c.Param("id"), c.Param("expenseId"), by)
+	}
+	if err != nil {
+		respondError(c, err)
+		return uuid.Nil, false
+	}
+	return by, true
+}
+
+// GetExpense returns an expense, including one that has been deleted.
+func (h *Handler) GetExpense(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	expense, err := h.expenseService.GetExpense(c.Request.Context(), c.Param("id"), c.Param("expenseId"))
+	if err != nil {
+		respondError(c, err)
 		return
 	}
+	c.JSON(http.StatusOK, expense)
+}
 
-	if err := h.repo.CreateExpense(c.Request.Context(), &expense); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+// UpdateExpense replaces an expense. The body is the whole expense, as for creating
+// one; include "version" to be told if someone else changed it first.
+func (h *Handler) UpdateExpense(c *gin.Context) {
+	var update models.Expense
+	if err := c.ShouldBindJSON(&update); err != nil {
+		invalidRequest(c, err)
 		return
 	}
-	c.JSON(http.StatusCreated, expense)
+	by, ok := h.authorizeExpenseEdit(c)
+	if !ok {
+		return
+	}
+	expense, err := h.expenseService.UpdateExpense(c.Request.Context(), c.Param("id"), c.Param("expenseId"), by, &update)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, expense)
 }
 
-func (h *Handler) GetSettlement(c *gin.Context) {
-	groupID := c.Param("id")
-	
-	fromStr := c.Query("from")
-	toStr := c.Query("to")
+// DeleteExpense removes an expense from the group's balances. It can be restored.
+func (h *Handler) DeleteExpense(c *gin.Context) {
+	by, ok := h.authorizeExpenseEdit(c)
+	if !ok {
+		return
+	}
+	expense, err := h.expenseService.DeleteExpense(c.Request.Context(), c.Param("id"), c.Param("expenseId"), by)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, expense)
+}
+
+func (h *Handler) RestoreExpense(c *gin.Context) {
+	by, ok := h.authorizeExpenseEdit(c)
+	if !ok {
+		return
+	}
+	expense, err := h.expenseService.RestoreExpense(c.Request.Context(), c.Param("id"), c.Param("expenseId"), by)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, expense)
+}
+
+// GetExpenseRevisions lists every version of an expense, oldest first.
+func (h *Handler) GetExpenseRevisions(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	revisions, err := h.expenseService.ExpenseHistory(c.Request.Context(), c.Param("id"), c.Param("expenseId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, revisions)
+}
+
+// DiffExpense shows what changed between ?from= and ?to= versions of an expense. By
+// default it compares the latest version with the one before.
+func (h *Handler) DiffExpense(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	from, err := versionParam(c, "from")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	to, err := versionParam(c, "to")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	diff, err := h.expenseService.DiffExpense(c.Request.Context(), c.Param("id"), c.Param("expenseId"), from, to)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, diff)
+}
+
+// versionParam reads an optional expense version from the query, returning 0 if unset.
+func versionParam(c *gin.Context, name string) (int, error) {
+	s := c.Query(name)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, apperrors.Invalid(apperrors.CodeInvalidRequest, fmt.Sprintf("%s must be a version number", name))
+	}
+	return n, nil
+}
+
+// GetExpenseItems shows the line items of an itemized expense and what each person was
+// charged for them. Pass ?user_id= to see a single person's charges.
+func (h *Handler) GetExpenseItems(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	expense, err := h.expenseService.GetExpense(c.Request.Context(), c.Param("id"), c.Param("expenseId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	items, adjustments := expense.Items, expense.Adjustments
+
+	if userStr := c.Query("user_id"); userStr != "" {
+		uid, err := services.ParseID("user_id", userStr)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		items, adjustments = filterCharges(items, adjustments, uid)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": items, "adjustments": adjustments})
+}
+
+func filterCharges(items []models.ExpenseItem, adjustments []models.Adjustment, userID uuid.UUID) ([]models.ExpenseItem, []models.Adjustment) {
+	keep := func(shares []models.ChargeShare) []models.ChargeShare {
+		var out []models.ChargeShare
+		for _, s := range shares {
+			if s.UserID == userID {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+
+	var outItems []models.ExpenseItem
+	for _, item := range items {
+		if item.Shares = keep(item.Shares); len(item.Shares) > 0 {
+			outItems = append(outItems, item)
+		}
+	}
+	var outAdj []models.Adjustment
+	for _, adj := range adjustments {
+		if adj.Shares = keep(adj.Shares); len(adj.Shares) > 0 {
+			outAdj = append(outAdj, adj)
+		}
+	}
+	return outItems, outAdj
+}
 
-	var from, to *time.Time
-	if fromStr != "" {
-		if t, err := time.Parse("2006-01-02", fromStr); err == nil { from = &t }
+func (h *Handler) GetSettlement(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
 	}
-	if toStr != "" {
-		if t, err := time.Parse("2006-01-02", toStr); err == nil { to = &t }
+	groupID := c.Param("id")
+	from, to, ok := dateRange(c)
+	if !ok {
+		return
 	}
 
-	resp, err := h.settlementService.GetSettlement(c.Request.Context(), groupID, from, to)
+	resp, err := h.settlementService.GetSettlement(c.Request.Context(), groupID, from, to, c.Query("currency"), c.Query("strategy"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, resp)
 }
 
 func (h *Handler) GetBalances(c *gin.Context) {
-	groupID := c.Param("id")
-	fromStr := c.Query("from")
-	toStr := c.Query("to")
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	from, to, ok := dateRange(c)
+	if !ok {
+		return
+	}
+	balances, err := h.settlementService.GroupBalances(c.Request.Context(), c.Param("id"), from, to)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, balances)
+}
 
-	var from, to *time.Time
-	if fromStr != "" {
-		if t, err := time.Parse("2006-01-02", fromStr); err == nil { from = &t }
+func (h *Handler) RecordPayment(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionSettleUp); !ok {
+		return
+	}
+	var payment models.SettlementPayment
+	if err := c.ShouldBindJSON(&payment); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	gid, err := services.ParseID("group_id", c.Param("id"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	payment.GroupID = gid
+
+	if err := h.settlementService.RecordPayment(c.Request.Context(), &payment); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, payment)
+}
+
+func (h *Handler) ListPayments(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
 	}
-	if toStr != "" {
-		if t, err := time.Parse("2006-01-02", toStr); err == nil { to = &t }
+	groupID := c.Param("id")
+	from, to, ok := dateRange(c)
+	if !ok {
+		return
 	}
 
-	balances, err := h.settlementService.CalculateBalances(c.Request.Context(), groupID, from, to)
+	payments, err := h.repo.GetSettlementPaymentsByGroup(c.Request.Context(), groupID, from, to)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
-	c.JSON(http.StatusOK, balances)
+	c.JSON(http.StatusOK, payments)
 }
 
 func (h *Handler) CompareStrategies(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
 	groupID := c.Param("id")
 	cmp, err := h.settlementService.CompareStrategies(c.Request.Context(), groupID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, cmp)
 }
+
+// dateRange reads the optional ?from= and ?to= days (YYYY-MM-DD) of a request, the
+// way services.DateRange does: to comes back as the midnight after that day. It
+// responds with the error and returns false if either is malformed.
+func dateRange(c *gin.Context) (from, to *time.Time, ok bool) {
+	from, to, err := services.DateRange(c.Query("from"), c.Query("to"))
+	if err != nil {
+		respondError(c, err)
+		return nil, nil, false
+	}
+	return from, to, true
+}
+
+// ExplainSettlement returns the settlement plan with the reasons behind each transfer.
+func (h *Handler) ExplainSettlement(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	from, to, ok := dateRange(c)
+	if !ok {
+		return
+	}
+	ex, err := h.settlementService.ExplainSettlement(c.Request.Context(), c.Param("id"), from, to, c.Query("strategy"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ex)
+}
+
+// GetBalanceBreakdown lists the expenses and payments behind one member's balance.
+func (h *Handler) GetBalanceBreakdown(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	from, to, ok := dateRange(c)
+	if !ok {
+		return
+	}
+	b, err := h.settlementService.BalanceBreakdown(c.Request.Context(), c.Param("id"), c.Param("userId"), from, to)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, b)
+}
+
+// CreateSettlementPlan saves the current settlement as a plan members can pay off.
+func (h *Handler) CreateSettlementPlan(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionSettleUp); !ok {
+		return
+	}
+	plan, err := h.settlementService.CreatePlan(c.Request.Context(), c.Param("id"), c.Query("strategy"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, plan)
+}
+
+func (h *Handler) GetCurrentSettlementPlan(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	plan, err := h.settlementService.CurrentPlan(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+func (h *Handler) GetSettlementPlan(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	plan, err := h.settlementService.GetPlan(c.Request.Context(), c.Param("id"), c.Param("planId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// UpdatePlanTransfer marks a transfer in a plan as paid, partly paid or disputed.
+func (h *Handler) UpdatePlanTransfer(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionSettleUp); !ok {
+		return
+	}
+	var update models.TransferUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	plan, err := h.settlementService.UpdateTransfer(c.Request.Context(), c.Param("id"), c.Param("planId"), c.Param("transferId"), update)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+func (h *Handler) GetPaymentConstraints(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionView); !ok {
+		return
+	}
+	constraints, err := h.settlementService.GetPaymentConstraints(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, constraints)
+}
+
+// SetPaymentConstraints replaces the group's whole payment network.
+func (h *Handler) SetPaymentConstraints(c *gin.Context) {
+	if _, ok := h.authorize(c, services.ActionManageGroup); !ok {
+		return
+	}
+	var constraints models.PaymentConstraints
+	if err := c.ShouldBindJSON(&constraints); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	if err := h.settlementService.SetPaymentConstraints(c.Request.Context(), c.Param("id"), &constraints); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, constraints)
+}
+
+// GetUserSettlement nets a user's debts with each counterparty across all their groups.
+// Only the user themself can see it.
+func (h *Handler) GetUserSettlement(c *gin.Context) {
+	uid, err := self(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	plan, err := h.settlementService.ConsolidatedSettlement(c.Request.Context(), uid, c.Query("currency"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// RecordUserSettlement records consolidated transfers as payments in every group they
+// pay off. Without counterparty_ids the whole plan is recorded.
+func (h *Handler) RecordUserSettlement(c *gin.Context) {
+	uid, err := self(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	var req struct {
+		Currency        string      `json:"currency"`
+		CounterpartyIDs []uuid.UUID `json:"counterparty_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	payments, err := h.settlementService.RecordConsolidatedSettlement(c.Request.Context(), uid, req.Currency, req.CounterpartyIDs)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, payments)
+}
+
+// GetPaymentMethods lists a user's payment methods, for the user and anyone in a group
+// with them.
+func (h *Handler) GetPaymentMethods(c *gin.Context) {
+	viewer, err := actor(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	methods, err := h.settlementService.GetPaymentMethods(c.Request.Context(), viewer, c.Param("id"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, methods)
+}
+
+// SetPaymentMethods replaces all of a user's payment methods.
+func (h *Handler) SetPaymentMethods(c *gin.Context) {
+	uid, err := self(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	var req struct {
+		Methods []models.PaymentMethod `json:"methods"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	if req.Methods == nil {
+		req.Methods = []models.PaymentMethod{}
+	}
+	if err := h.settlementService.SetPaymentMethods(c.Request.Context(), uid, req.Methods); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, req.Methods)
+}
+
+func (h *Handler) LoadFXRates(c *gin.Context) {
+	var req struct {
+		Rates []models.FXRate `json:"rates" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidRequest(c, err)
+		return
+	}
+	if err := h.fxService.LoadRates(c.Request.Context(), req.Rates); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"loaded": len(req.Rates)})
+}
+
+func (h *Handler) ListFXRates(c *gin.Context) {
+	from, to, ok := dateRange(c)
+	if !ok {
+		return
+	}
+
+	base := c.Query("base")
+	if base != "" {
+		base = models.NormalizeCurrency(base)
+	}
+	quote := c.Query("quote")
+	if quote != "" {
+		quote = models.NormalizeCurrency(quote)
+	}
+
+	rates, err := h.repo.GetFXRates(c.Request.Context(), base, quote, from, to)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rates)
+}
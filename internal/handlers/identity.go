@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+	"github.com/user/debt-optimization-engine/internal/services"
+)
+
+const userKey = "user"
+
+var errAuthRequired = apperrors.Unauthenticated("authentication_required",
+	"log in and send the token as \"Authorization: Bearer <token>\"")
+
+// Authenticate reads the bearer token from the Authorization header and puts the user
+// it belongs to into the request context. A request without a token carries no user;
+// one with a bad, expired or revoked token is rejected.
+func Authenticate(auth *services.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if header == "" {
+			c.Next()
+			return
+		}
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			respondError(c, errAuthRequired)
+			c.Abort()
+			return
+		}
+		user, err := auth.Authenticate(c.Request.Context(), strings.TrimSpace(token))
+		if err != nil {
+			respondError(c, err)
+			c.Abort()
+			return
+		}
+		c.Set(userKey, user)
+		c.Next()
+	}
+}
+
+// RequireUser rejects requests that don't carry a logged-in user.
+func RequireUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get(userKey); !ok {
+			respondError(c, errAuthRequired)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireOperator lets through only the given users, for changes to data every group
+// depends on. With no operators configured nobody gets through.
+func RequireOperator(operators []uuid.UUID) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := actor(c)
+		if err == nil && !slices.Contains(operators, id) {
+			err = apperrors.Forbidden("operator_only", "only the server's operators can do this")
+		}
+		if err != nil {
+			respondError(c, err)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// currentUser returns the logged-in user making the request, if there is one.
+func currentUser(c *gin.Context) (*models.User, bool) {
+	if v, ok := c.Get(userKey); ok {
+		return v.(*models.User), true
+	}
+	return nil, false
+}
+
+// actor returns the ID of the logged-in user making the request.
+func actor(c *gin.Context) (uuid.UUID, error) {
+	if user, ok := currentUser(c); ok {
+		return user.ID, nil
+	}
+	return uuid.Nil, errAuthRequired
+}
+
+// self checks that the user making the request is the user named by the :id
+// parameter, for changes people may only make for themselves.
+func self(c *gin.Context) (uuid.UUID, error) {
+	id, err := actor(c)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if c.Param("id") != id.String() {
+		return uuid.Nil, apperrors.Forbidden("permission_denied", "you can only do this for yourself")
+	}
+	return id, nil
+}
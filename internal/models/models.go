@@ -15,9 +15,40 @@ type User struct {
 }
 
 type Group struct {
-	ID        uuid.UUID `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"created_at"`
+	ID             uuid.UUID   `json:"id"`
+	Name           string      `json:"name"`
+	RoundingPolicy string      `json:"rounding_policy"` // Who absorbs leftover cents when splitting
+	BaseCurrency   string      `json:"base_currency"`   // Balances and settlements are worked out in this currency
+	Status         GroupStatus `json:"status"`
+	CreatedAt      time.Time   `json:"created_at"`
+}
+
+// GroupStatus is where a group is in its life. Expenses can only be added to an
+// ACTIVE group. Closing it moves it to SETTLING with a final settlement plan, and
+// it becomes ARCHIVED once that plan is paid.
+type GroupStatus string
+
+const (
+	GroupActive   GroupStatus = "ACTIVE"
+	GroupSettling GroupStatus = "SETTLING"
+	GroupArchived GroupStatus = "ARCHIVED"
+)
+
+// GroupStatusChange is one entry in a group's status log.
+type GroupStatusChange struct {
+	ID        uuid.UUID   `json:"id"`
+	GroupID   uuid.UUID   `json:"group_id"`
+	From      GroupStatus `json:"from"`
+	To        GroupStatus `json:"to"`
+	ChangedBy *uuid.UUID  `json:"changed_by,omitempty"` // Unset for automatic changes, such as archiving
+	Reason    string      `json:"reason,omitempty"`
+	ChangedAt time.Time   `json:"changed_at"`
+}
+
+// GroupClosure is a group that has just been closed, with its final settlement plan.
+type GroupClosure struct {
+	Group Group           `json:"group"`
+	Plan  *SettlementPlan `json:"plan"`
 }
 
 type GroupMember struct {
@@ -26,63 +57,553 @@ type GroupMember struct {
 	JoinedAt time.Time `json:"joined_at"`
 }
 
+// Role is what a member may do in a group. Each role can do everything the ones below
+// it can: viewers only read, members add expenses and payments and edit their own
+// expenses, admins manage members, settings and everyone's expenses, and the one owner
+// can also hand ownership on.
+type Role string
+
+const (
+	RoleOwner  Role = "OWNER"
+	RoleAdmin  Role = "ADMIN"
+	RoleMember Role = "MEMBER"
+	RoleViewer Role = "VIEWER"
+)
+
+var roleRanks = map[Role]int{RoleViewer: 1, RoleMember: 2, RoleAdmin: 3, RoleOwner: 4}
+
+// Valid reports whether r is one of the known roles.
+func (r Role) Valid() bool {
+	return roleRanks[r] > 0
+}
+
+// AtLeast reports whether r can do everything other can.
+func (r Role) AtLeast(other Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[other]
+}
+
+// Member is a user as a member of a group. A user who leaves and rejoins has one
+// Member for each time they were in the group.
+type Member struct {
+	User
+	Role      Role       `json:"role"`
+	JoinedAt  time.Time  `json:"joined_at"`
+	LeftAt    *time.Time `json:"left_at,omitempty"`    // Set once the user has left or been removed
+	RemovedBy *uuid.UUID `json:"removed_by,omitempty"` // Who removed them; the user themself if they left
+}
+
+// MemberRemoval says what happens to the outstanding balance of a member who leaves.
+// A member with a balance can only leave if one of the two is chosen.
+type MemberRemoval struct {
+	TransferTo *uuid.UUID // Another member takes the balance over
+	WriteOff   bool       // The remaining members absorb it, shared equally
+}
+
+// RemovedMember is the outcome of a member leaving a group: their balance when they
+// left and the payments recorded to clear it.
+type RemovedMember struct {
+	GroupID  uuid.UUID           `json:"group_id"`
+	User     UserSummary         `json:"user"`
+	LeftAt   time.Time           `json:"left_at"`
+	Balance  decimal.Decimal     `json:"balance"`
+	Payments []SettlementPayment `json:"payments"`
+}
+
 type SplitType string
 
 const (
 	SplitEqual      SplitType = "EQUAL"
 	SplitPercentage SplitType = "PERCENTAGE"
 	SplitExact      SplitType = "EXACT"
+	SplitShares     SplitType = "SHARES"
+	SplitItemized   SplitType = "ITEMIZED"
 )
 
 type Expense struct {
-	ID          uuid.UUID       `json:"id"`
-	GroupID     uuid.UUID       `json:"group_id"`
-	PayerID     uuid.UUID       `json:"payer_id"`
-	Amount      decimal.Decimal `json:"amount"`
-	Description string          `json:"description"`
-	SplitType   SplitType       `json:"split_type"`
-	CreatedAt   time.Time       `json:"created_at"`
-	Splits      []ExpenseSplit  `json:"splits"`
+	ID           uuid.UUID       `json:"id"`
+	GroupID      uuid.UUID       `json:"group_id"`
+	PayerID      uuid.UUID       `json:"payer_id"`
+	Amount       decimal.Decimal `json:"amount"`
+	Currency     string          `json:"currency"`      // ISO-4217, defaults to DefaultCurrency
+	ExchangeRate decimal.Decimal `json:"exchange_rate"` // 1 Currency = ExchangeRate group base currency
+	Description  string          `json:"description"`
+	SplitType    SplitType       `json:"split_type"`
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+	CreatedBy    *uuid.UUID      `json:"created_by,omitempty"` // The member who added it, if known; not necessarily the payer
+	Version      int             `json:"version"`              // Goes up by one with every change
+	DeletedAt    *time.Time      `json:"deleted_at,omitempty"` // Set while the expense is deleted
+	Payers       []ExpensePayer  `json:"payers,omitempty"`     // Defaults to PayerID paying the full amount
+	Splits       []ExpenseSplit  `json:"splits"`
+	Items        []ExpenseItem   `json:"items,omitempty"`       // ITEMIZED expenses only
+	Adjustments  []Adjustment    `json:"adjustments,omitempty"` // Tax, tip etc. on an ITEMIZED receipt
+
+	RoundingSequence int64 `json:"-"` // Expenses the group had when this one was created; edits keep rounding with it
 }
 
-type ExpenseSplit struct {
+// Money returns the expense total in the expense's currency.
+func (e *Expense) Money() Money {
+	return Money{Amount: e.Amount, Currency: NormalizeCurrency(e.Currency)}
+}
+
+// In returns an amount expressed in the expense's currency, e.g. a split or payer amount.
+func (e *Expense) In(amount decimal.Decimal) Money {
+	return Money{Amount: amount, Currency: NormalizeCurrency(e.Currency)}
+}
+
+type ExpenseAction string
+
+const (
+	ExpenseCreated  ExpenseAction = "CREATED"
+	ExpenseUpdated  ExpenseAction = "UPDATED"
+	ExpenseDeleted  ExpenseAction = "DELETED"
+	ExpenseRestored ExpenseAction = "RESTORED"
+)
+
+// ExpenseRevision is one version of an expense: what was done, by whom, and the
+// expense as it was afterwards.
+type ExpenseRevision struct {
+	ID        uuid.UUID     `json:"id"`
+	ExpenseID uuid.UUID     `json:"expense_id"`
+	Version   int           `json:"version"`
+	Action    ExpenseAction `json:"action"`
+	ChangedBy *uuid.UUID    `json:"changed_by,omitempty"` // Unknown for expenses created before revisions were kept
+	ChangedAt time.Time     `json:"changed_at"`
+	Expense   Expense       `json:"expense"`
+}
+
+// ExpenseDiff lists what changed in an expense between two versions.
+type ExpenseDiff struct {
+	ExpenseID   uuid.UUID     `json:"expense_id"`
+	FromVersion int           `json:"from_version"`
+	ToVersion   int           `json:"to_version"`
+	Changes     []FieldChange `json:"changes"`
+}
+
+// FieldChange is one field that differs between two versions. Before or After is
+// null when the field was added or removed, e.g. a participant joining the split.
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// ExpenseFilter selects a page of a group's expenses. Unset fields match every
+// expense. Expenses are ordered by CreatedAt and then ID, newest first unless
+// Ascending is set.
+type ExpenseFilter struct {
+	PayerID        *uuid.UUID
+	ParticipantID  *uuid.UUID
+	SplitType      SplitType
+	MinAmount      *decimal.Decimal // In the group's base currency
+	MaxAmount      *decimal.Decimal
+	From           *time.Time
+	Before         *time.Time // Exclusive, so a whole end day is the next midnight
+	Description    string     // Matched anywhere in the description, ignoring case
+	IncludeDeleted bool
+	Ascending      bool
+	After          *ExpenseCursor // Only expenses after this one in the order
+	Limit          int
+}
+
+// ExpenseCursor is the position of an expense in a listing. CreatedAt and ID never
+// change, so a cursor stays valid while expenses are added.
+type ExpenseCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// ExpensePage is one page of a group's expenses. NextCursor is empty on the last page.
+type ExpensePage struct {
+	Expenses   []Expense `json:"expenses"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// ExpensePayer is one of the people who paid for an expense, e.g. one of two cards.
+type ExpensePayer struct {
 	ExpenseID uuid.UUID       `json:"expense_id"`
 	UserID    uuid.UUID       `json:"user_id"`
 	Amount    decimal.Decimal `json:"amount"`
 }
 
+type ExpenseSplit struct {
+	ExpenseID   uuid.UUID        `json:"expense_id"`
+	UserID      uuid.UUID        `json:"user_id"`
+	Amount      decimal.Decimal  `json:"amount"`
+	Percentage  *decimal.Decimal `json:"percentage,omitempty"`   // PERCENTAGE splits only, as entered
+	BasisPoints *int64           `json:"basis_points,omitempty"` // Alternative to Percentage (1% = 100bp)
+	Shares      *decimal.Decimal `json:"shares,omitempty"`       // SHARES splits only, the participant's weight
+}
+
+// ExpenseItem is one line of an itemized receipt, shared equally by its participants.
+type ExpenseItem struct {
+	ID           uuid.UUID       `json:"id"`
+	ExpenseID    uuid.UUID       `json:"expense_id"`
+	Description  string          `json:"description"`
+	Amount       decimal.Decimal `json:"amount"`
+	Participants []uuid.UUID     `json:"participants"`
+	Shares       []ChargeShare   `json:"shares"` // Filled in by the service
+}
+
+type AdjustmentKind string
+
+const (
+	AdjustmentTax           AdjustmentKind = "TAX"
+	AdjustmentServiceCharge AdjustmentKind = "SERVICE_CHARGE"
+	AdjustmentTip           AdjustmentKind = "TIP"
+	AdjustmentDiscount      AdjustmentKind = "DISCOUNT"
+)
+
+// Adjustment is a receipt-level charge (or discount) spread across participants in
+// proportion to what each consumed. Amount is always positive; discounts are subtracted.
+type Adjustment struct {
+	ID        uuid.UUID       `json:"id"`
+	ExpenseID uuid.UUID       `json:"expense_id"`
+	Kind      AdjustmentKind  `json:"kind"`
+	Amount    decimal.Decimal `json:"amount"`
+	Shares    []ChargeShare   `json:"shares"` // Filled in by the service
+}
+
+// ChargeShare is the part of an item or adjustment charged to one user.
+type ChargeShare struct {
+	UserID uuid.UUID       `json:"user_id"`
+	Amount decimal.Decimal `json:"amount"`
+}
+
+// FXRate is a locally loaded exchange rate: 1 Base = Rate Quote on Date.
+type FXRate struct {
+	Date  string          `json:"date"` // YYYY-MM-DD
+	Base  string          `json:"base"`
+	Quote string          `json:"quote"`
+	Rate  decimal.Decimal `json:"rate"`
+}
+
+// UserSummary identifies a user in balances and settlements. People are always
+// matched by ID; the username is only there to display.
+type UserSummary struct {
+	ID       uuid.UUID `json:"id"`
+	Username string    `json:"username"`
+}
+
+func (u User) Summary() UserSummary {
+	return UserSummary{ID: u.ID, Username: u.Username}
+}
+
+// UserBalance is a member's net balance. Positive means the member is owed money.
+type UserBalance struct {
+	User    UserSummary     `json:"user"`
+	Balance decimal.Decimal `json:"balance"`
+}
+
 type GroupBalances struct {
-	GroupID  uuid.UUID                  `json:"group_id"`
-	Balances map[string]decimal.Decimal `json:"balances"` // Username -> Balance
+	GroupID  uuid.UUID     `json:"group_id"`
+	Currency string        `json:"currency"`
+	Balances []UserBalance `json:"balances"` // Ordered by username
+}
+
+// Transfer is one payment in a settlement plan.
+type Transfer struct {
+	From       UserSummary     `json:"from"`
+	To         UserSummary     `json:"to"`
+	Amount     decimal.Decimal `json:"amount"`
+	Method     string          `json:"method,omitempty"`      // Payment method the fee was worked out for
+	Fee        decimal.Decimal `json:"fee"`                   // Expected fee, paid by the sender
+	FeeUnknown bool            `json:"fee_unknown,omitempty"` // The method's fees are in a currency with no rate, so Fee leaves them out
 }
 
 type SettlementResponse struct {
-	Transactions         interface{} `json:"transactions"`
-	TotalTransactions    int         `json:"total_transactions"`
-	OptimizationGain     string      `json:"optimization_gain"`
-	RawBalances          interface{} `json:"raw_balances,omitempty"`
+	Transactions      []Transfer    `json:"transactions"`
+	TotalTransactions int           `json:"total_transactions"`
+	OptimizationGain  string        `json:"optimization_gain"`
+	Strategy          string        `json:"strategy"`
+	Currency          string        `json:"currency"`
+	ExchangeRate      string        `json:"exchange_rate,omitempty"` // Set when settling in a currency other than the base
+	TotalFees         string        `json:"total_fees"`              // Expected fees of the plan, in the settlement currency
+	RawBalances       []UserBalance `json:"raw_balances,omitempty"`  // Always in the group's base currency
 }
 
 type SettlementComparison struct {
-	Greedy   SettlementStats `json:"greedy"`
-	Baseline SettlementStats `json:"baseline"`
+	Baseline   string            `json:"baseline"` // Strategy the optimization gains are measured against
+	Strategies []SettlementStats `json:"strategies"`
 }
 
 type SettlementStats struct {
-	TransactionCount int             `json:"transaction_count"`
-	TotalVolume      decimal.Decimal `json:"total_volume"`
-	OptimizationGain string          `json:"optimization_gain"`
+	Strategy              string          `json:"strategy"`
+	Description           string          `json:"description"`
+	TransactionCount      int             `json:"transaction_count"`
+	TotalVolume           decimal.Decimal `json:"total_volume"`
+	MaxTransfersPerPerson int             `json:"max_transfers_per_person"` // Most transfers any one person has to send
+	OptimizationGain      string          `json:"optimization_gain"`
+	TotalFees             decimal.Decimal `json:"total_fees"`           // Expected fees of the whole plan, in the base currency
+	Violations            int             `json:"violations,omitempty"` // Transfers the group's payment constraints don't allow
+	Error                 string          `json:"error,omitempty"`      // Set when the strategy could not produce a plan
 }
 
+// PaymentKind says why a payment was recorded. Only PAYMENT is money actually sent;
+// the others move a leaving member's balance onto the members who stay.
+type PaymentKind string
+
+const (
+	PaymentSettlement      PaymentKind = "PAYMENT"
+	PaymentBalanceTransfer PaymentKind = "BALANCE_TRANSFER"
+	PaymentWriteOff        PaymentKind = "WRITE_OFF"
+)
+
 type SettlementPayment struct {
 	ID         uuid.UUID       `json:"id"`
 	GroupID    uuid.UUID       `json:"group_id"`
 	FromUserID uuid.UUID       `json:"from_user_id"`
 	ToUserID   uuid.UUID       `json:"to_user_id"`
 	Amount     decimal.Decimal `json:"amount"`
+	Kind       PaymentKind     `json:"kind"` // Defaults to PAYMENT
 	CreatedAt  time.Time       `json:"created_at"`
 }
 
+type PairConstraintKind string
+
+const (
+	PairForbidden PairConstraintKind = "FORBIDDEN"
+	PairPreferred PairConstraintKind = "PREFERRED"
+)
+
+// PairConstraint forbids or favours direct payments between two members, in either
+// direction.
+type PairConstraint struct {
+	UserA uuid.UUID          `json:"user_a"`
+	UserB uuid.UUID          `json:"user_b"`
+	Kind  PairConstraintKind `json:"kind"`
+}
+
+// ReceiveHub makes a member accept settlement money only through another member.
+type ReceiveHub struct {
+	UserID    uuid.UUID `json:"user_id"`
+	HubUserID uuid.UUID `json:"hub_user_id"`
+}
+
+// PaymentConstraints is the payment network a group's settlements must respect.
+type PaymentConstraints struct {
+	Pairs      []PairConstraint `json:"pairs"`
+	ReceiveVia []ReceiveHub     `json:"receive_via"`
+}
+
+type BalanceEntryKind string
+
+const (
+	EntryExpense         BalanceEntryKind = "EXPENSE"
+	EntryPaymentSent     BalanceEntryKind = "PAYMENT_SENT"
+	EntryPaymentReceived BalanceEntryKind = "PAYMENT_RECEIVED"
+)
+
+// BalanceEntry is one expense or payment's effect on a user's balance, in the group's
+// base currency. Net is Paid minus Share for expenses, the amount for payments sent and
+// minus the amount for payments received.
+type BalanceEntry struct {
+	Kind           BalanceEntryKind `json:"kind"`
+	ExpenseID      *uuid.UUID       `json:"expense_id,omitempty"`
+	PaymentID      *uuid.UUID       `json:"payment_id,omitempty"`
+	Description    string           `json:"description,omitempty"`
+	Counterparty   *UserSummary     `json:"counterparty,omitempty"` // The other side of a payment
+	PaidBy         []UserSummary    `json:"paid_by,omitempty"`
+	Date           time.Time        `json:"date"`
+	Paid           decimal.Decimal  `json:"paid"`
+	Share          decimal.Decimal  `json:"share"`
+	Net            decimal.Decimal  `json:"net"`
+	RunningBalance decimal.Decimal  `json:"running_balance"`
+}
+
+// BalanceBreakdown explains how a user's net balance in a group came about.
+type BalanceBreakdown struct {
+	GroupID          uuid.UUID       `json:"group_id"`
+	User             UserSummary     `json:"user"`
+	Currency         string          `json:"currency"`
+	Balance          decimal.Decimal `json:"balance"` // Positive when the user is owed money
+	TotalPaid        decimal.Decimal `json:"total_paid"`
+	TotalShare       decimal.Decimal `json:"total_share"`
+	PaymentsSent     decimal.Decimal `json:"payments_sent"`
+	PaymentsReceived decimal.Decimal `json:"payments_received"`
+	Entries          []BalanceEntry  `json:"entries"`
+}
+
+// SettlementExplanation is a settlement plan with the reasoning behind every transfer.
+type SettlementExplanation struct {
+	GroupID   uuid.UUID             `json:"group_id"`
+	Strategy  string                `json:"strategy"`
+	Currency  string                `json:"currency"`
+	Transfers []TransferExplanation `json:"transfers"`
+	Balances  []BalanceBreakdown    `json:"balances"`
+}
+
+// TransferExplanation says which balances a transfer clears and which of the payer's
+// expense shares it pays for.
+type TransferExplanation struct {
+	From              UserSummary     `json:"from"`
+	To                UserSummary     `json:"to"`
+	Amount            decimal.Decimal `json:"amount"`
+	Summary           string          `json:"summary"`
+	FromBalanceBefore decimal.Decimal `json:"from_balance_before"`
+	FromBalanceAfter  decimal.Decimal `json:"from_balance_after"`
+	ToBalanceBefore   decimal.Decimal `json:"to_balance_before"`
+	ToBalanceAfter    decimal.Decimal `json:"to_balance_after"`
+	Covers            []ExpenseCover  `json:"covers"`
+}
+
+// ExpenseCover is the part of a transfer that pays for the sender's share of one expense.
+type ExpenseCover struct {
+	ExpenseID       uuid.UUID       `json:"expense_id"`
+	Description     string          `json:"description"`
+	Amount          decimal.Decimal `json:"amount"`
+	PaidByRecipient bool            `json:"paid_by_recipient"`
+}
+
+type PlanStatus string
+
+const (
+	PlanActive     PlanStatus = "ACTIVE"     // Still has transfers to pay
+	PlanCompleted  PlanStatus = "COMPLETED"  // Every transfer is paid
+	PlanSuperseded PlanStatus = "SUPERSEDED" // Replaced by a newer plan
+)
+
+type TransferStatus string
+
+const (
+	TransferPending       TransferStatus = "PENDING"
+	TransferPartiallyPaid TransferStatus = "PARTIALLY_PAID"
+	TransferPaid          TransferStatus = "PAID"
+	TransferDisputed      TransferStatus = "DISPUTED"
+)
+
+// SettlementPlan is a saved "who pays whom" list for a group. It stays the same while
+// members pay it off; only its pending transfers are worked out again when the group's
+// balances change for another reason, such as a new expense.
+type SettlementPlan struct {
+	ID        uuid.UUID      `json:"id"`
+	GroupID   uuid.UUID      `json:"group_id"`
+	Strategy  string         `json:"strategy"`
+	Currency  string         `json:"currency"` // The group's base currency
+	Status    PlanStatus     `json:"status"`
+	Version   int            `json:"version"` // Goes up by one with every change
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	Transfers []PlanTransfer `json:"transfers"`
+}
+
+type PlanTransfer struct {
+	ID         uuid.UUID       `json:"id"`
+	PlanID     uuid.UUID       `json:"plan_id"`
+	Position   int             `json:"position"`
+	From       UserSummary     `json:"from"`
+	To         UserSummary     `json:"to"`
+	Amount     decimal.Decimal `json:"amount"`
+	PaidAmount decimal.Decimal `json:"paid_amount"`
+	Status     TransferStatus  `json:"status"`
+	Note       string          `json:"note,omitempty"` // Why a transfer is disputed
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// Outstanding is what is still to be paid on the transfer.
+func (t PlanTransfer) Outstanding() decimal.Decimal {
+	return t.Amount.Sub(t.PaidAmount)
+}
+
+// TransferUpdate changes the status of a transfer in a settlement plan. PaidAmount is
+// the total paid so far and is only used for PARTIALLY_PAID.
+type TransferUpdate struct {
+	Status     TransferStatus   `json:"status" binding:"required"`
+	PaidAmount *decimal.Decimal `json:"paid_amount"`
+	Note       string           `json:"note"`
+}
+
+// ConsolidatedSettlement is one user's settlement across every group they belong to,
+// with what they owe each counterparty netted into a single transfer.
+type ConsolidatedSettlement struct {
+	UserID          uuid.UUID              `json:"user_id"`
+	Currency        string                 `json:"currency"`
+	Transfers       []ConsolidatedTransfer `json:"transfers"`
+	TotalTransfers  int                    `json:"total_transfers"`
+	GroupTransfers  int                    `json:"group_transfers"` // Per-group transfers the plan replaces
+	TotalOwed       decimal.Decimal        `json:"total_owed"`      // What the user pays out in total
+	TotalReceivable decimal.Decimal        `json:"total_receivable"`
+}
+
+// ConsolidatedTransfer settles everything between the user and one counterparty. Its
+// Groups are the per-group transfers it pays off; a zero Amount means they cancel out.
+type ConsolidatedTransfer struct {
+	From   UserSummary       `json:"from"`
+	To     UserSummary       `json:"to"`
+	Amount decimal.Decimal   `json:"amount"`
+	Groups []GroupSettlement `json:"groups"`
+}
+
+// GroupSettlement is one transfer from a group's own plan, in the group's base currency.
+type GroupSettlement struct {
+	GroupID   uuid.UUID       `json:"group_id"`
+	GroupName string          `json:"group_name"`
+	From      UserSummary     `json:"from"`
+	To        UserSummary     `json:"to"`
+	Amount    decimal.Decimal `json:"amount"`
+	Currency  string          `json:"currency"`
+	Converted decimal.Decimal `json:"converted"` // Amount in the consolidated currency
+}
+
+type FeeKind string
+
+const (
+	FeeFlat     FeeKind = "FLAT"       // FlatFee per transfer
+	FeePercent  FeeKind = "PERCENT"    // Percent of each transfer
+	FeeFreeUpTo FeeKind = "FREE_UP_TO" // Free up to FreeLimit per transfer, Percent on the rest
+)
+
+// PaymentMethod is a way a user can send and receive money. Two users can pay each
+// other with a method if both have one of the same name; the sender's fee applies.
+type PaymentMethod struct {
+	ID        uuid.UUID       `json:"id"`
+	UserID    uuid.UUID       `json:"user_id"`
+	Name      string          `json:"name"`
+	FeeKind   FeeKind         `json:"fee_kind"`
+	FlatFee   decimal.Decimal `json:"flat_fee"`
+	Percent   decimal.Decimal `json:"percent"` // e.g. 1.5 for 1.5%
+	FreeLimit decimal.Decimal `json:"free_limit"`
+	Currency  string          `json:"currency"` // Of FlatFee and FreeLimit
+}
+
+// Session is a signed token a user gets by logging in. It is checked by its signature
+// alone, so it stays valid until it expires.
+type Session struct {
+	Token     string      `json:"token"`
+	ExpiresAt time.Time   `json:"expires_at"`
+	User      UserSummary `json:"user"`
+}
+
+// LoginCode is a one-time code emailed to a user so they can log in without a
+// password. Only a hash of the code is stored.
+type LoginCode struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	CodeHash  string
+	Attempts  int // Wrong codes entered so far
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// APIToken is a long-lived personal token for scripts. Only a hash of the token is
+// stored; Prefix, its first few characters, helps the owner tell their tokens apart.
+type APIToken struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // Never expires when unset
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// NewAPIToken is a token that has just been created. Token is only ever shown here.
+type NewAPIToken struct {
+	APIToken
+	Token string `json:"token"`
+}
+
 func ParseUUID(s string) (uuid.UUID, error) {
 	return uuid.Parse(s)
 }
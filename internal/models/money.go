@@ -0,0 +1,80 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// DefaultCurrency is used for expenses that don't name a currency.
+const DefaultCurrency = "INR"
+
+var ErrUnknownCurrency = errors.New("unknown currency")
+
+// currencyExponents maps ISO-4217 codes to the number of decimal places of their minor
+// unit. Currencies not listed here are rejected.
+var currencyExponents = map[string]int32{
+	"AED": 2, "AUD": 2, "BRL": 2, "CAD": 2, "CHF": 2, "CNY": 2, "CZK": 2, "DKK": 2,
+	"EUR": 2, "GBP": 2, "HKD": 2, "IDR": 2, "ILS": 2, "INR": 2, "MXN": 2, "MYR": 2,
+	"NOK": 2, "NZD": 2, "PHP": 2, "PLN": 2, "SAR": 2, "SEK": 2, "SGD": 2, "THB": 2,
+	"TRY": 2, "USD": 2, "ZAR": 2, "LKR": 2, "NPR": 2, "PKR": 2, "BDT": 2,
+	"JPY": 0, "KRW": 0, "VND": 0, "CLP": 0, "ISK": 0, "UGX": 0, "XOF": 0, "XAF": 0,
+	"BHD": 3, "KWD": 3, "OMR": 3, "JOD": 3, "TND": 3, "IQD": 3, "LYD": 3,
+}
+
+// CurrencyExponent returns the number of decimal places used by the currency.
+func CurrencyExponent(code string) (int32, bool) {
+	exp, ok := currencyExponents[code]
+	return exp, ok
+}
+
+// NormalizeCurrency upper-cases a currency code and fills in the default when empty.
+func NormalizeCurrency(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return DefaultCurrency
+	}
+	return code
+}
+
+// Money is an amount in a specific ISO-4217 currency.
+type Money struct {
+	Amount   decimal.Decimal `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+// NewMoney builds a Money value and checks that the amount fits the currency.
+func NewMoney(amount decimal.Decimal, currency string) (Money, error) {
+	m := Money{Amount: amount, Currency: NormalizeCurrency(currency)}
+	return m, m.Validate()
+}
+
+// Exponent is the number of decimal places of the currency's minor unit.
+func (m Money) Exponent() int32 {
+	exp, _ := CurrencyExponent(m.Currency)
+	return exp
+}
+
+// MinorUnit is the smallest amount the currency can express, e.g. 0.01 for INR.
+func (m Money) MinorUnit() decimal.Decimal {
+	return decimal.New(1, -m.Exponent())
+}
+
+// Validate rejects unknown currencies and amounts with more precision than the
+// currency allows (e.g. 10.5 JPY or 1.2345 KWD).
+func (m Money) Validate() error {
+	exp, ok := CurrencyExponent(m.Currency)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownCurrency, m.Currency)
+	}
+	if !m.Amount.Equal(m.Amount.Truncate(exp)) {
+		return fmt.Errorf("%s amounts allow at most %d decimal places", m.Currency, exp)
+	}
+	return nil
+}
+
+func (m Money) String() string {
+	return m.Amount.StringFixed(m.Exponent()) + " " + m.Currency
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMoneyValidate(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		wantErr  bool
+	}{
+		{"100.25", "INR", false},
+		{"100.255", "INR", true},
+		{"1500", "JPY", false},
+		{"1500.5", "JPY", true},
+		{"12.345", "KWD", false},
+		{"12.3456", "BHD", true},
+		{"10.00", "jpy", false}, // trailing zeros are fine, code is normalised
+		{"10", "XYZ", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.amount+" "+tt.currency, func(t *testing.T) {
+			_, err := NewMoney(decimal.RequireFromString(tt.amount), tt.currency)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMoneyMinorUnit(t *testing.T) {
+	assert.True(t, Money{Currency: "JPY"}.MinorUnit().Equal(decimal.NewFromInt(1)))
+	assert.True(t, Money{Currency: "INR"}.MinorUnit().Equal(decimal.NewFromFloat(0.01)))
+	assert.True(t, Money{Currency: "KWD"}.MinorUnit().Equal(decimal.NewFromFloat(0.001)))
+	assert.Equal(t, "12.500 KWD", Money{Amount: decimal.NewFromFloat(12.5), Currency: "KWD"}.String())
+}
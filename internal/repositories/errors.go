@@ -0,0 +1,93 @@
+package repositories
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+)
+
+// Postgres error codes the repository translates.
+const (
+	pgUniqueViolation     = "23505"
+	pgForeignKeyViolation = "23503"
+	pgCheckViolation      = "23514"
+	pgInvalidText         = "22P02"
+)
+
+var (
+	errGroupNotFound      = apperrors.NotFound("group_not_found", "group does not exist")
+	errUserNotFound       = apperrors.NotFound("user_not_found", "user does not exist")
+	errMemberNotFound     = apperrors.NotFound("member_not_found", "user is not a member of this group")
+	errGroupStatusChanged = apperrors.Conflict("group_status_changed", "the group's status was changed at the same time; reload it and try again")
+	errExpenseNotFound    = apperrors.NotFound("expense_not_found", "expense does not exist")
+	errExpenseChanged     = apperrors.Conflict("expense_changed", "the expense was changed at the same time; reload it and try again")
+	errLedgerChanged      = apperrors.Conflict("balance_changed", "an expense or payment was added or changed at the same time; try again")
+	errPlanChanged        = apperrors.Conflict("settlement_plan_changed", "the settlement plan was changed at the same time; reload it and try again")
+	errLoginCodeUsed      = apperrors.Unauthenticated("invalid_login_code", "the login code is wrong or has expired")
+	errAPITokenNotFound   = apperrors.NotFound("api_token_not_found", "API token does not exist")
+)
+
+// uniqueViolations names the errors for unique constraints clients can run into.
+// Constraints not listed here are reported as a generic conflict.
+var uniqueViolations = map[string]*apperrors.Error{
+	"users_username_key":                       apperrors.Conflict("username_taken", "username is already taken"),
+	"users_email_key":                          apperrors.Conflict("email_taken", "email is already registered"),
+	"users_username_lower_key":                 apperrors.Conflict("username_taken", "username is already taken"),
+	"users_email_lower_key":                    apperrors.Conflict("email_taken", "email is already registered"),
+	"group_members_current_key":                apperrors.Conflict("already_member", "user is already a member of this group"),
+	"group_members_owner_key":                  apperrors.Conflict("owner_conflict", "the group's owner was changed at the same time; try again"),
+	"user_payment_methods_user_id_name_key":    apperrors.Conflict("duplicate_payment_method", "each payment method name may only be used once"),
+	"expense_revisions_expense_id_version_key": errExpenseChanged,
+	"idx_settlement_plans_current":             apperrors.Conflict("settlement_plan_conflict", "the group's settlement plan was changed at the same time; try again"),
+}
+
+// dbError translates a Postgres error into an *apperrors.Error, so that callers never
+// need to know about pgx or match on Postgres messages. Errors it doesn't recognise are
+// returned unchanged and end up as internal errors.
+func dbError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := apperrors.As(err); ok {
+		return err
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return apperrors.NotFound(apperrors.CodeNotFound, "record not found").Wrap(err)
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	switch pgErr.Code {
+	case pgUniqueViolation:
+		if e, ok := uniqueViolations[pgErr.ConstraintName]; ok {
+			return e.Wrap(err)
+		}
+		return apperrors.Conflict(apperrors.CodeConflict, "record already exists").Wrap(err)
+	case pgForeignKeyViolation:
+		return missingReference(pgErr.ConstraintName).Wrap(err)
+	case pgCheckViolation:
+		return apperrors.Invalid(apperrors.CodeInvalidRequest, "a value is out of range").Wrap(err)
+	case pgInvalidText:
+		return apperrors.Invalid(apperrors.CodeInvalidID, "malformed ID").Wrap(err)
+	}
+	return err
+}
+
+// missingReference names the error for a foreign key violation from the constraint,
+// which Postgres names <table>_<column>_fkey.
+func missingReference(constraint string) *apperrors.Error {
+	column := strings.TrimSuffix(constraint, "_fkey")
+	switch {
+	case strings.HasSuffix(column, "group_id"):
+		return apperrors.Unprocessable("group_not_found", "group does not exist")
+	case strings.HasSuffix(column, "user_id"), strings.HasSuffix(column, "payer_id"),
+		strings.HasSuffix(column, "user_a"), strings.HasSuffix(column, "user_b"):
+		return apperrors.Unprocessable("user_not_found", "user does not exist")
+	}
+	return apperrors.Unprocessable(apperrors.CodeReference, "a referenced record does not exist")
+}
@@ -0,0 +1,48 @@
+package repositories
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+)
+
+func TestDBError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"no rows", pgx.ErrNoRows, http.StatusNotFound, apperrors.CodeNotFound},
+		{"taken username", &pgconn.PgError{Code: "23505", ConstraintName: "users_username_key"}, http.StatusConflict, "username_taken"},
+		{"taken email", &pgconn.PgError{Code: "23505", ConstraintName: "users_email_key"}, http.StatusConflict, "email_taken"},
+		{"other duplicate", &pgconn.PgError{Code: "23505", ConstraintName: "something_key"}, http.StatusConflict, apperrors.CodeConflict},
+		{"missing group", &pgconn.PgError{Code: "23503", ConstraintName: "group_members_group_id_fkey"}, http.StatusUnprocessableEntity, "group_not_found"},
+		{"missing payer", &pgconn.PgError{Code: "23503", ConstraintName: "expenses_payer_id_fkey"}, http.StatusUnprocessableEntity, "user_not_found"},
+		{"missing other", &pgconn.PgError{Code: "23503", ConstraintName: "expense_item_shares_item_id_fkey"}, http.StatusUnprocessableEntity, apperrors.CodeReference},
+		{"malformed id", &pgconn.PgError{Code: "22P02"}, http.StatusBadRequest, apperrors.CodeInvalidID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := dbError(fmt.Errorf("query: %w", tt.err))
+			e, ok := apperrors.As(err)
+			if assert.True(t, ok) {
+				assert.Equal(t, tt.status, e.Kind.Status())
+				assert.Equal(t, tt.code, e.Code)
+			}
+			// The cause is kept for logging but never shown
+			assert.True(t, errors.Is(err, tt.err))
+			assert.NotContains(t, err.Error(), "query")
+		})
+	}
+
+	other := errors.New("connection refused")
+	assert.Equal(t, other, dbError(other))
+	assert.NoError(t, dbError(nil))
+}
@@ -2,19 +2,73 @@ package repositories
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/user/debt-optimization-engine/internal/models"
 )
 
 type Repository interface {
-	CreateUser(ctx context.Context, user *models.User) error
-	CreateGroup(ctx context.Context, group *models.Group) error
-	AddMemberToGroup(ctx context.Context, groupID, userID string) error
-	CreateExpense(ctx context.Context, expense *models.Expense) error
+	CreateUser(ctx context.Context, user *models.User, passwordHash string) error
+	GetUser(ctx context.Context, userID string) (*models.User, error)
+	GetUserByLogin(ctx context.Context, login string) (*models.User, string, error)
+	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
+	SetPasswordHash(ctx context.Context, userID, hash string) error
+	CreateLoginCode(ctx context.Context, code *models.LoginCode) error
+	GetLatestLoginCode(ctx context.Context, userID string) (*models.LoginCode, error)
+	CountLoginCodes(ctx context.Context, userID string, since time.Time) (int, error)
+	AddLoginCodeAttempt(ctx context.Context, codeID string, max int) (bool, error)
+	UseLoginCode(ctx context.Context, codeID string) error
+	CreateAPIToken(ctx context.Context, token *models.APIToken, hash string) error
+	GetAPITokenByHash(ctx context.Context, hash string) (*models.APIToken, error)
+	ListAPITokens(ctx context.Context, userID string) ([]models.APIToken, error)
+	RevokeAPIToken(ctx context.Context, userID, tokenID string) error
+	TouchAPIToken(ctx context.Context, tokenID string) error
+	SearchUsers(ctx context.Context, text string, limit int) ([]models.UserSummary, error)
+	CreateGroup(ctx context.Context, group *models.Group, owner uuid.UUID) error
+	GetGroup(ctx context.Context, groupID string) (*models.Group, error)
+	UpdateGroup(ctx context.Context, group *models.Group) error
+	SetGroupStatus(ctx context.Context, group *models.Group, to models.GroupStatus, changedBy *uuid.UUID, reason string) error
+	CloseGroup(ctx context.Context, group *models.Group, plan *models.SettlementPlan, closedBy uuid.UUID) error
+	GetGroupStatusChanges(ctx context.Context, groupID string) ([]models.GroupStatusChange, error)
+	AddMemberToGroup(ctx context.Context, groupID, userID string, role models.Role) error
+	GetMember(ctx context.Context, groupID, userID string) (*models.Member, error)
+	SetMemberRole(ctx context.Context, groupID, userID string, role models.Role) error
+	CreateExpense(ctx context.Context, expense *models.Expense, revision *models.ExpenseRevision) error
+	GetExpense(ctx context.Context, expenseID string) (*models.Expense, error)
+	UpdateExpense(ctx context.Context, expense *models.Expense, revisions []models.ExpenseRevision) error
+	GetExpenseRevisions(ctx context.Context, expenseID string) ([]models.ExpenseRevision, error)
 	GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error)
-	GetExpensesByGroup(ctx context.Context, groupID string, from, to *time.Time) ([]models.Expense, error)
+	GetMemberships(ctx context.Context, groupID string, includeFormer bool) ([]models.Member, error)
+	GetLedgerStamp(ctx context.Context, groupID string) (string, error)
+	RemoveMember(ctx context.Context, groupID, userID string, removedBy uuid.UUID, payments []models.SettlementPayment, ledgerStamp string) (time.Time, error)
+	GetExpensesByGroup(ctx context.Context, groupID string, from, before *time.Time) ([]models.Expense, error)
+	ListExpenses(ctx context.Context, groupID string, filter models.ExpenseFilter) ([]models.Expense, error)
+	CountExpensesByGroup(ctx context.Context, groupID string) (int64, error)
+	GetExpenseItems(ctx context.Context, expenseID string) ([]models.ExpenseItem, []models.Adjustment, error)
+	UpsertFXRates(ctx context.Context, rates []models.FXRate) error
+	GetFXRates(ctx context.Context, base, quote string, from, before *time.Time) ([]models.FXRate, error)
+	FindFXRate(ctx context.Context, base, quote string, on time.Time) (*models.FXRate, error)
+	CreateSettlementPayment(ctx context.Context, payment *models.SettlementPayment) error
+	GetSettlementPaymentsByGroup(ctx context.Context, groupID string, from, before *time.Time) ([]models.SettlementPayment, error)
+	GetPaymentConstraints(ctx context.Context, groupID string) (*models.PaymentConstraints, error)
+	ReplacePaymentConstraints(ctx context.Context, groupID string, constraints *models.PaymentConstraints) error
+	GetGroupsByUser(ctx context.Context, userID string, includeArchived bool) ([]models.Group, error)
+	CreateSettlementPayments(ctx context.Context, payments []models.SettlementPayment) error
+	CreateSettlementPlan(ctx context.Context, plan *models.SettlementPlan) error
+	GetSettlementPlan(ctx context.Context, planID string) (*models.SettlementPlan, error)
+	GetCurrentSettlementPlan(ctx context.Context, groupID string) (*models.SettlementPlan, error)
+	SaveSettlementPlan(ctx context.Context, plan *models.SettlementPlan) error
+	UpdatePlanTransfer(ctx context.Context, plan *models.SettlementPlan, transfer *models.PlanTransfer, payment *models.SettlementPayment) error
+	GetPaymentMethodsByUser(ctx context.Context, userID string) ([]models.PaymentMethod, error)
+	GetPaymentMethodsByGroup(ctx context.Context, groupID string) ([]models.PaymentMethod, error)
+	ReplacePaymentMethods(ctx context.Context, userID string, methods []models.PaymentMethod) error
 }
 
 type PostgresRepo struct {
@@ -25,54 +79,441 @@ func NewPostgresRepo(pool *pgxpool.Pool) *PostgresRepo {
 	return &PostgresRepo{pool: pool}
 }
 
-func (r *PostgresRepo) CreateUser(ctx context.Context, user *models.User) error {
-	query := `INSERT INTO users (username, email) VALUES ($1, $2) RETURNING id, created_at`
-	return r.pool.QueryRow(ctx, query, user.Username, user.Email).Scan(&user.ID, &user.CreatedAt)
+// CreateUser stores a new user. passwordHash is empty for users who only log in with
+// emailed codes.
+func (r *PostgresRepo) CreateUser(ctx context.Context, user *models.User, passwordHash string) error {
+	query := `INSERT INTO users (username, email, password_hash) VALUES ($1, $2, NULLIF($3, '')) RETURNING id, created_at`
+	return dbError(r.pool.QueryRow(ctx, query, user.Username, user.Email, passwordHash).Scan(&user.ID, &user.CreatedAt))
 }
 
-func (r *PostgresRepo) CreateGroup(ctx context.Context, group *models.Group) error {
-	query := `INSERT INTO groups (name) VALUES ($1) RETURNING id, created_at`
-	return r.pool.QueryRow(ctx, query, group.Name).Scan(&group.ID, &group.CreatedAt)
+func (r *PostgresRepo) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	query := `SELECT id, username, email, created_at FROM users WHERE id = $1`
+	var u models.User
+	err := r.pool.QueryRow(ctx, query, userID).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errUserNotFound.Wrap(err)
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return &u, nil
 }
 
-func (r *PostgresRepo) AddMemberToGroup(ctx context.Context, groupID, userID string) error {
-	query := `INSERT INTO group_members (group_id, user_id) VALUES ($1, $2)`
-	_, err := r.pool.Exec(ctx, query, groupID, userID)
-	return err
+// SearchUsers finds users whose username contains text, ignoring case, or whose
+// email is text. Emails are never partly matched or returned, so searching can't be
+// used to collect them. Exact matches come first, then the rest by username.
+func (r *PostgresRepo) SearchUsers(ctx context.Context, text string, limit int) ([]models.UserSummary, error) {
+	query := `SELECT id, username FROM users
+	          WHERE username ILIKE $1 OR lower(email) = lower($2)
+	          ORDER BY (lower(username) = lower($2) OR lower(email) = lower($2)) DESC, username
+	          LIMIT $3`
+	rows, err := r.pool.Query(ctx, query, "%"+likeEscaper.Replace(text)+"%", text, limit)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	users := []models.UserSummary{}
+	for rows.Next() {
+		var u models.UserSummary
+		if err := rows.Scan(&u.ID, &u.Username); err != nil {
+			return nil, dbError(err)
+		}
+		users = append(users, u)
+	}
+	return users, dbError(rows.Err())
 }
 
-func (r *PostgresRepo) CreateExpense(ctx context.Context, expense *models.Expense) error {
+// CreateGroup stores a new group with owner as its first member.
+func (r *PostgresRepo) CreateGroup(ctx context.Context, group *models.Group, owner uuid.UUID) error {
 	tx, err := r.pool.Begin(ctx)
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 	defer tx.Rollback(ctx)
 
-	query := `INSERT INTO expenses (group_id, payer_id, amount, description, split_type) 
-	          VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`
-	err = tx.QueryRow(ctx, query, expense.GroupID, expense.PayerID, expense.Amount, expense.Description, expense.SplitType).
-		Scan(&expense.ID, &expense.CreatedAt)
+	query := `INSERT INTO groups (name, rounding_policy, base_currency) VALUES ($1, $2, $3) RETURNING id, status, created_at`
+	err = tx.QueryRow(ctx, query, group.Name, group.RoundingPolicy, group.BaseCurrency).Scan(&group.ID, &group.Status, &group.CreatedAt)
+	if err != nil {
+		return dbError(err)
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO group_members (group_id, user_id, role) VALUES ($1, $2, $3)`, group.ID, owner, models.RoleOwner); err != nil {
+		return dbError(err)
+	}
+	return dbError(tx.Commit(ctx))
+}
+
+func (r *PostgresRepo) GetGroup(ctx context.Context, groupID string) (*models.Group, error) {
+	query := `SELECT id, name, rounding_policy, base_currency, status, created_at FROM groups WHERE id = $1`
+	var g models.Group
+	err := r.pool.QueryRow(ctx, query, groupID).Scan(&g.ID, &g.Name, &g.RoundingPolicy, &g.BaseCurrency, &g.Status, &g.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errGroupNotFound.Wrap(err)
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return &g, nil
+}
+
+// GetGroupsByUser returns every group the user is currently a member of, oldest first.
+// Archived groups are left out unless includeArchived is set.
+func (r *PostgresRepo) GetGroupsByUser(ctx context.Context, userID string, includeArchived bool) ([]models.Group, error) {
+	query := `SELECT g.id, g.name, g.rounding_policy, g.base_currency, g.status, g.created_at FROM groups g
+	          JOIN group_members gm ON gm.group_id = g.id WHERE gm.user_id = $1 AND gm.left_at IS NULL
+	          AND (g.status <> 'ARCHIVED' OR $2) ORDER BY g.created_at, g.id`
+	rows, err := r.pool.Query(ctx, query, userID, includeArchived)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	groups := []models.Group{}
+	for rows.Next() {
+		var g models.Group
+		if err := rows.Scan(&g.ID, &g.Name, &g.RoundingPolicy, &g.BaseCurrency, &g.Status, &g.CreatedAt); err != nil {
+			return nil, dbError(err)
+		}
+		groups = append(groups, g)
+	}
+	return groups, dbError(rows.Err())
+}
+
+func (r *PostgresRepo) UpdateGroup(ctx context.Context, group *models.Group) error {
+	query := `UPDATE groups SET name = $2, rounding_policy = $3 WHERE id = $1`
+	_, err := r.pool.Exec(ctx, query, group.ID, group.Name, group.RoundingPolicy)
+	return dbError(err)
+}
+
+// SetGroupStatus moves the group to a new status and logs the change. It fails with a
+// conflict if the group's status is no longer group.Status, so two people closing or
+// reopening a group at once can't both succeed.
+func (r *PostgresRepo) SetGroupStatus(ctx context.Context, group *models.Group, to models.GroupStatus, changedBy *uuid.UUID, reason string) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := updateGroupStatus(ctx, tx, group, to, changedBy, reason); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return dbError(err)
+	}
+	group.Status = to
+	return nil
+}
+
+// CloseGroup moves an active group to SETTLING and saves its final settlement plan in
+// one transaction, so a group is never left frozen without a plan to pay off.
+func (r *PostgresRepo) CloseGroup(ctx context.Context, group *models.Group, plan *models.SettlementPlan, closedBy uuid.UUID) error {
+	tx, err := r.pool.Begin(ctx)
 	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := updateGroupStatus(ctx, tx, group, models.GroupSettling, &closedBy, "closed"); err != nil {
 		return err
 	}
+	if err := insertSettlementPlan(ctx, tx, plan); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return dbError(err)
+	}
+	group.Status = models.GroupSettling
+	return nil
+}
+
+func updateGroupStatus(ctx context.Context, tx pgx.Tx, group *models.Group, to models.GroupStatus, changedBy *uuid.UUID, reason string) error {
+	tag, err := tx.Exec(ctx, `UPDATE groups SET status = $3 WHERE id = $1 AND status = $2`, group.ID, group.Status, to)
+	if err != nil {
+		return dbError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return errGroupStatusChanged
+	}
+	query := `INSERT INTO group_status_changes (group_id, from_status, to_status, changed_by, reason) VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.Exec(ctx, query, group.ID, group.Status, to, changedBy, reason)
+	return dbError(err)
+}
+
+// GetGroupStatusChanges returns the group's status log, oldest first.
+func (r *PostgresRepo) GetGroupStatusChanges(ctx context.Context, groupID string) ([]models.GroupStatusChange, error) {
+	query := `SELECT id, group_id, from_status, to_status, changed_by, reason, created_at
+	          FROM group_status_changes WHERE group_id = $1 ORDER BY created_at, id`
+	rows, err := r.pool.Query(ctx, query, groupID)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	changes := []models.GroupStatusChange{}
+	for rows.Next() {
+		var c models.GroupStatusChange
+		if err := rows.Scan(&c.ID, &c.GroupID, &c.From, &c.To, &c.ChangedBy, &c.Reason, &c.ChangedAt); err != nil {
+			return nil, dbError(err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, dbError(rows.Err())
+}
+
+func (r *PostgresRepo) AddMemberToGroup(ctx context.Context, groupID, userID string, role models.Role) error {
+	query := `INSERT INTO group_members (group_id, user_id, role) VALUES ($1, $2, $3)`
+	_, err := r.pool.Exec(ctx, query, groupID, userID, role)
+	return dbError(err)
+}
+
+// GetMember returns the user's current membership of the group.
+func (r *PostgresRepo) GetMember(ctx context.Context, groupID, userID string) (*models.Member, error) {
+	query := `SELECT u.id, u.username, u.email, u.created_at, gm.role, gm.joined_at FROM users u
+	          JOIN group_members gm ON u.id = gm.user_id WHERE gm.group_id = $1 AND gm.user_id = $2 AND gm.left_at IS NULL`
+	var m models.Member
+	err := r.pool.QueryRow(ctx, query, groupID, userID).Scan(&m.ID, &m.Username, &m.Email, &m.CreatedAt, &m.Role, &m.JoinedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errMemberNotFound.Wrap(err)
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return &m, nil
+}
+
+// SetMemberRole changes a current member's role. Making someone the owner demotes the
+// current owner to admin in the same transaction, as a group has only one owner.
+func (r *PostgresRepo) SetMemberRole(ctx context.Context, groupID, userID string, role models.Role) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if role == models.RoleOwner {
+		query := `UPDATE group_members SET role = $2 WHERE group_id = $1 AND role = $3 AND left_at IS NULL`
+		if _, err := tx.Exec(ctx, query, groupID, models.RoleAdmin, models.RoleOwner); err != nil {
+			return dbError(err)
+		}
+	}
+	query := `UPDATE group_members SET role = $3 WHERE group_id = $1 AND user_id = $2 AND left_at IS NULL`
+	tag, err := tx.Exec(ctx, query, groupID, userID, role)
+	if err != nil {
+		return dbError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return errMemberNotFound
+	}
+	return dbError(tx.Commit(ctx))
+}
+
+// CreateExpense stores a new expense with its splits, payers and items, and its first
+// revision, in one transaction.
+func (r *PostgresRepo) CreateExpense(ctx context.Context, expense *models.Expense, revision *models.ExpenseRevision) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if expense.ID == uuid.Nil {
+		expense.ID = uuid.New()
+	}
+	if expense.Version == 0 {
+		expense.Version = 1
+	}
+	query := `INSERT INTO expenses (id, group_id, payer_id, amount, currency, exchange_rate, description, split_type, version, created_by, rounding_sequence) 
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING created_at, updated_at`
+	err = tx.QueryRow(ctx, query, expense.ID, expense.GroupID, expense.PayerID, expense.Amount, expense.Currency, expense.ExchangeRate, expense.Description, expense.SplitType, expense.Version, expense.CreatedBy, expense.RoundingSequence).
+		Scan(&expense.CreatedAt, &expense.UpdatedAt)
+	if err != nil {
+		return dbError(err)
+	}
+
+	if err := insertExpenseDetails(ctx, tx, expense); err != nil {
+		return dbError(err)
+	}
+	if revision != nil {
+		revision.Expense = *expense
+		if err := insertExpenseRevisions(ctx, tx, revision); err != nil {
+			return dbError(err)
+		}
+	}
+
+	return dbError(tx.Commit(ctx))
+}
+
+// insertExpenseDetails writes an expense's payers, splits, items and adjustments.
+func insertExpenseDetails(ctx context.Context, tx pgx.Tx, expense *models.Expense) error {
+	for i := range expense.Payers {
+		payer := &expense.Payers[i]
+		payerQuery := `INSERT INTO expense_payers (expense_id, user_id, amount) VALUES ($1, $2, $3)`
+		if _, err := tx.Exec(ctx, payerQuery, expense.ID, payer.UserID, payer.Amount); err != nil {
+			return err
+		}
+		payer.ExpenseID = expense.ID
+	}
 
 	for _, split := range expense.Splits {
-		splitQuery := `INSERT INTO expense_splits (expense_id, user_id, amount) VALUES ($1, $2, $3)`
-		_, err = tx.Exec(ctx, splitQuery, expense.ID, split.UserID, split.Amount)
-		if err != nil {
+		splitQuery := `INSERT INTO expense_splits (expense_id, user_id, amount, percentage, basis_points, shares) VALUES ($1, $2, $3, $4, $5, $6)`
+		if _, err := tx.Exec(ctx, splitQuery, expense.ID, split.UserID, split.Amount, split.Percentage, split.BasisPoints, split.Shares); err != nil {
+			return err
+		}
+	}
+
+	for i := range expense.Items {
+		item := &expense.Items[i]
+		if item.ID == uuid.Nil {
+			item.ID = uuid.New()
+		}
+		itemQuery := `INSERT INTO expense_items (id, expense_id, position, description, amount) VALUES ($1, $2, $3, $4, $5)`
+		if _, err := tx.Exec(ctx, itemQuery, item.ID, expense.ID, i, item.Description, item.Amount); err != nil {
 			return err
 		}
+		item.ExpenseID = expense.ID
+		for _, share := range item.Shares {
+			shareQuery := `INSERT INTO expense_item_shares (item_id, user_id, amount) VALUES ($1, $2, $3)`
+			if _, err := tx.Exec(ctx, shareQuery, item.ID, share.UserID, share.Amount); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := range expense.Adjustments {
+		adj := &expense.Adjustments[i]
+		if adj.ID == uuid.Nil {
+			adj.ID = uuid.New()
+		}
+		adjQuery := `INSERT INTO expense_adjustments (id, expense_id, position, kind, amount) VALUES ($1, $2, $3, $4, $5)`
+		if _, err := tx.Exec(ctx, adjQuery, adj.ID, expense.ID, i, adj.Kind, adj.Amount); err != nil {
+			return err
+		}
+		adj.ExpenseID = expense.ID
+		for _, share := range adj.Shares {
+			shareQuery := `INSERT INTO expense_adjustment_shares (adjustment_id, user_id, amount) VALUES ($1, $2, $3)`
+			if _, err := tx.Exec(ctx, shareQuery, adj.ID, share.UserID, share.Amount); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateExpense replaces an expense and everything under it with a new version, and
+// records the revisions given. It fails with a conflict if someone else changed the
+// expense since expense.Version-1 was read.
+func (r *PostgresRepo) UpdateExpense(ctx context.Context, expense *models.Expense, revisions []models.ExpenseRevision) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Hold off RemoveMember until this change is in, as inserting an expense does
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM groups WHERE id = $1 FOR KEY SHARE`, expense.GroupID); err != nil {
+		return dbError(err)
+	}
+
+	query := `UPDATE expenses SET payer_id = $3, amount = $4, currency = $5, exchange_rate = $6, description = $7,
+	          split_type = $8, deleted_at = $9, version = $2, updated_at = CURRENT_TIMESTAMP
+	          WHERE id = $1 AND version = $2 - 1 RETURNING updated_at`
+	err = tx.QueryRow(ctx, query, expense.ID, expense.Version, expense.PayerID, expense.Amount, expense.Currency,
+		expense.ExchangeRate, expense.Description, expense.SplitType, expense.DeletedAt).Scan(&expense.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errExpenseChanged.Wrap(err)
+	}
+	if err != nil {
+		return dbError(err)
+	}
+
+	for _, table := range []string{"expense_payers", "expense_splits", "expense_items", "expense_adjustments"} {
+		if _, err := tx.Exec(ctx, `DELETE FROM `+table+` WHERE expense_id = $1`, expense.ID); err != nil {
+			return dbError(err)
+		}
+	}
+	if err := insertExpenseDetails(ctx, tx, expense); err != nil {
+		return dbError(err)
+	}
+
+	for i := range revisions {
+		if revisions[i].Version == expense.Version {
+			revisions[i].Expense = *expense
+		}
+		if err := insertExpenseRevisions(ctx, tx, &revisions[i]); err != nil {
+			return dbError(err)
+		}
+	}
+	return dbError(tx.Commit(ctx))
+}
+
+func insertExpenseRevisions(ctx context.Context, tx pgx.Tx, revision *models.ExpenseRevision) error {
+	snapshot, err := json.Marshal(revision.Expense)
+	if err != nil {
+		return err
+	}
+	revision.ExpenseID = revision.Expense.ID
+	query := `INSERT INTO expense_revisions (expense_id, version, action, changed_by, snapshot)
+	          VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`
+	return tx.QueryRow(ctx, query, revision.ExpenseID, revision.Version, revision.Action, revision.ChangedBy, snapshot).
+		Scan(&revision.ID, &revision.ChangedAt)
+}
+
+// GetExpense returns an expense with its splits, payers and items, including a deleted
+// one.
+func (r *PostgresRepo) GetExpense(ctx context.Context, expenseID string) (*models.Expense, error) {
+	query := `SELECT id, group_id, payer_id, amount, currency, exchange_rate, description, split_type, created_at,
+	          updated_at, version, deleted_at, created_by, rounding_sequence FROM expenses WHERE id = $1`
+	var e models.Expense
+	err := r.pool.QueryRow(ctx, query, expenseID).Scan(&e.ID, &e.GroupID, &e.PayerID, &e.Amount, &e.Currency, &e.ExchangeRate,
+		&e.Description, &e.SplitType, &e.CreatedAt, &e.UpdatedAt, &e.Version, &e.DeletedAt, &e.CreatedBy, &e.RoundingSequence)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errExpenseNotFound.Wrap(err)
+	}
+	if err != nil {
+		return nil, dbError(err)
 	}
+	if err := r.loadExpenseDetails(ctx, &e); err != nil {
+		return nil, dbError(err)
+	}
+	if e.Items, e.Adjustments, err = r.GetExpenseItems(ctx, expenseID); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// GetExpenseRevisions returns every revision of an expense, oldest first.
+func (r *PostgresRepo) GetExpenseRevisions(ctx context.Context, expenseID string) ([]models.ExpenseRevision, error) {
+	query := `SELECT id, expense_id, version, action, changed_by, snapshot, created_at
+	          FROM expense_revisions WHERE expense_id = $1 ORDER BY version`
+	rows, err := r.pool.Query(ctx, query, expenseID)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
 
-	return tx.Commit(ctx)
+	revisions := []models.ExpenseRevision{}
+	for rows.Next() {
+		var rev models.ExpenseRevision
+		var snapshot []byte
+		if err := rows.Scan(&rev.ID, &rev.ExpenseID, &rev.Version, &rev.Action, &rev.ChangedBy, &snapshot, &rev.ChangedAt); err != nil {
+			return nil, dbError(err)
+		}
+		if err := json.Unmarshal(snapshot, &rev.Expense); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, dbError(rows.Err())
 }
 
+// GetGroupMembers returns the group's current members.
 func (r *PostgresRepo) GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error) {
 	query := `SELECT u.id, u.username, u.email, u.created_at FROM users u
-	          JOIN group_members gm ON u.id = gm.user_id WHERE gm.group_id = $1`
+	          JOIN group_members gm ON u.id = gm.user_id WHERE gm.group_id = $1 AND gm.left_at IS NULL`
 	rows, err := r.pool.Query(ctx, query, groupID)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	defer rows.Close()
 
@@ -80,62 +521,908 @@ func (r *PostgresRepo) GetGroupMembers(ctx context.Context, groupID string) ([]m
 	for rows.Next() {
 		var u models.User
 		if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt); err != nil {
-			return nil, err
+			return nil, dbError(err)
 		}
 		users = append(users, u)
 	}
 	return users, nil
 }
 
-func (r *PostgresRepo) GetExpensesByGroup(ctx context.Context, groupID string, from, to *time.Time) ([]models.Expense, error) {
-	query := `SELECT id, payer_id, amount, description, split_type, created_at FROM expenses WHERE group_id = $1`
+// GetMemberships returns the group's members with when they joined, in the order they
+// joined. With includeFormer, members who have left are included too, once for each
+// time they were in the group.
+func (r *PostgresRepo) GetMemberships(ctx context.Context, groupID string, includeFormer bool) ([]models.Member, error) {
+	query := `SELECT u.id, u.username, u.email, u.created_at, gm.role, gm.joined_at, gm.left_at, gm.removed_by FROM users u
+	          JOIN group_members gm ON u.id = gm.user_id WHERE gm.group_id = $1 AND (gm.left_at IS NULL OR $2)
+	          ORDER BY gm.joined_at, u.username`
+	rows, err := r.pool.Query(ctx, query, groupID, includeFormer)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	members := []models.Member{}
+	for rows.Next() {
+		var m models.Member
+		if err := rows.Scan(&m.ID, &m.Username, &m.Email, &m.CreatedAt, &m.Role, &m.JoinedAt, &m.LeftAt, &m.RemovedBy); err != nil {
+			return nil, dbError(err)
+		}
+		members = append(members, m)
+	}
+	return members, dbError(rows.Err())
+}
+
+// RemoveMember ends the user's current membership of the group, recording the
+// payments that clear their balance in the same transaction. It returns when they
+// left.
+//
+// The member's balance was worked out before the transaction, from the ledger as it
+// was at ledgerStamp. The group's row is locked first, which waits for any expense or
+// payment still being written (inserts hold a key share lock on it through their
+// foreign key, and UpdateExpense takes one), and the removal fails with a conflict if
+// the ledger has changed since. Otherwise the member could leave with a balance
+// nothing can clear any more.
+func (r *PostgresRepo) RemoveMember(ctx context.Context, groupID, userID string, removedBy uuid.UUID, payments []models.SettlementPayment, ledgerStamp string) (time.Time, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return time.Time{}, dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM groups WHERE id = $1 FOR UPDATE`, groupID); err != nil {
+		return time.Time{}, dbError(err)
+	}
+	stamp, err := ledgerStampOf(ctx, tx, groupID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if stamp != ledgerStamp {
+		return time.Time{}, errLedgerChanged
+	}
+
+	for i := range payments {
+		if err := insertPayment(ctx, tx, &payments[i]); err != nil {
+			return time.Time{}, dbError(err)
+		}
+	}
+
+	var leftAt time.Time
+	query := `UPDATE group_members SET left_at = CURRENT_TIMESTAMP, removed_by = $3
+	          WHERE group_id = $1 AND user_id = $2 AND left_at IS NULL RETURNING left_at`
+	err = tx.QueryRow(ctx, query, groupID, userID, removedBy).Scan(&leftAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, errMemberNotFound.Wrap(err)
+	}
+	if err != nil {
+		return time.Time{}, dbError(err)
+	}
+	return leftAt, dbError(tx.Commit(ctx))
+}
+
+// GetLedgerStamp returns a value that changes whenever an expense or payment in the
+// group is added, changed, deleted or restored.
+func (r *PostgresRepo) GetLedgerStamp(ctx context.Context, groupID string) (string, error) {
+	return ledgerStampOf(ctx, r.pool, groupID)
+}
+
+// ledgerStampOf counts the group's expenses and payments and adds up the expenses'
+// versions, which every change bumps. Payments are never changed once recorded.
+func ledgerStampOf(ctx context.Context, q interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}, groupID string) (string, error) {
+	query := `SELECT (SELECT count(*) || '.' || COALESCE(sum(version), 0) FROM expenses WHERE group_id = $1)
+	                 || '/' || (SELECT count(*) FROM settlement_payments WHERE group_id = $1)`
+	var stamp string
+	if err := q.QueryRow(ctx, query, groupID).Scan(&stamp); err != nil {
+		return "", dbError(err)
+	}
+	return stamp, nil
+}
+
+// GetExpensesByGroup returns the group's expenses with their splits and payers,
+// leaving out deleted ones. Either end of the range may be nil; before is exclusive.
+func (r *PostgresRepo) GetExpensesByGroup(ctx context.Context, groupID string, from, before *time.Time) ([]models.Expense, error) {
+	query := `SELECT id, group_id, payer_id, amount, currency, exchange_rate, description, split_type, created_at, updated_at, version,
+	          created_by FROM expenses WHERE group_id = $1 AND deleted_at IS NULL`
 	args := []interface{}{groupID}
 
 	if from != nil {
 		query += ` AND created_at >= $2`
 		args = append(args, *from)
 	}
-	if to != nil {
+	if before != nil {
 		if from != nil {
-			query += ` AND created_at <= $3`
+			query += ` AND created_at < $3`
 		} else {
-			query += ` AND created_at <= $2`
+			query += ` AND created_at < $2`
 		}
-		args = append(args, *to)
+		args = append(args, *before)
 	}
 
 	rows, err := r.pool.Query(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	defer rows.Close()
 
 	var expenses []models.Expense
 	for rows.Next() {
 		var e models.Expense
-		err := rows.Scan(&e.ID, &e.PayerID, &e.Amount, &e.Description, &e.SplitType, &e.CreatedAt)
+		err := rows.Scan(&e.ID, &e.GroupID, &e.PayerID, &e.Amount, &e.Currency, &e.ExchangeRate, &e.Description, &e.SplitType,
+			&e.CreatedAt, &e.UpdatedAt, &e.Version, &e.CreatedBy)
 		if err != nil {
-			return nil, err
+			return nil, dbError(err)
 		}
 
-		// Get splits for this expense
-		splitQuery := `SELECT user_id, amount FROM expense_splits WHERE expense_id = $1`
-		sRows, err := r.pool.Query(ctx, splitQuery, e.ID)
-		if err != nil {
-			return nil, err
+		if err := r.loadExpenseDetails(ctx, &e); err != nil {
+			return nil, dbError(err)
 		}
-		var splits []models.ExpenseSplit
-		for sRows.Next() {
-			var s models.ExpenseSplit
-			if err := sRows.Scan(&s.UserID, &s.Amount); err != nil {
-				sRows.Close()
-				return nil, err
-			}
-			splits = append(splits, s)
+		expenses = append(expenses, e)
+	}
+	return expenses, nil
+}
+
+// ListExpenses returns up to filter.Limit of the group's expenses that match filter,
+// with their splits and payers. Pages are keyed on (created_at, id) rather than an
+// offset, so expenses added while a client pages through don't shift the pages.
+func (r *PostgresRepo) ListExpenses(ctx context.Context, groupID string, filter models.ExpenseFilter) ([]models.Expense, error) {
+	query := `SELECT id, group_id, payer_id, amount, currency, exchange_rate, description, split_type, created_at, updated_at,
+	          version, deleted_at, created_by FROM expenses e WHERE group_id = $1`
+	args := []interface{}{groupID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if !filter.IncludeDeleted {
+		query += ` AND deleted_at IS NULL`
+	}
+	if filter.PayerID != nil {
+		p := arg(*filter.PayerID)
+		query += ` AND (payer_id = ` + p + ` OR EXISTS (SELECT 1 FROM expense_payers ep WHERE ep.expense_id = e.id AND ep.user_id = ` + p + `))`
+	}
+	if filter.ParticipantID != nil {
+		query += ` AND EXISTS (SELECT 1 FROM expense_splits es WHERE es.expense_id = e.id AND es.user_id = ` + arg(*filter.ParticipantID) + `)`
+	}
+	if filter.SplitType != "" {
+		query += ` AND split_type = ` + arg(filter.SplitType)
+	}
+	if filter.MinAmount != nil {
+		query += ` AND amount * exchange_rate >= ` + arg(*filter.MinAmount)
+	}
+	if filter.MaxAmount != nil {
+		query += ` AND amount * exchange_rate <= ` + arg(*filter.MaxAmount)
+	}
+	if filter.From != nil {
+		query += ` AND created_at >= ` + arg(*filter.From)
+	}
+	if filter.Before != nil {
+		query += ` AND created_at < ` + arg(*filter.Before)
+	}
+	if filter.Description != "" {
+		query += ` AND description ILIKE ` + arg("%"+likeEscaper.Replace(filter.Description)+"%")
+	}
+
+	order, cmp := "DESC", "<"
+	if filter.Ascending {
+		order, cmp = "ASC", ">"
+	}
+	if filter.After != nil {
+		query += fmt.Sprintf(` AND (created_at, id) %s (%s, %s)`, cmp, arg(filter.After.CreatedAt), arg(filter.After.ID))
+	}
+	query += fmt.Sprintf(` ORDER BY created_at %s, id %s LIMIT %s`, order, order, arg(filter.Limit))
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	expenses := []models.Expense{}
+	for rows.Next() {
+		var e models.Expense
+		err := rows.Scan(&e.ID, &e.GroupID, &e.PayerID, &e.Amount, &e.Currency, &e.ExchangeRate, &e.Description, &e.SplitType,
+			&e.CreatedAt, &e.UpdatedAt, &e.Version, &e.DeletedAt, &e.CreatedBy)
+		if err != nil {
+			return nil, dbError(err)
 		}
-		sRows.Close()
-		e.Splits = splits
 		expenses = append(expenses, e)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+	rows.Close()
+
+	for i := range expenses {
+		if err := r.loadExpenseDetails(ctx, &expenses[i]); err != nil {
+			return nil, dbError(err)
+		}
+	}
 	return expenses, nil
 }
+
+// likeEscaper escapes the wildcards in text matched with LIKE, so that a search for
+// "50%" finds exactly that.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// loadExpenseDetails fills in an expense's splits and payers.
+func (r *PostgresRepo) loadExpenseDetails(ctx context.Context, e *models.Expense) error {
+	splitQuery := `SELECT user_id, amount, percentage, basis_points, shares FROM expense_splits WHERE expense_id = $1`
+	sRows, err := r.pool.Query(ctx, splitQuery, e.ID)
+	if err != nil {
+		return err
+	}
+	var splits []models.ExpenseSplit
+	for sRows.Next() {
+		var s models.ExpenseSplit
+		if err := sRows.Scan(&s.UserID, &s.Amount, &s.Percentage, &s.BasisPoints, &s.Shares); err != nil {
+			sRows.Close()
+			return err
+		}
+		splits = append(splits, s)
+	}
+	sRows.Close()
+	e.Splits = splits
+
+	payerQuery := `SELECT user_id, amount FROM expense_payers WHERE expense_id = $1`
+	pRows, err := r.pool.Query(ctx, payerQuery, e.ID)
+	if err != nil {
+		return err
+	}
+	var payers []models.ExpensePayer
+	for pRows.Next() {
+		p := models.ExpensePayer{ExpenseID: e.ID}
+		if err := pRows.Scan(&p.UserID, &p.Amount); err != nil {
+			pRows.Close()
+			return err
+		}
+		payers = append(payers, p)
+	}
+	pRows.Close()
+	e.Payers = payers
+	return nil
+}
+
+func (r *PostgresRepo) CountExpensesByGroup(ctx context.Context, groupID string) (int64, error) {
+	var n int64
+	err := r.pool.QueryRow(ctx, `SELECT COUNT(*) FROM expenses WHERE group_id = $1`, groupID).Scan(&n)
+	return n, dbError(err)
+}
+
+func (r *PostgresRepo) GetExpenseItems(ctx context.Context, expenseID string) ([]models.ExpenseItem, []models.Adjustment, error) {
+	itemQuery := `SELECT i.id, i.description, i.amount, s.user_id, s.amount
+	              FROM expense_items i JOIN expense_item_shares s ON s.item_id = i.id
+	              WHERE i.expense_id = $1 ORDER BY i.position, s.user_id`
+	rows, err := r.pool.Query(ctx, itemQuery, expenseID)
+	if err != nil {
+		return nil, nil, dbError(err)
+	}
+	defer rows.Close()
+
+	var items []models.ExpenseItem
+	for rows.Next() {
+		var item models.ExpenseItem
+		var share models.ChargeShare
+		if err := rows.Scan(&item.ID, &item.Description, &item.Amount, &share.UserID, &share.Amount); err != nil {
+			return nil, nil, dbError(err)
+		}
+		if n := len(items); n == 0 || items[n-1].ID != item.ID {
+			item.ExpenseID, _ = models.ParseUUID(expenseID)
+			items = append(items, item)
+		}
+		last := &items[len(items)-1]
+		last.Participants = append(last.Participants, share.UserID)
+		last.Shares = append(last.Shares, share)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, dbError(err)
+	}
+
+	adjQuery := `SELECT a.id, a.kind, a.amount, s.user_id, s.amount
+	             FROM expense_adjustments a JOIN expense_adjustment_shares s ON s.adjustment_id = a.id
+	             WHERE a.expense_id = $1 ORDER BY a.position, s.user_id`
+	aRows, err := r.pool.Query(ctx, adjQuery, expenseID)
+	if err != nil {
+		return nil, nil, dbError(err)
+	}
+	defer aRows.Close()
+
+	var adjustments []models.Adjustment
+	for aRows.Next() {
+		var adj models.Adjustment
+		var share models.ChargeShare
+		if err := aRows.Scan(&adj.ID, &adj.Kind, &adj.Amount, &share.UserID, &share.Amount); err != nil {
+			return nil, nil, dbError(err)
+		}
+		if n := len(adjustments); n == 0 || adjustments[n-1].ID != adj.ID {
+			adj.ExpenseID, _ = models.ParseUUID(expenseID)
+			adjustments = append(adjustments, adj)
+		}
+		last := &adjustments[len(adjustments)-1]
+		last.Shares = append(last.Shares, share)
+	}
+	return items, adjustments, dbError(aRows.Err())
+}
+
+func (r *PostgresRepo) UpsertFXRates(ctx context.Context, rates []models.FXRate) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `INSERT INTO fx_rates (rate_date, base, quote, rate) VALUES ($1::date, $2, $3, $4)
+	          ON CONFLICT (rate_date, base, quote) DO UPDATE SET rate = EXCLUDED.rate`
+	for _, rate := range rates {
+		if _, err := tx.Exec(ctx, query, rate.Date, rate.Base, rate.Quote, rate.Rate); err != nil {
+			return dbError(err)
+		}
+	}
+	return dbError(tx.Commit(ctx))
+}
+
+func (r *PostgresRepo) GetFXRates(ctx context.Context, base, quote string, from, before *time.Time) ([]models.FXRate, error) {
+	query := `SELECT to_char(rate_date, 'YYYY-MM-DD'), base, quote, rate FROM fx_rates WHERE 1 = 1`
+	var args []interface{}
+	if base != "" {
+		args = append(args, base)
+		query += fmt.Sprintf(` AND base = $%d`, len(args))
+	}
+	if quote != "" {
+		args = append(args, quote)
+		query += fmt.Sprintf(` AND quote = $%d`, len(args))
+	}
+	if from != nil {
+		args = append(args, *from)
+		query += fmt.Sprintf(` AND rate_date >= $%d`, len(args))
+	}
+	if before != nil {
+		args = append(args, *before)
+		query += fmt.Sprintf(` AND rate_date < $%d`, len(args))
+	}
+	query += ` ORDER BY rate_date DESC, base, quote`
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	var rates []models.FXRate
+	for rows.Next() {
+		var rate models.FXRate
+		if err := rows.Scan(&rate.Date, &rate.Base, &rate.Quote, &rate.Rate); err != nil {
+			return nil, dbError(err)
+		}
+		rates = append(rates, rate)
+	}
+	return rates, dbError(rows.Err())
+}
+
+// FindFXRate returns the latest base/quote rate dated on or before the given day, or
+// nil if none has been loaded.
+func (r *PostgresRepo) FindFXRate(ctx context.Context, base, quote string, on time.Time) (*models.FXRate, error) {
+	query := `SELECT to_char(rate_date, 'YYYY-MM-DD'), base, quote, rate FROM fx_rates
+	          WHERE base = $1 AND quote = $2 AND rate_date <= $3::date
+	          ORDER BY rate_date DESC LIMIT 1`
+	var rate models.FXRate
+	err := r.pool.QueryRow(ctx, query, base, quote, on.Format("2006-01-02")).Scan(&rate.Date, &rate.Base, &rate.Quote, &rate.Rate)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return &rate, nil
+}
+
+func (r *PostgresRepo) CreateSettlementPayment(ctx context.Context, payment *models.SettlementPayment) error {
+	return dbError(insertPayment(ctx, r.pool, payment))
+}
+
+// queryRower is a pool or a transaction, for inserts that are made both on their own
+// and as part of a larger transaction.
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// insertPayment stores a settlement payment, as a plain PAYMENT unless it says
+// otherwise.
+func insertPayment(ctx context.Context, q queryRower, p *models.SettlementPayment) error {
+	if p.Kind == "" {
+		p.Kind = models.PaymentSettlement
+	}
+	query := `INSERT INTO settlement_payments (group_id, from_user_id, to_user_id, amount, kind)
+	          VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`
+	return q.QueryRow(ctx, query, p.GroupID, p.FromUserID, p.ToUserID, p.Amount, p.Kind).Scan(&p.ID, &p.CreatedAt)
+}
+
+// CreateSettlementPayments stores payments across any number of groups, all or none.
+func (r *PostgresRepo) CreateSettlementPayments(ctx context.Context, payments []models.SettlementPayment) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	for i := range payments {
+		if err := insertPayment(ctx, tx, &payments[i]); err != nil {
+			return dbError(err)
+		}
+	}
+	return dbError(tx.Commit(ctx))
+}
+
+func (r *PostgresRepo) GetSettlementPaymentsByGroup(ctx context.Context, groupID string, from, before *time.Time) ([]models.SettlementPayment, error) {
+	query := `SELECT id, group_id, from_user_id, to_user_id, amount, kind, created_at FROM settlement_payments WHERE group_id = $1`
+	args := []interface{}{groupID}
+	if from != nil {
+		args = append(args, *from)
+		query += fmt.Sprintf(` AND created_at >= $%d`, len(args))
+	}
+	if before != nil {
+		args = append(args, *before)
+		query += fmt.Sprintf(` AND created_at < $%d`, len(args))
+	}
+	query += ` ORDER BY created_at`
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	var payments []models.SettlementPayment
+	for rows.Next() {
+		var p models.SettlementPayment
+		if err := rows.Scan(&p.ID, &p.GroupID, &p.FromUserID, &p.ToUserID, &p.Amount, &p.Kind, &p.CreatedAt); err != nil {
+			return nil, dbError(err)
+		}
+		payments = append(payments, p)
+	}
+	return payments, dbError(rows.Err())
+}
+
+func (r *PostgresRepo) GetPaymentConstraints(ctx context.Context, groupID string) (*models.PaymentConstraints, error) {
+	constraints := &models.PaymentConstraints{Pairs: []models.PairConstraint{}, ReceiveVia: []models.ReceiveHub{}}
+
+	pairQuery := `SELECT user_a, user_b, kind FROM payment_pair_constraints WHERE group_id = $1 ORDER BY kind, user_a, user_b`
+	rows, err := r.pool.Query(ctx, pairQuery, groupID)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c models.PairConstraint
+		if err := rows.Scan(&c.UserA, &c.UserB, &c.Kind); err != nil {
+			return nil, dbError(err)
+		}
+		constraints.Pairs = append(constraints.Pairs, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+
+	hubQuery := `SELECT user_id, hub_user_id FROM payment_receive_hubs WHERE group_id = $1 ORDER BY user_id`
+	hRows, err := r.pool.Query(ctx, hubQuery, groupID)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer hRows.Close()
+	for hRows.Next() {
+		var h models.ReceiveHub
+		if err := hRows.Scan(&h.UserID, &h.HubUserID); err != nil {
+			return nil, dbError(err)
+		}
+		constraints.ReceiveVia = append(constraints.ReceiveVia, h)
+	}
+	return constraints, dbError(hRows.Err())
+}
+
+// ReplacePaymentConstraints swaps the group's whole payment network for the given one.
+func (r *PostgresRepo) ReplacePaymentConstraints(ctx context.Context, groupID string, constraints *models.PaymentConstraints) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM payment_pair_constraints WHERE group_id = $1`, groupID); err != nil {
+		return dbError(err)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM payment_receive_hubs WHERE group_id = $1`, groupID); err != nil {
+		return dbError(err)
+	}
+
+	pairQuery := `INSERT INTO payment_pair_constraints (group_id, user_a, user_b, kind) VALUES ($1, $2, $3, $4)`
+	for _, c := range constraints.Pairs {
+		if _, err := tx.Exec(ctx, pairQuery, groupID, c.UserA, c.UserB, c.Kind); err != nil {
+			return dbError(err)
+		}
+	}
+	hubQuery := `INSERT INTO payment_receive_hubs (group_id, user_id, hub_user_id) VALUES ($1, $2, $3)`
+	for _, h := range constraints.ReceiveVia {
+		if _, err := tx.Exec(ctx, hubQuery, groupID, h.UserID, h.HubUserID); err != nil {
+			return dbError(err)
+		}
+	}
+	return dbError(tx.Commit(ctx))
+}
+
+const paymentMethodColumns = `m.id, m.user_id, m.name, m.fee_kind, m.flat_fee, m.percent, m.free_limit, m.currency`
+
+func (r *PostgresRepo) GetPaymentMethodsByUser(ctx context.Context, userID string) ([]models.PaymentMethod, error) {
+	query := `SELECT ` + paymentMethodColumns + ` FROM user_payment_methods m WHERE m.user_id = $1 ORDER BY m.name`
+	return r.queryPaymentMethods(ctx, query, userID)
+}
+
+// GetPaymentMethodsByGroup returns the payment methods of every member of the group.
+func (r *PostgresRepo) GetPaymentMethodsByGroup(ctx context.Context, groupID string) ([]models.PaymentMethod, error) {
+	query := `SELECT ` + paymentMethodColumns + ` FROM user_payment_methods m
+	          JOIN group_members gm ON gm.user_id = m.user_id
+	          WHERE gm.group_id = $1 AND gm.left_at IS NULL ORDER BY m.user_id, m.name`
+	return r.queryPaymentMethods(ctx, query, groupID)
+}
+
+func (r *PostgresRepo) queryPaymentMethods(ctx context.Context, query string, args ...interface{}) ([]models.PaymentMethod, error) {
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	methods := []models.PaymentMethod{}
+	for rows.Next() {
+		var m models.PaymentMethod
+		if err := rows.Scan(&m.ID, &m.UserID, &m.Name, &m.FeeKind, &m.FlatFee, &m.Percent, &m.FreeLimit, &m.Currency); err != nil {
+			return nil, dbError(err)
+		}
+		methods = append(methods, m)
+	}
+	return methods, dbError(rows.Err())
+}
+
+// ReplacePaymentMethods swaps all of a user's payment methods for the given ones.
+func (r *PostgresRepo) ReplacePaymentMethods(ctx context.Context, userID string, methods []models.PaymentMethod) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM user_payment_methods WHERE user_id = $1`, userID); err != nil {
+		return dbError(err)
+	}
+	query := `INSERT INTO user_payment_methods (user_id, name, fee_kind, flat_fee, percent, free_limit, currency)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+	for i := range methods {
+		m := &methods[i]
+		if err := tx.QueryRow(ctx, query, userID, m.Name, m.FeeKind, m.FlatFee, m.Percent, m.FreeLimit, m.Currency).Scan(&m.ID); err != nil {
+			return dbError(err)
+		}
+	}
+	return dbError(tx.Commit(ctx))
+}
+
+// CreateSettlementPlan saves a new plan for the group and supersedes the one before it.
+func (r *PostgresRepo) CreateSettlementPlan(ctx context.Context, plan *models.SettlementPlan) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := insertSettlementPlan(ctx, tx, plan); err != nil {
+		return err
+	}
+	return dbError(tx.Commit(ctx))
+}
+
+func insertSettlementPlan(ctx context.Context, tx pgx.Tx, plan *models.SettlementPlan) error {
+	supersede := `UPDATE settlement_plans SET status = 'SUPERSEDED', updated_at = CURRENT_TIMESTAMP
+	              WHERE group_id = $1 AND status <> 'SUPERSEDED'`
+	if _, err := tx.Exec(ctx, supersede, plan.GroupID); err != nil {
+		return dbError(err)
+	}
+
+	query := `INSERT INTO settlement_plans (group_id, strategy, currency, status, version)
+	          VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at, updated_at`
+	err := tx.QueryRow(ctx, query, plan.GroupID, plan.Strategy, plan.Currency, plan.Status, plan.Version).
+		Scan(&plan.ID, &plan.CreatedAt, &plan.UpdatedAt)
+	if err != nil {
+		return dbError(err)
+	}
+	return insertPlanTransfers(ctx, tx, plan)
+}
+
+func insertPlanTransfers(ctx context.Context, tx pgx.Tx, plan *models.SettlementPlan) error {
+	query := `INSERT INTO settlement_plan_transfers (id, plan_id, position, from_user_id, to_user_id, amount, paid_amount, status, note)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING updated_at`
+	for i := range plan.Transfers {
+		t := &plan.Transfers[i]
+		if t.ID == uuid.Nil {
+			t.ID = uuid.New()
+		}
+		t.PlanID = plan.ID
+		t.Position = i
+		err := tx.QueryRow(ctx, query, t.ID, plan.ID, t.Position, t.From.ID, t.To.ID, t.Amount, t.PaidAmount, t.Status, t.Note).
+			Scan(&t.UpdatedAt)
+		if err != nil {
+			return dbError(err)
+		}
+	}
+	return nil
+}
+
+// GetSettlementPlan returns the plan with its transfers, or nil if there is no such plan.
+func (r *PostgresRepo) GetSettlementPlan(ctx context.Context, planID string) (*models.SettlementPlan, error) {
+	return r.findSettlementPlan(ctx, `WHERE id = $1`, planID)
+}
+
+// GetCurrentSettlementPlan returns the group's plan that hasn't been superseded, or nil.
+func (r *PostgresRepo) GetCurrentSettlementPlan(ctx context.Context, groupID string) (*models.SettlementPlan, error) {
+	return r.findSettlementPlan(ctx, `WHERE group_id = $1 AND status <> 'SUPERSEDED'`, groupID)
+}
+
+func (r *PostgresRepo) findSettlementPlan(ctx context.Context, where string, arg string) (*models.SettlementPlan, error) {
+	query := `SELECT id, group_id, strategy, currency, status, version, created_at, updated_at FROM settlement_plans ` + where
+	var p models.SettlementPlan
+	err := r.pool.QueryRow(ctx, query, arg).
+		Scan(&p.ID, &p.GroupID, &p.Strategy, &p.Currency, &p.Status, &p.Version, &p.CreatedAt, &p.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	tQuery := `SELECT t.id, t.plan_id, t.position, t.from_user_id, t.to_user_id, fu.username, tu.username,
+	                  t.amount, t.paid_amount, t.status, t.note, t.updated_at
+	           FROM settlement_plan_transfers t
+	           JOIN users fu ON fu.id = t.from_user_id
+	           JOIN users tu ON tu.id = t.to_user_id
+	           WHERE t.plan_id = $1 ORDER BY t.position`
+	rows, err := r.pool.Query(ctx, tQuery, p.ID)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	p.Transfers = []models.PlanTransfer{}
+	for rows.Next() {
+		var t models.PlanTransfer
+		if err := rows.Scan(&t.ID, &t.PlanID, &t.Position, &t.From.ID, &t.To.ID, &t.From.Username, &t.To.Username,
+			&t.Amount, &t.PaidAmount, &t.Status, &t.Note, &t.UpdatedAt); err != nil {
+			return nil, dbError(err)
+		}
+		p.Transfers = append(p.Transfers, t)
+	}
+	return &p, dbError(rows.Err())
+}
+
+// SaveSettlementPlan stores a recomputed plan, rewriting its transfers. Transfers that
+// were kept keep their IDs. plan.Version must be one more than the stored version, or
+// the plan was changed since it was read and nothing is saved.
+func (r *PostgresRepo) SaveSettlementPlan(ctx context.Context, plan *models.SettlementPlan) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := updatePlanVersion(ctx, tx, plan); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM settlement_plan_transfers WHERE plan_id = $1`, plan.ID); err != nil {
+		return dbError(err)
+	}
+	if err := insertPlanTransfers(ctx, tx, plan); err != nil {
+		return dbError(err)
+	}
+	return dbError(tx.Commit(ctx))
+}
+
+// UpdatePlanTransfer saves a change to one transfer and the plan's status, and records
+// the payment that goes with it, if any, in the same transaction. As with
+// SaveSettlementPlan, plan.Version must be one more than the stored version, so two
+// people marking the same transfer paid at once can't both record a payment.
+func (r *PostgresRepo) UpdatePlanTransfer(ctx context.Context, plan *models.SettlementPlan, transfer *models.PlanTransfer, payment *models.SettlementPayment) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	// The plan row is updated first, so its lock keeps concurrent changes in line
+	if err := updatePlanVersion(ctx, tx, plan); err != nil {
+		return err
+	}
+	query := `UPDATE settlement_plan_transfers SET paid_amount = $3, status = $4, note = $5, updated_at = CURRENT_TIMESTAMP
+	          WHERE id = $1 AND plan_id = $2 RETURNING updated_at`
+	err = tx.QueryRow(ctx, query, transfer.ID, plan.ID, transfer.PaidAmount, transfer.Status, transfer.Note).Scan(&transfer.UpdatedAt)
+	if err != nil {
+		return dbError(err)
+	}
+	if payment != nil {
+		if err := insertPayment(ctx, tx, payment); err != nil {
+			return dbError(err)
+		}
+	}
+	return dbError(tx.Commit(ctx))
+}
+
+// updatePlanVersion saves the plan's status and version, provided nobody has saved
+// the plan since it was read.
+func updatePlanVersion(ctx context.Context, tx pgx.Tx, plan *models.SettlementPlan) error {
+	query := `UPDATE settlement_plans SET status = $2, version = $3, updated_at = CURRENT_TIMESTAMP
+	          WHERE id = $1 AND version = $3 - 1 RETURNING updated_at`
+	err := tx.QueryRow(ctx, query, plan.ID, plan.Status, plan.Version).Scan(&plan.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errPlanChanged.Wrap(err)
+	}
+	return dbError(err)
+}
+
+// GetUserByLogin finds a user by username or email, ignoring case, and returns their
+// password hash, which is empty if they have none. A login with an @ in it is an
+// email and anything else a username, so it can only ever match one user.
+func (r *PostgresRepo) GetUserByLogin(ctx context.Context, login string) (*models.User, string, error) {
+	column := "username"
+	if strings.Contains(login, "@") {
+		column = "email"
+	}
+	query := `SELECT id, username, email, created_at, COALESCE(password_hash, '') FROM users
+	          WHERE lower(` + column + `) = lower($1)`
+	var u models.User
+	var hash string
+	err := r.pool.QueryRow(ctx, query, login).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt, &hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, "", errUserNotFound.Wrap(err)
+	}
+	if err != nil {
+		return nil, "", dbError(err)
+	}
+	return &u, hash, nil
+}
+
+// GetUserByEmail finds a user by email, ignoring case.
+func (r *PostgresRepo) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	query := `SELECT id, username, email, created_at FROM users WHERE lower(email) = lower($1)`
+	var u models.User
+	err := r.pool.QueryRow(ctx, query, email).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errUserNotFound.Wrap(err)
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return &u, nil
+}
+
+func (r *PostgresRepo) SetPasswordHash(ctx context.Context, userID, hash string) error {
+	tag, err := r.pool.Exec(ctx, `UPDATE users SET password_hash = $2 WHERE id = $1`, userID, hash)
+	if err != nil {
+		return dbError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepo) CreateLoginCode(ctx context.Context, code *models.LoginCode) error {
+	query := `INSERT INTO login_codes (user_id, code_hash, expires_at) VALUES ($1, $2, $3) RETURNING id, created_at`
+	return dbError(r.pool.QueryRow(ctx, query, code.UserID, code.CodeHash, code.ExpiresAt).Scan(&code.ID, &code.CreatedAt))
+}
+
+// GetLatestLoginCode returns the user's most recent login code that is unused and
+// unexpired, or nil if there is none. Asking for a new code makes older ones useless.
+func (r *PostgresRepo) GetLatestLoginCode(ctx context.Context, userID string) (*models.LoginCode, error) {
+	query := `SELECT id, user_id, code_hash, attempts, expires_at, created_at FROM (
+	              SELECT * FROM login_codes WHERE user_id = $1 ORDER BY created_at DESC LIMIT 1
+	          ) latest WHERE used_at IS NULL AND expires_at > CURRENT_TIMESTAMP`
+	var c models.LoginCode
+	err := r.pool.QueryRow(ctx, query, userID).Scan(&c.ID, &c.UserID, &c.CodeHash, &c.Attempts, &c.ExpiresAt, &c.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return &c, nil
+}
+
+// CountLoginCodes counts the codes sent to the user since the given time.
+func (r *PostgresRepo) CountLoginCodes(ctx context.Context, userID string, since time.Time) (int, error) {
+	var n int
+	err := r.pool.QueryRow(ctx, `SELECT count(*) FROM login_codes WHERE user_id = $1 AND created_at >= $2`, userID, since).Scan(&n)
+	return n, dbError(err)
+}
+
+// AddLoginCodeAttempt counts a try at the code, unless it has had max tries already,
+// and reports whether the try may go ahead. The check and the count are one statement,
+// so guesses sent in parallel can't get past the limit.
+func (r *PostgresRepo) AddLoginCodeAttempt(ctx context.Context, codeID string, max int) (bool, error) {
+	query := `UPDATE login_codes SET attempts = attempts + 1 WHERE id = $1 AND attempts < $2 RETURNING attempts`
+	var attempts int
+	err := r.pool.QueryRow(ctx, query, codeID, max).Scan(&attempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, dbError(err)
+}
+
+// UseLoginCode marks a code used. It fails if the code was used already, so the same
+// code can't log in twice even when two requests race.
+func (r *PostgresRepo) UseLoginCode(ctx context.Context, codeID string) error {
+	tag, err := r.pool.Exec(ctx, `UPDATE login_codes SET used_at = CURRENT_TIMESTAMP WHERE id = $1 AND used_at IS NULL`, codeID)
+	if err != nil {
+		return dbError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return errLoginCodeUsed
+	}
+	return nil
+}
+
+func (r *PostgresRepo) CreateAPIToken(ctx context.Context, token *models.APIToken, hash string) error {
+	query := `INSERT INTO api_tokens (user_id, name, prefix, token_hash, expires_at) VALUES ($1, $2, $3, $4, $5)
+	          RETURNING id, created_at`
+	return dbError(r.pool.QueryRow(ctx, query, token.UserID, token.Name, token.Prefix, hash, token.ExpiresAt).Scan(&token.ID, &token.CreatedAt))
+}
+
+const apiTokenColumns = `id, user_id, name, prefix, created_at, last_used_at, expires_at, revoked_at`
+
+func scanAPIToken(row pgx.Row) (models.APIToken, error) {
+	var t models.APIToken
+	err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &t.CreatedAt, &t.LastUsedAt, &t.ExpiresAt, &t.RevokedAt)
+	return t, err
+}
+
+// GetAPITokenByHash returns the token with the given hash, revoked or not.
+func (r *PostgresRepo) GetAPITokenByHash(ctx context.Context, hash string) (*models.APIToken, error) {
+	t, err := scanAPIToken(r.pool.QueryRow(ctx, `SELECT `+apiTokenColumns+` FROM api_tokens WHERE token_hash = $1`, hash))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errAPITokenNotFound.Wrap(err)
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return &t, nil
+}
+
+// ListAPITokens returns all of the user's tokens, newest first, including revoked ones.
+func (r *PostgresRepo) ListAPITokens(ctx context.Context, userID string) ([]models.APIToken, error) {
+	rows, err := r.pool.Query(ctx, `SELECT `+apiTokenColumns+` FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, dbError(rows.Err())
+}
+
+func (r *PostgresRepo) RevokeAPIToken(ctx context.Context, userID, tokenID string) error {
+	query := `UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`
+	tag, err := r.pool.Exec(ctx, query, tokenID, userID)
+	if err != nil {
+		return dbError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return errAPITokenNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepo) TouchAPIToken(ctx context.Context, tokenID string) error {
+	_, err := r.pool.Exec(ctx, `UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1`, tokenID)
+	return dbError(err)
+}
@@ -0,0 +1,369 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+	"github.com/user/debt-optimization-engine/internal/repositories"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// APITokenPrefix starts every personal API token, which tells them apart from
+	// session tokens and makes them easy to spot in a leaked config file.
+	APITokenPrefix = "dk_"
+
+	MinPasswordLength    = 8
+	loginCodeTTL         = 10 * time.Minute
+	maxLoginCodeAttempts = 5
+
+	// At most this many codes are sent to a user an hour, which also caps how many
+	// guesses fresh codes can buy.
+	maxLoginCodesPerHour = 3
+)
+
+var (
+	errInvalidCredentials = apperrors.Unauthenticated("invalid_credentials", "wrong username, email or password")
+	errInvalidToken       = apperrors.Unauthenticated("invalid_token", "the token is invalid, expired or revoked")
+	errInvalidLoginCode   = apperrors.Unauthenticated("invalid_login_code", "the login code is wrong or has expired")
+)
+
+// CodeSender delivers login codes to users.
+type CodeSender interface {
+	SendLoginCode(ctx context.Context, user *models.User, code string) error
+}
+
+// LogCodeSender writes login codes to the server log instead of emailing them. Anyone
+// who can read the log can log in as anyone, so it is only for development.
+type LogCodeSender struct{}
+
+func (LogCodeSender) SendLoginCode(ctx context.Context, user *models.User, code string) error {
+	log.Printf("login code for %s <%s>: %s", user.Username, user.Email, code)
+	return nil
+}
+
+// SMTPCodeSender emails login codes through a mail server. Username and Password are
+// optional; without them it sends without authenticating.
+type SMTPCodeSender struct {
+	Addr     string // host:port
+	From     string
+	Username string
+	Password string
+}
+
+func (s SMTPCodeSender) SendLoginCode(ctx context.Context, user *models.User, code string) error {
+	if strings.ContainsAny(user.Email, "\r\n") {
+		return fmt.Errorf("can't send a login code to %q", user.Email)
+	}
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Your login code\r\n\r\n"+
+		"Your login code is %s. It works once, for the next ten minutes.\r\n", s.From, user.Email, code)
+	return smtp.SendMail(s.Addr, auth, s.From, []string{user.Email}, []byte(msg))
+}
+
+// AuthService logs users in and works out who is behind a token. Logging in, with a
+// password or an emailed code, gives a session token signed with the server's secret;
+// personal API tokens are random and stored only as hashes.
+type AuthService struct {
+	repo       repositories.Repository
+	secret     []byte
+	sessionTTL time.Duration
+	codes      CodeSender
+	now        func() time.Time
+}
+
+func NewAuthService(repo repositories.Repository, secret []byte, sessionTTL time.Duration, codes CodeSender) *AuthService {
+	return &AuthService{repo: repo, secret: secret, sessionTTL: sessionTTL, codes: codes, now: time.Now}
+}
+
+// HashPassword checks a new password is long enough and hashes it for storage.
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", invalid(FieldErrors{{Field: "password", Code: CodeInvalidValue, Message: fmt.Sprintf("must be at least %d characters", MinPasswordLength)}})
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", invalid(FieldErrors{{Field: "password", Code: CodeInvalidValue, Message: err.Error()}})
+	}
+	return string(hash), nil
+}
+
+// SignUp creates a user, with a password if one is given. Usernames can't contain an @
+// and emails must, so a login is never one user's username and another's email.
+func (a *AuthService) SignUp(ctx context.Context, user *models.User, password string) error {
+	user.Username = strings.TrimSpace(user.Username)
+	user.Email = strings.TrimSpace(user.Email)
+	var errs FieldErrors
+	switch {
+	case user.Username == "":
+		errs = append(errs, FieldError{Field: "username", Code: CodeRequired, Message: "is required"})
+	case strings.Contains(user.Username, "@"):
+		errs = append(errs, FieldError{Field: "username", Code: CodeInvalidValue, Message: "must not contain @"})
+	}
+	switch {
+	case user.Email == "":
+		errs = append(errs, FieldError{Field: "email", Code: CodeRequired, Message: "is required"})
+	case !strings.Contains(user.Email, "@"):
+		errs = append(errs, FieldError{Field: "email", Code: CodeInvalidValue, Message: "must be an email address"})
+	}
+	if len(errs) > 0 {
+		return invalid(errs)
+	}
+
+	var hash string
+	if password != "" {
+		var err error
+		if hash, err = HashPassword(password); err != nil {
+			return err
+		}
+	}
+	return a.repo.CreateUser(ctx, user, hash)
+}
+
+// Login checks a username or email and password. Users without a password can only
+// log in with a code.
+func (a *AuthService) Login(ctx context.Context, login, password string) (*models.Session, error) {
+	user, hash, err := a.repo.GetUserByLogin(ctx, strings.TrimSpace(login))
+	if apperrors.IsNotFound(err) {
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hash == "" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, errInvalidCredentials
+	}
+	return a.session(user), nil
+}
+
+// SetPassword replaces the user's password, or gives them one.
+func (a *AuthService) SetPassword(ctx context.Context, userID uuid.UUID, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return a.repo.SetPasswordHash(ctx, userID.String(), hash)
+}
+
+// RequestLoginCode sends a six-digit code to the user with this email, replacing any
+// code sent before. Nothing tells the caller whether the email is registered, or
+// whether the user has had too many codes this hour and was sent nothing.
+func (a *AuthService) RequestLoginCode(ctx context.Context, email string) error {
+	if strings.TrimSpace(email) == "" {
+		return Required("email")
+	}
+	user, err := a.repo.GetUserByEmail(ctx, strings.TrimSpace(email))
+	if apperrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sent, err := a.repo.CountLoginCodes(ctx, user.ID.String(), a.now().Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	if sent >= maxLoginCodesPerHour {
+		return nil
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	err = a.repo.CreateLoginCode(ctx, &models.LoginCode{
+		UserID:    user.ID,
+		CodeHash:  a.codeHash(user.ID, code),
+		ExpiresAt: a.now().Add(loginCodeTTL),
+	})
+	if err != nil {
+		return err
+	}
+	return a.codes.SendLoginCode(ctx, user, code)
+}
+
+// VerifyLoginCode logs in with the latest code sent to the email. A code works once,
+// for ten minutes, and stops working after five wrong guesses.
+func (a *AuthService) VerifyLoginCode(ctx context.Context, email, code string) (*models.Session, error) {
+	user, err := a.repo.GetUserByEmail(ctx, strings.TrimSpace(email))
+	if apperrors.IsNotFound(err) {
+		return nil, errInvalidLoginCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := a.repo.GetLatestLoginCode(ctx, user.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	if c == nil || !a.now().Before(c.ExpiresAt) {
+		return nil, errInvalidLoginCode
+	}
+	// Every try is counted before the code is compared, right or wrong
+	ok, err := a.repo.AddLoginCodeAttempt(ctx, c.ID.String(), maxLoginCodeAttempts)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !hmac.Equal([]byte(c.CodeHash), []byte(a.codeHash(user.ID, strings.TrimSpace(code)))) {
+		return nil, errInvalidLoginCode
+	}
+	if err := a.repo.UseLoginCode(ctx, c.ID.String()); err != nil {
+		return nil, err
+	}
+	return a.session(user), nil
+}
+
+// Authenticate returns the user a session or API token belongs to.
+func (a *AuthService) Authenticate(ctx context.Context, token string) (*models.User, error) {
+	var userID string
+	if strings.HasPrefix(token, APITokenPrefix) {
+		t, err := a.repo.GetAPITokenByHash(ctx, tokenHash(token))
+		if apperrors.IsNotFound(err) {
+			return nil, errInvalidToken
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t.RevokedAt != nil || (t.ExpiresAt != nil && !a.now().Before(*t.ExpiresAt)) {
+			return nil, errInvalidToken
+		}
+		if err := a.repo.TouchAPIToken(ctx, t.ID.String()); err != nil {
+			return nil, err
+		}
+		userID = t.UserID.String()
+	} else {
+		id, ok := a.verifySession(token)
+		if !ok {
+			return nil, errInvalidToken
+		}
+		userID = id
+	}
+
+	user, err := a.repo.GetUser(ctx, userID)
+	if apperrors.IsNotFound(err) {
+		return nil, errInvalidToken
+	}
+	return user, err
+}
+
+// CreateAPIToken makes a personal API token for the user. The token itself is only in
+// the result; it can't be shown again.
+func (a *AuthService) CreateAPIToken(ctx context.Context, userID uuid.UUID, name string, expiresAt *time.Time) (*models.NewAPIToken, error) {
+	name = strings.TrimSpace(name)
+	var errs FieldErrors
+	switch {
+	case name == "":
+		errs = append(errs, FieldError{Field: "name", Code: CodeRequired, Message: "is required"})
+	case len(name) > 100:
+		errs = append(errs, FieldError{Field: "name", Code: CodeInvalidValue, Message: "must be at most 100 characters"})
+	}
+	if expiresAt != nil && !expiresAt.After(a.now()) {
+		errs = append(errs, FieldError{Field: "expires_at", Code: CodeInvalidValue, Message: "must be in the future"})
+	}
+	if len(errs) > 0 {
+		return nil, invalid(errs)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	token := APITokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	t := &models.NewAPIToken{
+		APIToken: models.APIToken{UserID: userID, Name: name, Prefix: token[:len(APITokenPrefix)+6], ExpiresAt: expiresAt},
+		Token:    token,
+	}
+	if err := a.repo.CreateAPIToken(ctx, &t.APIToken, tokenHash(token)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (a *AuthService) ListAPITokens(ctx context.Context, userID uuid.UUID) ([]models.APIToken, error) {
+	return a.repo.ListAPITokens(ctx, userID.String())
+}
+
+// RevokeAPIToken stops one of the user's tokens working. It stays in their list.
+func (a *AuthService) RevokeAPIToken(ctx context.Context, userID uuid.UUID, tokenID string) error {
+	if _, err := ParseID("token_id", tokenID); err != nil {
+		return err
+	}
+	return a.repo.RevokeAPIToken(ctx, userID.String(), tokenID)
+}
+
+// session issues a token of the form payload.signature, where the payload is the
+// user's ID and the token's expiry as a Unix time.
+func (a *AuthService) session(user *models.User) *models.Session {
+	expires := a.now().Add(a.sessionTTL).Truncate(time.Second)
+	payload := user.ID.String() + "." + strconv.FormatInt(expires.Unix(), 10)
+	token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(a.sign("session:"+payload))
+	return &models.Session{Token: token, ExpiresAt: expires, User: user.Summary()}
+}
+
+// verifySession checks a session token's signature and expiry and returns the ID of
+// the user it was issued to.
+func (a *AuthService) verifySession(token string) (string, bool) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, a.sign("session:"+string(payload))) {
+		return "", false
+	}
+	userID, exp, ok := strings.Cut(string(payload), ".")
+	if !ok {
+		return "", false
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || !a.now().Before(time.Unix(unix, 0)) {
+		return "", false
+	}
+	return userID, true
+}
+
+func (a *AuthService) sign(message string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// codeHash keys a login code to its user, so a stored hash is no use for anyone else.
+func (a *AuthService) codeHash(userID uuid.UUID, code string) string {
+	return hex.EncodeToString(a.sign("login-code:" + userID.String() + ":" + code))
+}
+
+// tokenHash is how API tokens are stored. They are long and random, so a fast hash is
+// enough.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
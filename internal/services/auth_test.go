@@ -0,0 +1,173 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+// codeRecorder keeps the login codes it is asked to send.
+type codeRecorder struct {
+	codes []string
+}
+
+func (r *codeRecorder) SendLoginCode(ctx context.Context, user *models.User, code string) error {
+	r.codes = append(r.codes, code)
+	return nil
+}
+
+func newAuth(repo *fakeRepo) (*AuthService, *codeRecorder) {
+	codes := &codeRecorder{}
+	return NewAuthService(repo, []byte("test secret"), time.Hour, codes), codes
+}
+
+func TestSignUp(t *testing.T) {
+	repo := newFakeRepo("Alice")
+	repo.members[0].Email = "alice@example.com"
+	auth, sent := newAuth(repo)
+	ctx := context.Background()
+
+	// A username that looks like someone's email would shadow them at login
+	var fields FieldErrors
+	assert.ErrorAs(t, auth.SignUp(ctx, &models.User{Username: "alice@example.com", Email: "mallory@example.com"}, ""), &fields)
+	assert.Equal(t, "username", fields[0].Field)
+	assert.ErrorAs(t, auth.SignUp(ctx, &models.User{Username: "mallory", Email: "alice"}, ""), &fields)
+	assert.Equal(t, "email", fields[0].Field)
+
+	carol := &models.User{Username: " Carol ", Email: "carol@example.com"}
+	assert.NoError(t, auth.SignUp(ctx, carol, "correct horse"))
+	assert.Equal(t, "Carol", carol.Username)
+	for _, login := range []string{"carol", "CAROL@example.com"} {
+		session, err := auth.Login(ctx, login, "correct horse")
+		assert.NoError(t, err)
+		assert.Equal(t, carol.ID, session.User.ID)
+	}
+
+	// Codes only go to an email address, never to whoever has that username
+	assert.NoError(t, auth.RequestLoginCode(ctx, "Alice"))
+	assert.Empty(t, sent.codes)
+}
+
+func TestPasswordLogin(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+	auth, _ := newAuth(repo)
+	ctx := context.Background()
+
+	var fields FieldErrors
+	assert.ErrorAs(t, auth.SetPassword(ctx, alice, "short"), &fields)
+	assert.Equal(t, "password", fields[0].Field)
+	assert.NoError(t, auth.SetPassword(ctx, alice, "correct horse"))
+
+	_, err := auth.Login(ctx, "alice", "wrong horse")
+	assert.Equal(t, "invalid_credentials", codeOf(err))
+	_, err = auth.Login(ctx, "Bob", "")
+	assert.Equal(t, "invalid_credentials", codeOf(err))
+
+	session, err := auth.Login(ctx, "alice", "correct horse")
+	assert.NoError(t, err)
+	assert.Equal(t, alice, session.User.ID)
+
+	user, err := auth.Authenticate(ctx, session.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, alice, user.ID)
+
+	// Swapping in another user's ID breaks the signature
+	encoded, sig, _ := strings.Cut(session.Token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(encoded)
+	forged := strings.Replace(string(payload), alice.String(), bob.String(), 1)
+	_, err = auth.Authenticate(ctx, base64.RawURLEncoding.EncodeToString([]byte(forged))+"."+sig)
+	assert.Equal(t, apperrors.KindUnauthenticated, apperrors.KindOf(err))
+
+	auth.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = auth.Authenticate(ctx, session.Token)
+	assert.Equal(t, "invalid_token", codeOf(err))
+}
+
+func TestLoginCode(t *testing.T) {
+	repo := newFakeRepo("Alice")
+	repo.members[0].Email = "alice@example.com"
+	auth, sent := newAuth(repo)
+	ctx := context.Background()
+
+	// Unknown emails look the same to the caller but get nothing
+	assert.NoError(t, auth.RequestLoginCode(ctx, "nobody@example.com"))
+	assert.Empty(t, sent.codes)
+
+	assert.NoError(t, auth.RequestLoginCode(ctx, "alice@example.com"))
+	if !assert.Len(t, sent.codes, 1) {
+		return
+	}
+	code := sent.codes[0]
+	assert.Len(t, code, 6)
+
+	// Five wrong guesses use the code up
+	for i := 0; i < maxLoginCodeAttempts; i++ {
+		_, err := auth.VerifyLoginCode(ctx, "alice@example.com", "not it")
+		assert.Equal(t, "invalid_login_code", codeOf(err))
+	}
+	_, err := auth.VerifyLoginCode(ctx, "alice@example.com", code)
+	assert.Equal(t, "invalid_login_code", codeOf(err))
+
+	assert.NoError(t, auth.RequestLoginCode(ctx, "ALICE@example.com"))
+	code = sent.codes[1]
+	session, err := auth.VerifyLoginCode(ctx, "alice@example.com", code)
+	assert.NoError(t, err)
+	assert.Equal(t, repo.user("Alice"), session.User.ID)
+
+	_, err = auth.VerifyLoginCode(ctx, "alice@example.com", code)
+	assert.Equal(t, "invalid_login_code", codeOf(err))
+
+	// A third code this hour is sent, a fourth isn't, so new codes can't buy endless guesses
+	assert.NoError(t, auth.RequestLoginCode(ctx, "alice@example.com"))
+	assert.NoError(t, auth.RequestLoginCode(ctx, "alice@example.com"))
+	assert.Len(t, sent.codes, maxLoginCodesPerHour)
+	auth.now = func() time.Time { return time.Now().Add(time.Hour + time.Second) }
+	assert.NoError(t, auth.RequestLoginCode(ctx, "alice@example.com"))
+	assert.Len(t, sent.codes, maxLoginCodesPerHour+1)
+}
+
+func TestAPITokens(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+	auth, _ := newAuth(repo)
+	ctx := context.Background()
+
+	var fields FieldErrors
+	past := time.Now().Add(-time.Minute)
+	_, err := auth.CreateAPIToken(ctx, alice, " ", &past)
+	assert.ErrorAs(t, err, &fields)
+	assert.Len(t, fields, 2)
+
+	created, err := auth.CreateAPIToken(ctx, alice, "budget script", nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(created.Token, APITokenPrefix))
+	assert.True(t, strings.HasPrefix(created.Token, created.Prefix))
+
+	user, err := auth.Authenticate(ctx, created.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, alice, user.ID)
+	assert.NotNil(t, repo.tokens[0].LastUsedAt)
+
+	_, err = auth.Authenticate(ctx, created.Token+"x")
+	assert.Equal(t, "invalid_token", codeOf(err))
+
+	// Only the owner can revoke it
+	assert.True(t, apperrors.IsNotFound(auth.RevokeAPIToken(ctx, bob, created.ID.String())))
+	assert.NoError(t, auth.RevokeAPIToken(ctx, alice, created.ID.String()))
+	_, err = auth.Authenticate(ctx, created.Token)
+	assert.Equal(t, "invalid_token", codeOf(err))
+
+	soon := time.Now().Add(time.Minute)
+	expiring, err := auth.CreateAPIToken(ctx, bob, "one-off", &soon)
+	assert.NoError(t, err)
+	auth.now = func() time.Time { return soon.Add(time.Second) }
+	_, err = auth.Authenticate(ctx, expiring.Token)
+	assert.Equal(t, "invalid_token", codeOf(err))
+}
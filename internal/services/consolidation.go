@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+// ConsolidatedSettlement nets what a user owes and is owed by each counterparty across
+// all of their groups into one transfer per counterparty.
+//
+// Each group is settled on its own first, with its usual strategy; the transfers that
+// involve the user are then converted into one currency and added up per
+// counterparty. The currency defaults to the groups' base currency, and must be given
+// when the user's groups don't share one.
+func (s *SettlementService) ConsolidatedSettlement(ctx context.Context, userID uuid.UUID, currency string) (*models.ConsolidatedSettlement, error) {
+	groups, err := s.repo.GetGroupsByUser(ctx, userID.String(), false)
+	if err != nil { return nil, err }
+
+	if currency == "" {
+		for _, g := range groups {
+			if currency != "" && g.BaseCurrency != currency {
+				return nil, invalid(errors.New("the user's groups use different base currencies; pick one with ?currency="))
+			}
+			currency = g.BaseCurrency
+		}
+		if currency == "" {
+			currency = models.DefaultCurrency
+		}
+	}
+	currency = models.NormalizeCurrency(currency)
+	if _, ok := models.CurrencyExponent(currency); !ok {
+		return nil, invalid(fmt.Errorf("%w: %q", models.ErrUnknownCurrency, currency))
+	}
+
+	type counterparty struct {
+		user   models.UserSummary
+		net    decimal.Decimal // Positive when the user owes them
+		groups []models.GroupSettlement
+	}
+	byID := make(map[uuid.UUID]*counterparty)
+	user := models.UserSummary{ID: userID}
+	groupTransfers := 0
+
+	for _, g := range groups {
+		plan, err := s.GetSettlement(ctx, g.ID.String(), nil, nil, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %w", g.Name, err)
+		}
+		rate, err := s.fx.Rate(ctx, g.BaseCurrency, currency, time.Now())
+		if err != nil { return nil, err }
+
+		for _, tx := range plan.Transactions {
+			if tx.From.ID != userID && tx.To.ID != userID {
+				continue
+			}
+			other, sign := tx.To, decimal.NewFromInt(1)
+			if tx.To.ID == userID {
+				user, other, sign = tx.To, tx.From, decimal.NewFromInt(-1)
+			} else {
+				user = tx.From
+			}
+			cp, ok := byID[other.ID]
+			if !ok {
+				cp = &counterparty{user: other}
+				byID[other.ID] = cp
+			}
+			converted := ConvertAmount(tx.Amount, rate, currency)
+			cp.net = cp.net.Add(converted.Mul(sign))
+			cp.groups = append(cp.groups, models.GroupSettlement{
+				GroupID:   g.ID,
+				GroupName: g.Name,
+				From:      tx.From,
+				To:        tx.To,
+				Amount:    tx.Amount,
+				Currency:  g.BaseCurrency,
+				Converted: converted,
+			})
+			groupTransfers++
+		}
+	}
+
+	counterparties := make([]*counterparty, 0, len(byID))
+	for _, cp := range byID {
+		counterparties = append(counterparties, cp)
+	}
+	sort.Slice(counterparties, func(i, j int) bool {
+		a, b := counterparties[i].user, counterparties[j].user
+		if a.Username != b.Username {
+			return a.Username < b.Username
+		}
+		return a.ID.String() < b.ID.String()
+	})
+
+	result := &models.ConsolidatedSettlement{
+		UserID:          userID,
+		Currency:        currency,
+		Transfers:       []models.ConsolidatedTransfer{},
+		GroupTransfers:  groupTransfers,
+		TotalOwed:       decimal.Zero,
+		TotalReceivable: decimal.Zero,
+	}
+	for _, cp := range counterparties {
+		t := models.ConsolidatedTransfer{
+			From:   user,
+			To:     cp.user,
+			Amount: cp.net,
+			Groups: cp.groups,
+		}
+		if cp.net.IsNegative() {
+			t.From, t.To = cp.user, user
+			t.Amount = cp.net.Neg()
+			result.TotalReceivable = result.TotalReceivable.Add(t.Amount)
+		} else {
+			result.TotalOwed = result.TotalOwed.Add(t.Amount)
+		}
+		result.Transfers = append(result.Transfers, t)
+	}
+	result.TotalTransfers = len(result.Transfers)
+	return result, nil
+}
+
+// RecordConsolidatedSettlement records the consolidated transfers with the given
+// counterparties (all of them when none are named) by writing a payment for every
+// per-group transfer they pay off, so each group's balances reflect it. The payments
+// are written together or not at all.
+func (s *SettlementService) RecordConsolidatedSettlement(ctx context.Context, userID uuid.UUID, currency string, counterparties []uuid.UUID) ([]models.SettlementPayment, error) {
+	plan, err := s.ConsolidatedSettlement(ctx, userID, currency)
+	if err != nil { return nil, err }
+
+	wanted := make(map[uuid.UUID]bool)
+	for _, id := range counterparties {
+		wanted[id] = true
+	}
+	found := make(map[uuid.UUID]bool)
+
+	payments := []models.SettlementPayment{}
+	for _, t := range plan.Transfers {
+		other := t.To.ID
+		if other == userID {
+			other = t.From.ID
+		}
+		if len(wanted) > 0 && !wanted[other] {
+			continue
+		}
+		found[other] = true
+		for _, g := range t.Groups {
+			payments = append(payments, models.SettlementPayment{
+				GroupID:    g.GroupID,
+				FromUserID: g.From.ID,
+				ToUserID:   g.To.ID,
+				Amount:     g.Amount,
+			})
+		}
+	}
+	for id := range wanted {
+		if !found[id] {
+			return nil, invalid(fmt.Errorf("nothing to settle with user %s", id))
+		}
+	}
+	if len(payments) == 0 {
+		return payments, nil
+	}
+
+	if err := s.repo.CreateSettlementPayments(ctx, payments); err != nil {
+		return nil, err
+	}
+	settled := make(map[uuid.UUID]bool)
+	for _, p := range payments {
+		if settled[p.GroupID] {
+			continue
+		}
+		settled[p.GroupID] = true
+		if err := s.archiveIfSettled(ctx, p.GroupID.String()); err != nil { return nil, err }
+	}
+	return payments, nil
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+// paid records an expense paid by payer and owed in full by ower.
+func paid(payer, ower uuid.UUID, amount int64) models.Expense {
+	return models.Expense{
+		PayerID: payer,
+		Amount:  decimal.NewFromInt(amount),
+		Payers:  []models.ExpensePayer{{UserID: payer, Amount: decimal.NewFromInt(amount)}},
+		Splits:  []models.ExpenseSplit{{UserID: ower, Amount: decimal.NewFromInt(amount)}},
+	}
+}
+
+func TestConsolidatedSettlementNetsAcrossGroups(t *testing.T) {
+	trip := newFakeRepo("Alice", "Bob", "Carol")
+	flat := newFakeRepo()
+	flat.group.Name = "Flat"
+	flat.members = trip.members
+	alice, bob, carol := trip.user("Alice"), trip.user("Bob"), trip.user("Carol")
+
+	// Alice owes Bob 100 on the trip; at the flat Bob owes her 60 and Carol owes her 30
+	trip.expenses = []models.Expense{paid(bob, alice, 100)}
+	flat.expenses = []models.Expense{paid(alice, bob, 60), paid(alice, carol, 30)}
+
+	repo := &fakeRepos{groups: []*fakeRepo{trip, flat}}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+
+	plan, err := svc.ConsolidatedSettlement(ctx, alice, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "INR", plan.Currency)
+	assert.Equal(t, 3, plan.GroupTransfers)
+	assert.Equal(t, 2, plan.TotalTransfers)
+
+	toBob := plan.Transfers[0]
+	assert.Equal(t, alice, toBob.From.ID)
+	assert.Equal(t, bob, toBob.To.ID)
+	assert.True(t, toBob.Amount.Equal(decimal.NewFromInt(40)))
+	assert.Len(t, toBob.Groups, 2)
+
+	fromCarol := plan.Transfers[1]
+	assert.Equal(t, carol, fromCarol.From.ID)
+	assert.True(t, fromCarol.Amount.Equal(decimal.NewFromInt(30)))
+	assert.True(t, plan.TotalOwed.Equal(decimal.NewFromInt(40)))
+	assert.True(t, plan.TotalReceivable.Equal(decimal.NewFromInt(30)))
+
+	// Recording only the Bob transfer clears Alice and Bob in both groups
+	payments, err := svc.RecordConsolidatedSettlement(ctx, alice, "", []uuid.UUID{bob})
+	assert.NoError(t, err)
+	assert.Len(t, payments, 2)
+	assert.Len(t, trip.payments, 1)
+	assert.Len(t, flat.payments, 1)
+
+	for _, g := range repo.groups {
+		balances, err := svc.CalculateBalances(ctx, g.group.ID.String(), nil, nil)
+		assert.NoError(t, err)
+		assert.True(t, balances[bob].IsZero(), g.group.Name)
+	}
+
+	plan, err = svc.ConsolidatedSettlement(ctx, alice, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, plan.TotalTransfers)
+
+	_, err = svc.RecordConsolidatedSettlement(ctx, alice, "", []uuid.UUID{bob})
+	var verr *ValidationError
+	assert.ErrorAs(t, err, &verr)
+}
+
+func TestConsolidatedSettlementNeedsCurrencyForMixedGroups(t *testing.T) {
+	trip := newFakeRepo("Alice", "Bob")
+	euro := newFakeRepo()
+	euro.group.BaseCurrency = "EUR"
+	euro.members = trip.members
+	repo := &fakeRepos{groups: []*fakeRepo{trip, euro}}
+	svc := NewSettlementService(repo, NewFXService(repo))
+
+	_, err := svc.ConsolidatedSettlement(context.Background(), trip.user("Alice"), "")
+	var verr *ValidationError
+	assert.ErrorAs(t, err, &verr)
+}
@@ -0,0 +1,179 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+// Page sizes for expense listings.
+const (
+	DefaultExpensePageSize = 50
+	MaxExpensePageSize     = 200
+)
+
+// ExpenseQuery is a request for a page of a group's expenses, as the client sent it.
+// Every field is optional; see models.ExpenseFilter for what each one matches.
+type ExpenseQuery struct {
+	PayerID        string `form:"payer_id"`
+	ParticipantID  string `form:"participant_id"`
+	SplitType      string `form:"split_type"`
+	MinAmount      string `form:"min_amount"`
+	MaxAmount      string `form:"max_amount"`
+	From           string `form:"from"` // YYYY-MM-DD
+	To             string `form:"to"`
+	Description    string `form:"q"`
+	IncludeDeleted bool   `form:"include_deleted"`
+	Order          string `form:"order"` // "desc" (newest first, the default) or "asc"
+	Cursor         string `form:"cursor"`
+	Limit          string `form:"limit"`
+}
+
+// filter checks every field of the query, reporting all the bad ones together.
+func (q ExpenseQuery) filter() (models.ExpenseFilter, error) {
+	f := models.ExpenseFilter{
+		Description:    strings.TrimSpace(q.Description),
+		IncludeDeleted: q.IncludeDeleted,
+		Limit:          DefaultExpensePageSize,
+	}
+	var errs FieldErrors
+	bad := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Code: CodeInvalidValue, Message: fmt.Sprintf(format, args...)})
+	}
+
+	id := func(field, value string) *uuid.UUID {
+		if value == "" {
+			return nil
+		}
+		parsed, err := uuid.Parse(value)
+		if err != nil {
+			errs = append(errs, FieldError{Field: field, Code: CodeInvalidID, Message: fmt.Sprintf("%q is not a valid ID", value)})
+			return nil
+		}
+		return &parsed
+	}
+	f.PayerID = id("payer_id", q.PayerID)
+	f.ParticipantID = id("participant_id", q.ParticipantID)
+
+	switch t := models.SplitType(strings.ToUpper(q.SplitType)); t {
+	case "":
+	case models.SplitEqual, models.SplitExact, models.SplitPercentage, models.SplitShares, models.SplitItemized:
+		f.SplitType = t
+	default:
+		bad("split_type", "unknown split type %q", q.SplitType)
+	}
+
+	amount := func(field, value string) *decimal.Decimal {
+		if value == "" {
+			return nil
+		}
+		d, err := decimal.NewFromString(value)
+		if err != nil {
+			bad(field, "%q is not an amount", value)
+			return nil
+		}
+		return &d
+	}
+	f.MinAmount = amount("min_amount", q.MinAmount)
+	f.MaxAmount = amount("max_amount", q.MaxAmount)
+	if f.MinAmount != nil && f.MaxAmount != nil && f.MinAmount.GreaterThan(*f.MaxAmount) {
+		bad("min_amount", "must not be more than max_amount")
+	}
+
+	var dateErrs FieldErrors
+	f.From, f.Before, dateErrs = dateRange(q.From, q.To)
+	errs = append(errs, dateErrs...)
+
+	switch strings.ToLower(q.Order) {
+	case "", "desc":
+	case "asc":
+		f.Ascending = true
+	default:
+		bad("order", `must be "asc" or "desc"`)
+	}
+
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			bad("cursor", "is not a cursor from a previous page")
+		}
+		f.After = c
+	}
+
+	if q.Limit != "" {
+		n, err := strconv.Atoi(q.Limit)
+		if err != nil || n < 1 || n > MaxExpensePageSize {
+			bad("limit", "must be between 1 and %d", MaxExpensePageSize)
+		} else {
+			f.Limit = n
+		}
+	}
+
+	if len(errs) > 0 {
+		return f, invalid(errs)
+	}
+	return f, nil
+}
+
+// encodeCursor and decodeCursor turn the position of an expense into an opaque token
+// and back. Clients should only pass back what they were given.
+func encodeCursor(e models.Expense) string {
+	raw := e.CreatedAt.UTC().Format(time.RFC3339Nano) + "," + e.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (*models.ExpenseCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	at, id, ok := strings.Cut(string(raw), ",")
+	if !ok {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	c := &models.ExpenseCursor{}
+	if c.CreatedAt, err = time.Parse(time.RFC3339Nano, at); err != nil {
+		return nil, err
+	}
+	if c.ID, err = uuid.Parse(id); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ListExpenses returns one page of a group's expenses, each with its splits and
+// payers. Pass the page's NextCursor back as the cursor to get the next one.
+func (s *ExpenseService) ListExpenses(ctx context.Context, groupID string, q ExpenseQuery) (*models.ExpensePage, error) {
+	if _, err := ParseID("group_id", groupID); err != nil {
+		return nil, err
+	}
+	filter, err := q.filter()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.repo.GetGroup(ctx, groupID); err != nil {
+		return nil, err
+	}
+
+	// Ask for one more than a page to find out whether there is another page
+	limit := filter.Limit
+	filter.Limit++
+	expenses, err := s.repo.ListExpenses(ctx, groupID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &models.ExpensePage{Expenses: expenses}
+	if len(expenses) > limit {
+		page.Expenses = expenses[:limit]
+		page.NextCursor = encodeCursor(expenses[limit-1])
+	}
+	return page, nil
+}
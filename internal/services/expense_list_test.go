@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func TestListExpensesPagesAreStable(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	svc := NewExpenseService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		e := dinner(repo, 10, "Alice", "Alice", "Bob")
+		e.ID, e.CreatedAt = uuid.New(), start.Add(time.Duration(i)*time.Hour)
+		repo.expenses = append(repo.expenses, *e)
+	}
+
+	var seen []uuid.UUID
+	q := ExpenseQuery{Limit: "2"}
+	for pages := 0; ; pages++ {
+		page, err := svc.ListExpenses(ctx, groupID, q)
+		assert.NoError(t, err)
+		for _, e := range page.Expenses {
+			seen = append(seen, e.ID)
+		}
+		if pages == 0 {
+			// A newer expense added while paging shows up on the first page next time,
+			// without shifting the pages still to come
+			e := dinner(repo, 10, "Bob", "Alice", "Bob")
+			e.ID, e.CreatedAt = uuid.New(), start.Add(24*time.Hour)
+			repo.expenses = append(repo.expenses, *e)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+
+	var want []uuid.UUID
+	for i := 4; i >= 0; i-- {
+		want = append(want, repo.expenses[i].ID)
+	}
+	assert.Equal(t, want, seen)
+}
+
+func TestListExpensesIncludesTheWholeEndDay(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	svc := NewExpenseService(repo, NewFXService(repo))
+
+	var ids []uuid.UUID
+	for _, at := range []string{"2026-10-15T09:00:00Z", "2026-10-16T08:00:00Z", "2026-10-17T23:30:00Z", "2026-10-18T00:00:00Z"} {
+		e := dinner(repo, 10, "Alice", "Alice", "Bob")
+		e.ID = uuid.New()
+		e.CreatedAt, _ = time.Parse(time.RFC3339, at)
+		repo.expenses = append(repo.expenses, *e)
+		ids = append(ids, e.ID)
+	}
+
+	page, err := svc.ListExpenses(context.Background(), repo.group.ID.String(), ExpenseQuery{From: "2026-10-16", To: "2026-10-17"})
+	assert.NoError(t, err)
+	var got []uuid.UUID
+	for _, e := range page.Expenses {
+		got = append(got, e.ID)
+	}
+	assert.Equal(t, []uuid.UUID{ids[2], ids[1]}, got)
+}
+
+func TestListExpensesRejectsBadQueries(t *testing.T) {
+	repo := newFakeRepo("Alice")
+	svc := NewExpenseService(repo, NewFXService(repo))
+
+	_, err := svc.ListExpenses(context.Background(), repo.group.ID.String(), ExpenseQuery{
+		PayerID:   "nobody",
+		SplitType: "halves",
+		MinAmount: "100",
+		MaxAmount: "10",
+		From:      "May 1st",
+		Cursor:    "not-a-cursor",
+		Limit:     "1000",
+	})
+	var fields FieldErrors
+	assert.ErrorAs(t, err, &fields)
+	var names []string
+	for _, f := range fields {
+		names = append(names, f.Field)
+	}
+	assert.Equal(t, []string{"payer_id", "split_type", "min_amount", "from", "cursor", "limit"}, names)
+}
+
+func TestExpenseCursorRoundTrip(t *testing.T) {
+	e := models.Expense{ID: uuid.New(), CreatedAt: time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC)}
+	c, err := decodeCursor(encodeCursor(e))
+	assert.NoError(t, err)
+	assert.Equal(t, e.ID, c.ID)
+	assert.True(t, e.CreatedAt.Equal(c.CreatedAt))
+}
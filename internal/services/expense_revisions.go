@@ -0,0 +1,337 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+var (
+	errExpenseNotFound = apperrors.NotFound("expense_not_found", "expense does not exist")
+	errExpenseDeleted  = apperrors.Conflict("expense_deleted", "the expense is deleted; restore it first")
+	errExpenseLive     = apperrors.Conflict("expense_not_deleted", "the expense is not deleted")
+	errExpenseStale    = apperrors.Conflict("expense_changed", "the expense has changed since that version; reload it and try again")
+	errVersionNotFound = apperrors.NotFound("version_not_found", "the expense has no such version")
+)
+
+// editing is an expense about to be changed, with its group's members and the user
+// making the change.
+type editing struct {
+	*membership
+	expense *models.Expense
+	actor   uuid.UUID
+}
+
+// edit loads an expense of the group for actor to change. The actor must be a member
+// and the group still active.
+func (s *ExpenseService) edit(ctx context.Context, groupID, expenseID string, actor uuid.UUID) (*editing, error) {
+	expense, err := s.expense(ctx, groupID, expenseID)
+	if err != nil {
+		return nil, err
+	}
+	m, err := loadMembership(ctx, s.repo, expense.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if errs := m.check(nil, "changed_by", actor); len(errs) > 0 {
+		return nil, invalid(errs)
+	}
+	if err := RequireActive(m.group); err != nil {
+		return nil, err
+	}
+	return &editing{membership: m, expense: expense, actor: actor}, nil
+}
+
+// expense loads an expense, deleted or not, reporting expenses of other groups as
+// missing.
+func (s *ExpenseService) expense(ctx context.Context, groupID, expenseID string) (*models.Expense, error) {
+	gid, err := ParseID("group_id", groupID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ParseID("expense_id", expenseID); err != nil {
+		return nil, err
+	}
+	expense, err := s.repo.GetExpense(ctx, expenseID)
+	if err != nil {
+		return nil, err
+	}
+	if expense.GroupID != gid {
+		return nil, errExpenseNotFound
+	}
+	return expense, nil
+}
+
+// GetExpense returns an expense of the group, including a deleted one.
+func (s *ExpenseService) GetExpense(ctx context.Context, groupID, expenseID string) (*models.Expense, error) {
+	return s.expense(ctx, groupID, expenseID)
+}
+
+// UpdateExpense replaces an expense with update, which is validated and split exactly
+// as a new expense would be. If update.Version is set it must be the version the
+// client last saw, so that two people editing at once don't overwrite each other.
+func (s *ExpenseService) UpdateExpense(ctx context.Context, groupID, expenseID string, actor uuid.UUID, update *models.Expense) (*models.Expense, error) {
+	e, err := s.edit(ctx, groupID, expenseID, actor)
+	if err != nil {
+		return nil, err
+	}
+	current := e.expense
+	if current.DeletedAt != nil {
+		return nil, errExpenseDeleted
+	}
+	if update.Version != 0 && update.Version != current.Version {
+		return nil, errExpenseStale
+	}
+
+	update.ID, update.GroupID, update.CreatedAt, update.CreatedBy = current.ID, current.GroupID, current.CreatedAt, current.CreatedBy
+	update.DeletedAt = nil
+	update.Version = current.Version + 1
+	if err := s.prepare(ctx, e.membership, update, current); err != nil {
+		return nil, err
+	}
+	if err := s.save(ctx, e, update, models.ExpenseUpdated); err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// DeleteExpense marks an expense deleted. It stops counting towards balances but is
+// kept, with its history, so it can be restored.
+func (s *ExpenseService) DeleteExpense(ctx context.Context, groupID, expenseID string, actor uuid.UUID) (*models.Expense, error) {
+	e, err := s.edit(ctx, groupID, expenseID, actor)
+	if err != nil {
+		return nil, err
+	}
+	if e.expense.DeletedAt != nil {
+		return nil, errExpenseDeleted
+	}
+
+	deleted := *e.expense
+	now := time.Now()
+	deleted.DeletedAt = &now
+	deleted.Version++
+	if err := s.save(ctx, e, &deleted, models.ExpenseDeleted); err != nil {
+		return nil, err
+	}
+	return &deleted, nil
+}
+
+// RestoreExpense brings back a deleted expense as it was. Everyone on it must still
+// be a member of the group.
+func (s *ExpenseService) RestoreExpense(ctx context.Context, groupID, expenseID string, actor uuid.UUID) (*models.Expense, error) {
+	e, err := s.edit(ctx, groupID, expenseID, actor)
+	if err != nil {
+		return nil, err
+	}
+	if e.expense.DeletedAt == nil {
+		return nil, errExpenseLive
+	}
+	if errs := e.checkExpense(e.expense); len(errs) > 0 {
+		return nil, invalid(errs)
+	}
+
+	restored := *e.expense
+	restored.DeletedAt = nil
+	restored.Version++
+	if err := s.save(ctx, e, &restored, models.ExpenseRestored); err != nil {
+		return nil, err
+	}
+	return &restored, nil
+}
+
+// save stores the next version of an expense along with its revision. An expense
+// created before revisions were kept first gets one for the version being replaced,
+// so that it can still be compared against.
+func (s *ExpenseService) save(ctx context.Context, e *editing, next *models.Expense, action models.ExpenseAction) error {
+	history, err := s.repo.GetExpenseRevisions(ctx, e.expense.ID.String())
+	if err != nil {
+		return err
+	}
+	var revisions []models.ExpenseRevision
+	if len(history) == 0 {
+		revisions = append(revisions, baseline(e.expense))
+	}
+	actor := e.actor
+	revisions = append(revisions, models.ExpenseRevision{
+		ExpenseID: next.ID,
+		Version:   next.Version,
+		Action:    action,
+		ChangedBy: &actor,
+	})
+	return s.repo.UpdateExpense(ctx, next, revisions)
+}
+
+// baseline is the revision standing in for an expense's history from before
+// revisions were kept. Who made it is unknown.
+func baseline(expense *models.Expense) models.ExpenseRevision {
+	return models.ExpenseRevision{
+		ExpenseID: expense.ID,
+		Version:   expense.Version,
+		Action:    models.ExpenseCreated,
+		ChangedAt: expense.UpdatedAt,
+		Expense:   *expense,
+	}
+}
+
+// ExpenseHistory returns every version of an expense, oldest first.
+func (s *ExpenseService) ExpenseHistory(ctx context.Context, groupID, expenseID string) ([]models.ExpenseRevision, error) {
+	expense, err := s.expense(ctx, groupID, expenseID)
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.repo.GetExpenseRevisions(ctx, expenseID)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		history = []models.ExpenseRevision{baseline(expense)}
+	}
+	return history, nil
+}
+
+// DiffExpense compares two versions of an expense. A zero to means the latest version
+// and a zero from the one before to.
+func (s *ExpenseService) DiffExpense(ctx context.Context, groupID, expenseID string, from, to int) (*models.ExpenseDiff, error) {
+	history, err := s.ExpenseHistory(ctx, groupID, expenseID)
+	if err != nil {
+		return nil, err
+	}
+	latest := history[len(history)-1].Version
+	if to == 0 {
+		to = latest
+	}
+	if from == 0 {
+		from = max(to-1, history[0].Version)
+	}
+
+	var before, after *models.Expense
+	for i := range history {
+		if history[i].Version == from {
+			before = &history[i].Expense
+		}
+		if history[i].Version == to {
+			after = &history[i].Expense
+		}
+	}
+	if before == nil || after == nil {
+		return nil, errVersionNotFound
+	}
+	return &models.ExpenseDiff{
+		ExpenseID:   after.ID,
+		FromVersion: from,
+		ToVersion:   to,
+		Changes:     diffExpenses(before, after),
+	}, nil
+}
+
+// diffExpenses lists the fields that differ between two versions of an expense.
+// Payers and splits are compared per user, as "splits.<user_id>", so that a new
+// participant shows up as an addition rather than a reshuffled list. Items and
+// adjustments are compared by position.
+func diffExpenses(a, b *models.Expense) []models.FieldChange {
+	changes := []models.FieldChange{}
+	field := func(name string, before, after interface{}) {
+		if !reflect.DeepEqual(before, after) {
+			changes = append(changes, models.FieldChange{Field: name, Before: before, After: after})
+		}
+	}
+
+	field("payer_id", a.PayerID, b.PayerID)
+	field("amount", a.Amount.String(), b.Amount.String())
+	field("currency", a.Currency, b.Currency)
+	field("exchange_rate", a.ExchangeRate.String(), b.ExchangeRate.String())
+	field("description", a.Description, b.Description)
+	field("split_type", a.SplitType, b.SplitType)
+	field("deleted", a.DeletedAt != nil, b.DeletedAt != nil)
+
+	perUser("payers", payerAmounts(a), payerAmounts(b), field)
+	perUser("splits", splitAmounts(a), splitAmounts(b), field)
+
+	for i := 0; i < max(len(a.Items), len(b.Items)); i++ {
+		field(fmt.Sprintf("items[%d]", i), item(a.Items, i), item(b.Items, i))
+	}
+	for i := 0; i < max(len(a.Adjustments), len(b.Adjustments)); i++ {
+		field(fmt.Sprintf("adjustments[%d]", i), adjustment(a.Adjustments, i), adjustment(b.Adjustments, i))
+	}
+	return changes
+}
+
+// userAmounts is the amount of each user on an expense, in the order they are listed.
+type userAmounts struct {
+	order   []uuid.UUID
+	amounts map[uuid.UUID]string
+}
+
+func (u *userAmounts) add(id uuid.UUID, amount decimal.Decimal) {
+	u.order = append(u.order, id)
+	u.amounts[id] = amount.String()
+}
+
+// get returns the user's amount, or nil if they aren't listed.
+func (u userAmounts) get(id uuid.UUID) interface{} {
+	if v, ok := u.amounts[id]; ok {
+		return v
+	}
+	return nil
+}
+
+func payerAmounts(e *models.Expense) userAmounts {
+	u := userAmounts{amounts: make(map[uuid.UUID]string)}
+	for _, p := range e.Payers {
+		u.add(p.UserID, p.Amount)
+	}
+	return u
+}
+
+func splitAmounts(e *models.Expense) userAmounts {
+	u := userAmounts{amounts: make(map[uuid.UUID]string)}
+	for _, s := range e.Splits {
+		u.add(s.UserID, s.Amount)
+	}
+	return u
+}
+
+// perUser compares the amounts of every user in either version, earlier version first.
+func perUser(prefix string, a, b userAmounts, field func(name string, before, after interface{})) {
+	seen := make(map[uuid.UUID]bool)
+	for _, id := range append(a.order, b.order...) {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		field(prefix+"."+id.String(), a.get(id), b.get(id))
+	}
+}
+
+// itemChange and adjustmentChange are the parts of an item or adjustment a diff
+// shows; IDs and per-user shares are derived and left out.
+type itemChange struct {
+	Description  string      `json:"description"`
+	Amount       string      `json:"amount"`
+	Participants []uuid.UUID `json:"participants"`
+}
+
+type adjustmentChange struct {
+	Kind   models.AdjustmentKind `json:"kind"`
+	Amount string                `json:"amount"`
+}
+
+func item(items []models.ExpenseItem, i int) interface{} {
+	if i >= len(items) {
+		return nil
+	}
+	return itemChange{Description: items[i].Description, Amount: items[i].Amount.String(), Participants: items[i].Participants}
+}
+
+func adjustment(adjustments []models.Adjustment, i int) interface{} {
+	if i >= len(adjustments) {
+		return nil
+	}
+	return adjustmentChange{Kind: adjustments[i].Kind, Amount: adjustments[i].Amount.String()}
+}
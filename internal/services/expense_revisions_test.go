@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func dinner(repo *fakeRepo, amount int64, payer string, participants ...string) *models.Expense {
+	e := &models.Expense{
+		GroupID:     repo.group.ID,
+		PayerID:     repo.user(payer),
+		Amount:      decimal.NewFromInt(amount),
+		Description: "Dinner",
+		SplitType:   models.SplitEqual,
+	}
+	for _, p := range participants {
+		e.Splits = append(e.Splits, models.ExpenseSplit{UserID: repo.user(p)})
+	}
+	return e
+}
+
+func TestUpdateExpenseRecordsRevisions(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob, carol := repo.user("Alice"), repo.user("Bob"), repo.user("Carol")
+	svc := NewExpenseService(repo, NewFXService(repo))
+	ctx := context.Background()
+
+	expense := dinner(repo, 90, "Alice", "Alice", "Bob")
+	assert.NoError(t, svc.CreateExpense(ctx, expense, &alice))
+	groupID, expenseID := repo.group.ID.String(), expense.ID.String()
+
+	updated, err := svc.UpdateExpense(ctx, groupID, expenseID, bob, dinner(repo, 90, "Alice", "Alice", "Bob", "Carol"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, updated.Version)
+	assert.Equal(t, expense.ID, updated.ID)
+	assert.True(t, decimal.NewFromInt(30).Equal(updated.Splits[2].Amount))
+
+	history, err := svc.ExpenseHistory(ctx, groupID, expenseID)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, models.ExpenseCreated, history[0].Action)
+	assert.Equal(t, alice, *history[0].ChangedBy)
+	assert.Equal(t, models.ExpenseUpdated, history[1].Action)
+	assert.Equal(t, bob, *history[1].ChangedBy)
+
+	diff, err := svc.DiffExpense(ctx, groupID, expenseID, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, diff.FromVersion)
+	assert.Equal(t, 2, diff.ToVersion)
+	assert.Equal(t, []models.FieldChange{
+		{Field: "splits." + alice.String(), Before: "45", After: "30"},
+		{Field: "splits." + bob.String(), Before: "45", After: "30"},
+		{Field: "splits." + carol.String(), Before: nil, After: "30"},
+	}, diff.Changes)
+
+	// Editing from an old version is refused rather than overwriting the newer one
+	stale := dinner(repo, 60, "Alice", "Alice", "Bob")
+	stale.Version = 1
+	_, err = svc.UpdateExpense(ctx, groupID, expenseID, alice, stale)
+	assert.Equal(t, apperrors.KindConflict, apperrors.KindOf(err))
+
+	_, err = svc.DiffExpense(ctx, groupID, expenseID, 1, 5)
+	assert.True(t, apperrors.IsNotFound(err))
+}
+
+func TestDeleteAndRestoreExpense(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	alice := repo.user("Alice")
+	svc := NewExpenseService(repo, NewFXService(repo))
+	settle := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+
+	expense := dinner(repo, 100, "Alice", "Alice", "Bob")
+	assert.NoError(t, svc.CreateExpense(ctx, expense, nil))
+	groupID, expenseID := repo.group.ID.String(), expense.ID.String()
+
+	deleted, err := svc.DeleteExpense(ctx, groupID, expenseID, alice)
+	assert.NoError(t, err)
+	assert.NotNil(t, deleted.DeletedAt)
+	balances, err := settle.CalculateBalances(ctx, groupID, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, allZero(balances))
+
+	_, err = svc.UpdateExpense(ctx, groupID, expenseID, alice, dinner(repo, 50, "Alice", "Alice", "Bob"))
+	assert.Equal(t, apperrors.KindConflict, apperrors.KindOf(err))
+
+	restored, err := svc.RestoreExpense(ctx, groupID, expenseID, alice)
+	assert.NoError(t, err)
+	assert.Nil(t, restored.DeletedAt)
+	assert.Equal(t, 3, restored.Version)
+	balances, err = settle.CalculateBalances(ctx, groupID, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, decimal.NewFromInt(50).Equal(balances[alice]))
+
+	diff, err := svc.DiffExpense(ctx, groupID, expenseID, 1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.FieldChange{{Field: "deleted", Before: false, After: true}}, diff.Changes)
+}
+
+func TestEditingExpenseRequiresMembers(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	svc := NewExpenseService(repo, NewFXService(repo))
+	ctx := context.Background()
+
+	expense := dinner(repo, 100, "Alice", "Alice", "Bob")
+	assert.NoError(t, svc.CreateExpense(ctx, expense, nil))
+	groupID, expenseID := repo.group.ID.String(), expense.ID.String()
+
+	var fields FieldErrors
+	_, err := svc.DeleteExpense(ctx, groupID, expenseID, uuid.New())
+	assert.ErrorAs(t, err, &fields)
+	assert.Equal(t, "changed_by", fields[0].Field)
+
+	update := dinner(repo, 100, "Alice", "Alice")
+	update.Splits = append(update.Splits, models.ExpenseSplit{UserID: uuid.New()})
+	_, err = svc.UpdateExpense(ctx, groupID, expenseID, repo.user("Bob"), update)
+	assert.ErrorAs(t, err, &fields)
+	assert.Equal(t, "splits[1].user_id", fields[0].Field)
+
+	_, err = svc.GetExpense(ctx, uuid.NewString(), expenseID)
+	assert.True(t, apperrors.IsNotFound(err))
+}
+
+func TestHistoryOfExpenseWithoutRevisions(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	svc := NewExpenseService(repo, NewFXService(repo))
+	ctx := context.Background()
+
+	// Expenses created before revisions were kept have none stored
+	expense := dinner(repo, 100, "Alice", "Alice", "Bob")
+	assert.NoError(t, svc.CreateExpense(ctx, expense, nil))
+	repo.revisions = nil
+	groupID, expenseID := repo.group.ID.String(), expense.ID.String()
+
+	update := dinner(repo, 100, "Alice", "Alice", "Bob")
+	update.Description = "Dinner and drinks"
+	_, err := svc.UpdateExpense(ctx, groupID, expenseID, repo.user("Bob"), update)
+	assert.NoError(t, err)
+
+	history, err := svc.ExpenseHistory(ctx, groupID, expenseID)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Nil(t, history[0].ChangedBy)
+	assert.Equal(t, "Dinner", history[0].Expense.Description)
+
+	diff, err := svc.DiffExpense(ctx, groupID, expenseID, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.FieldChange{{Field: "description", Before: "Dinner", After: "Dinner and drinks"}}, diff.Changes)
+}
+
+func TestEditKeepsRotatedRounding(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	repo.group.RoundingPolicy = RoundRotate
+	svc := NewExpenseService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	first := dinner(repo, 10, "Alice", "Alice", "Bob", "Carol")
+	assert.NoError(t, svc.CreateExpense(ctx, first, nil))
+	var before []string
+	for _, s := range first.Splits {
+		before = append(before, s.Amount.String())
+	}
+	assert.NoError(t, svc.CreateExpense(ctx, dinner(repo, 10, "Bob", "Alice", "Bob", "Carol"), nil))
+
+	// Only the description changes, so the extra cent stays where it was
+	update := dinner(repo, 10, "Alice", "Alice", "Bob", "Carol")
+	update.Description = "Dinner and drinks"
+	edited, err := svc.UpdateExpense(ctx, groupID, first.ID.String(), repo.user("Alice"), update)
+	assert.NoError(t, err)
+	var after []string
+	for _, s := range edited.Splits {
+		after = append(after, s.Amount.String())
+	}
+	assert.Equal(t, before, after)
+}
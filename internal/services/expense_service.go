@@ -1,18 +1,151 @@
 package services
 
 import (
+	"context"
 	"errors"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 	"github.com/user/debt-optimization-engine/internal/models"
+	"github.com/user/debt-optimization-engine/internal/repositories"
 )
 
+// ValidationError marks an error caused by the client's input rather than a failure
+// while processing it.
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+func invalid(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ValidationError{Err: err}
+}
+
+type ExpenseService struct {
+	repo repositories.Repository
+	fx   *FXService
+}
+
+func NewExpenseService(repo repositories.Repository, fx *FXService) *ExpenseService {
+	return &ExpenseService{repo: repo, fx: fx}
+}
+
+// CreateExpense derives the splits with the group's rounding policy, validates the
+// result and stores the expense. Invalid input is reported as a *ValidationError;
+// payers and participants who are not in the group are reported as FieldErrors.
+// createdBy, if known, is recorded as who added the expense, and as the author of its
+// first revision.
+func (s *ExpenseService) CreateExpense(ctx context.Context, expense *models.Expense, createdBy *uuid.UUID) error {
+	m, err := loadMembership(ctx, s.repo, expense.GroupID)
+	if err != nil {
+		return err
+	}
+	if err := RequireActive(m.group); err != nil {
+		return err
+	}
+	if createdBy != nil {
+		if errs := m.check(nil, "changed_by", *createdBy); len(errs) > 0 {
+			return invalid(errs)
+		}
+	}
+
+	// The ID is assigned up front so seeded rounding can depend on it
+	expense.ID = uuid.New()
+	expense.Version = 1
+	expense.CreatedBy = createdBy
+	if err := s.prepare(ctx, m, expense, nil); err != nil {
+		return err
+	}
+
+	revision := &models.ExpenseRevision{Version: 1, Action: models.ExpenseCreated, ChangedBy: createdBy}
+	return s.repo.CreateExpense(ctx, expense, revision)
+}
+
+// prepare checks an expense against its group, converts it into the group's base
+// currency and derives its splits. previous is the version being replaced when an
+// expense is edited; its exchange rate is kept while the currency stays the same, and
+// its rounding sequence always, so correcting a description doesn't move anyone's
+// balance.
+func (s *ExpenseService) prepare(ctx context.Context, m *membership, expense, previous *models.Expense) error {
+	if errs := m.checkExpense(expense); len(errs) > 0 {
+		return invalid(errs)
+	}
+	group := m.group
+	policy, ok := LookupRoundingPolicy(group.RoundingPolicy)
+	if !ok {
+		return errors.New("group has an unknown rounding policy: " + group.RoundingPolicy)
+	}
+	if previous != nil {
+		expense.RoundingSequence = previous.RoundingSequence
+	} else {
+		seq, err := s.repo.CountExpensesByGroup(ctx, expense.GroupID.String())
+		if err != nil {
+			return err
+		}
+		expense.RoundingSequence = seq
+	}
+
+	expense.Currency = models.NormalizeCurrency(expense.Currency)
+	if err := expense.Money().Validate(); err != nil {
+		return invalid(err)
+	}
+
+	// Remember the rate into the group's base currency so balances can be summed later
+	if previous != nil && previous.Currency == expense.Currency {
+		expense.ExchangeRate = previous.ExchangeRate
+	} else {
+		rate, err := s.fx.Rate(ctx, expense.Currency, group.BaseCurrency, time.Now())
+		if err != nil {
+			return err
+		}
+		expense.ExchangeRate = rate
+	}
+
+	// Item IDs are assigned when the expense is stored, never taken from the request
+	for i := range expense.Items {
+		expense.Items[i].ID = uuid.Nil
+	}
+	for i := range expense.Adjustments {
+		expense.Adjustments[i].ID = uuid.Nil
+	}
+
+	payerID := expense.PayerID
+	if payerID == uuid.Nil && len(expense.Payers) > 0 {
+		payerID = expense.Payers[0].UserID
+	}
+	splitter := Splitter{
+		Policy:  policy,
+		Context: RoundingContext{ExpenseID: expense.ID, PayerID: payerID, Sequence: expense.RoundingSequence},
+	}
+	if err := splitter.PrepareSplits(expense); err != nil {
+		return invalid(err)
+	}
+	// Only now is the amount of an itemized expense known, for a lone payer to cover
+	NormalizePayers(expense)
+	if err := ValidateSplits(expense); err != nil {
+		return invalid(err)
+	}
+	if err := ValidatePayers(expense); err != nil {
+		return invalid(err)
+	}
+	return nil
+}
+
 // ValidateSplits ensures that the sum of split amounts matches the total expense amount
 // and that there are no duplicate participants or negative amounts.
 func ValidateSplits(expense *models.Expense) error {
 	if expense.Amount.IsNegative() || expense.Amount.IsZero() {
 		return errors.New("expense amount must be positive")
 	}
+	if err := expense.Money().Validate(); err != nil {
+		return err
+	}
 
 	if len(expense.Splits) == 0 {
 		return errors.New("expense must have at least one participant")
@@ -25,6 +158,9 @@ func ValidateSplits(expense *models.Expense) error {
 		if split.Amount.IsNegative() {
 			return errors.New("split amount cannot be negative")
 		}
+		if err := expense.In(split.Amount).Validate(); err != nil {
+			return err
+		}
 
 		uid := split.UserID.String()
 		if members[uid] {
@@ -41,26 +177,196 @@ func ValidateSplits(expense *models.Expense) error {
 	return nil
 }
 
-// CalculateEqualSplits distributes the amount equally among participants, handling rounding drift.
+// NormalizePayers keeps single-payer requests working: an expense with only a PayerID
+// is treated as that user paying the whole amount, and PayerID is set to the first
+// payer when only a payer list is given.
+func NormalizePayers(expense *models.Expense) {
+	if len(expense.Payers) == 0 {
+		if expense.PayerID != uuid.Nil {
+			expense.Payers = []models.ExpensePayer{{UserID: expense.PayerID, Amount: expense.Amount}}
+		}
+		return
+	}
+	if expense.PayerID == uuid.Nil {
+		expense.PayerID = expense.Payers[0].UserID
+	}
+}
+
+// ValidatePayers ensures the payers' amounts add up to the expense amount, that
+// nobody is listed twice and that PayerID is one of them.
+func ValidatePayers(expense *models.Expense) error {
+	if len(expense.Payers) == 0 {
+		return errors.New("expense must have at least one payer")
+	}
+
+	sum := decimal.Zero
+	payers := make(map[uuid.UUID]bool)
+	for _, p := range expense.Payers {
+		if !p.Amount.IsPositive() {
+			return errors.New("payer amount must be positive")
+		}
+		if err := expense.In(p.Amount).Validate(); err != nil {
+			return err
+		}
+		if payers[p.UserID] {
+			return errors.New("duplicate payer found")
+		}
+		payers[p.UserID] = true
+		sum = sum.Add(p.Amount)
+	}
+
+	if !sum.Equal(expense.Amount) {
+		return errors.New("sum of payer amounts does not equal total amount")
+	}
+	if !payers[expense.PayerID] {
+		return errors.New("payer_id must be one of the payers")
+	}
+	return nil
+}
+
+// CalculateEqualSplits distributes the amount equally among participants, handling
+// rounding drift with the default rounding policy.
 func CalculateEqualSplits(amount decimal.Decimal, userIDs []string) []decimal.Decimal {
 	if len(userIDs) == 0 {
 		return nil
 	}
-	numParticipants := decimal.NewFromInt(int64(len(userIDs)))
-	
-	// Use 2 decimal places for financial calculations
-	individualAmount := amount.DivRound(numParticipants, 2)
-	
-	splits := make([]decimal.Decimal, len(userIDs))
-	runningSum := decimal.Zero
+	return DefaultSplitter().Equal(models.Money{Amount: amount, Currency: models.DefaultCurrency}, make([]uuid.UUID, len(userIDs)))
+}
+
+var hundred = decimal.NewFromInt(100)
+
+// Splitter divides expense amounts between participants. Every split type goes through
+// Allocate, so the group's rounding policy decides who absorbs leftover cents.
+type Splitter struct {
+	Policy  RoundingPolicy
+	Context RoundingContext
+}
+
+// DefaultSplitter uses the default rounding policy with an empty context.
+func DefaultSplitter() Splitter {
+	policy, _ := LookupRoundingPolicy(DefaultRoundingPolicy)
+	return Splitter{Policy: policy}
+}
+
+func (sp Splitter) allocate(amount models.Money, userIDs []uuid.UUID, weights []decimal.Decimal) []decimal.Decimal {
+	return Allocate(amount, weights, sp.Policy, sp.Context.withParticipants(userIDs))
+}
+
+// Equal distributes the amount equally among participants.
+func (sp Splitter) Equal(amount models.Money, userIDs []uuid.UUID) []decimal.Decimal {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	weights := make([]decimal.Decimal, len(userIDs))
+	for i := range weights {
+		weights[i] = decimal.NewFromInt(1)
+	}
+	return sp.allocate(amount, userIDs, weights)
+}
+
+// Percentages converts percentages into amounts. Percentages must total exactly 100.
+func (sp Splitter) Percentages(amount models.Money, userIDs []uuid.UUID, percentages []decimal.Decimal) ([]decimal.Decimal, error) {
+	if len(percentages) == 0 {
+		return nil, nil
+	}
 
-	for i := 0; i < len(userIDs)-1; i++ {
-		splits[i] = individualAmount
-		runningSum = runningSum.Add(individualAmount)
+	total := decimal.Zero
+	for _, p := range percentages {
+		if p.IsNegative() {
+			return nil, errors.New("percentage cannot be negative")
+		}
+		if p.Exponent() < -4 {
+			return nil, errors.New("percentage supports at most 4 decimal places")
+		}
+		total = total.Add(p)
+	}
+	if !total.Equal(hundred) {
+		return nil, errors.New("percentages must add up to 100")
 	}
 
-	// Last person takes the remaining to avoid rounding drift
-	splits[len(userIDs)-1] = amount.Sub(runningSum)
+	return sp.allocate(amount, userIDs, percentages), nil
+}
+
+// Shares divides the amount in proportion to each participant's weight (e.g. 2 shares
+// for a couple, 1 for a single). Weights may be decimals.
+func (sp Splitter) Shares(amount models.Money, userIDs []uuid.UUID, shares []decimal.Decimal) ([]decimal.Decimal, error) {
+	if len(shares) == 0 {
+		return nil, nil
+	}
 
-	return splits
+	total := decimal.Zero
+	for _, w := range shares {
+		if w.IsNegative() {
+			return nil, errors.New("shares cannot be negative")
+		}
+		if w.Exponent() < -4 {
+			return nil, errors.New("shares support at most 4 decimal places")
+		}
+		total = total.Add(w)
+	}
+	if !total.IsPositive() {
+		return nil, errors.New("total shares must be positive")
+	}
+
+	return sp.allocate(amount, userIDs, shares), nil
+}
+
+// PrepareSplits fills in split amounts for split types that are derived from the
+// expense total (EQUAL, PERCENTAGE, SHARES, ITEMIZED). EXACT splits are left untouched.
+func (sp Splitter) PrepareSplits(expense *models.Expense) error {
+	userIDs := make([]uuid.UUID, len(expense.Splits))
+	for i, s := range expense.Splits {
+		userIDs[i] = s.UserID
+	}
+
+	var amounts []decimal.Decimal
+	switch expense.SplitType {
+	case models.SplitEqual:
+		amounts = sp.Equal(expense.Money(), userIDs)
+	case models.SplitPercentage:
+		percentages := make([]decimal.Decimal, len(expense.Splits))
+		for i := range expense.Splits {
+			split := &expense.Splits[i]
+			switch {
+			case split.BasisPoints != nil:
+				// Both are kept, so the split reads back as it was entered
+				p := decimal.New(*split.BasisPoints, -2)
+				if split.Percentage != nil && !split.Percentage.Equal(p) {
+					return errors.New("percentage and basis_points disagree")
+				}
+				split.Percentage = &p
+			case split.Percentage != nil:
+			default:
+				return errors.New("percentage split requires a percentage for every participant")
+			}
+			percentages[i] = *split.Percentage
+		}
+		var err error
+		if amounts, err = sp.Percentages(expense.Money(), userIDs, percentages); err != nil {
+			return err
+		}
+	case models.SplitShares:
+		shares := make([]decimal.Decimal, len(expense.Splits))
+		for i, split := range expense.Splits {
+			if split.Shares == nil {
+				return errors.New("shares split requires a share weight for every participant")
+			}
+			shares[i] = *split.Shares
+		}
+		var err error
+		if amounts, err = sp.Shares(expense.Money(), userIDs, shares); err != nil {
+			return err
+		}
+	case models.SplitItemized:
+		return sp.Itemized(expense)
+	case models.SplitExact:
+		return nil
+	default:
+		return errors.New("unsupported split type")
+	}
+
+	for i := range expense.Splits {
+		expense.Splits[i].Amount = amounts[i]
+	}
+	return nil
 }
@@ -110,3 +110,173 @@ func TestCalculateEqualSplits(t *testing.T) {
 	}
 	assert.True(t, sum.Equal(amount))
 }
+
+func TestSplitterPercentages(t *testing.T) {
+	amount := decimal.NewFromInt(100)
+	pct := func(s string) decimal.Decimal { return decimal.RequireFromString(s) }
+
+	t.Run("Thirds", func(t *testing.T) {
+		splits, err := DefaultSplitter().Percentages(inr(amount), nil, []decimal.Decimal{pct("33.3333"), pct("33.3333"), pct("33.3334")})
+		assert.NoError(t, err)
+		assert.True(t, splits[0].Equal(decimal.NewFromFloat(33.33)))
+		assert.True(t, splits[1].Equal(decimal.NewFromFloat(33.33)))
+		assert.True(t, splits[2].Equal(decimal.NewFromFloat(33.34)))
+	})
+
+	t.Run("Zero share never absorbs remainder", func(t *testing.T) {
+		splits, err := DefaultSplitter().Percentages(inr(decimal.NewFromInt(10)), nil, []decimal.Decimal{pct("33.33"), pct("66.67"), pct("0")})
+		assert.NoError(t, err)
+		assert.True(t, splits[0].Equal(decimal.NewFromFloat(3.33)))
+		assert.True(t, splits[1].Equal(decimal.NewFromFloat(6.67)))
+		assert.True(t, splits[2].IsZero())
+	})
+
+	t.Run("Must total 100", func(t *testing.T) {
+		_, err := DefaultSplitter().Percentages(inr(amount), nil, []decimal.Decimal{pct("50"), pct("40")})
+		assert.EqualError(t, err, "percentages must add up to 100")
+	})
+
+	t.Run("Negative percentage", func(t *testing.T) {
+		_, err := DefaultSplitter().Percentages(inr(amount), nil, []decimal.Decimal{pct("150"), pct("-50")})
+		assert.EqualError(t, err, "percentage cannot be negative")
+	})
+}
+
+func TestPrepareSplitsPercentage(t *testing.T) {
+	u1, u2 := uuid.New(), uuid.New()
+	p := decimal.NewFromInt(25)
+	bp := int64(7500)
+
+	expense := &models.Expense{
+		Amount:    decimal.NewFromInt(80),
+		SplitType: models.SplitPercentage,
+		Splits: []models.ExpenseSplit{
+			{UserID: u1, Percentage: &p},
+			{UserID: u2, BasisPoints: &bp},
+		},
+	}
+
+	assert.NoError(t, DefaultSplitter().PrepareSplits(expense))
+	assert.True(t, expense.Splits[0].Amount.Equal(decimal.NewFromInt(20)))
+	assert.True(t, expense.Splits[1].Amount.Equal(decimal.NewFromInt(60)))
+	// Basis points are kept as entered, alongside the percentage they stand for
+	assert.True(t, expense.Splits[1].Percentage.Equal(decimal.NewFromInt(75)))
+	assert.Equal(t, int64(7500), *expense.Splits[1].BasisPoints)
+	assert.NoError(t, ValidateSplits(expense))
+
+	// Saving the expense again as it was read back still works
+	assert.NoError(t, DefaultSplitter().PrepareSplits(expense))
+
+	other := decimal.NewFromInt(70)
+	expense.Splits[1].Percentage = &other
+	assert.EqualError(t, DefaultSplitter().PrepareSplits(expense), "percentage and basis_points disagree")
+
+	expense.Splits[1].Percentage, expense.Splits[1].BasisPoints = nil, nil
+	assert.Error(t, DefaultSplitter().PrepareSplits(expense))
+}
+
+func TestSplitterShares(t *testing.T) {
+	shares := []decimal.Decimal{decimal.NewFromInt(2), decimal.NewFromInt(1), decimal.NewFromInt(1)}
+
+	splits, err := DefaultSplitter().Shares(inr(decimal.NewFromInt(1000)), nil, shares)
+	assert.NoError(t, err)
+	assert.True(t, splits[0].Equal(decimal.NewFromInt(500)))
+	assert.True(t, splits[1].Equal(decimal.NewFromInt(250)))
+	assert.True(t, splits[2].Equal(decimal.NewFromInt(250)))
+
+	// 100 / 2.5 shares: 40.00, 30.00 (1.5 shares would be 60.00)
+	splits, err = DefaultSplitter().Shares(inr(decimal.NewFromInt(100)), nil, []decimal.Decimal{decimal.NewFromInt(1), decimal.NewFromFloat(1.5)})
+	assert.NoError(t, err)
+	assert.True(t, splits[0].Equal(decimal.NewFromInt(40)))
+	assert.True(t, splits[1].Equal(decimal.NewFromInt(60)))
+
+	// Remainder is deterministic: 10 / 3 equal shares
+	splits, err = DefaultSplitter().Shares(inr(decimal.NewFromInt(10)), nil, []decimal.Decimal{decimal.NewFromInt(1), decimal.NewFromInt(1), decimal.NewFromInt(1)})
+	assert.NoError(t, err)
+	assert.True(t, splits[0].Equal(decimal.NewFromFloat(3.33)))
+	assert.True(t, splits[1].Equal(decimal.NewFromFloat(3.33)))
+	assert.True(t, splits[2].Equal(decimal.NewFromFloat(3.34)))
+
+	_, err = DefaultSplitter().Shares(inr(decimal.NewFromInt(10)), nil, []decimal.Decimal{decimal.Zero, decimal.Zero})
+	assert.EqualError(t, err, "total shares must be positive")
+
+	_, err = DefaultSplitter().Shares(inr(decimal.NewFromInt(10)), nil, []decimal.Decimal{decimal.NewFromInt(-1), decimal.NewFromInt(2)})
+	assert.EqualError(t, err, "shares cannot be negative")
+}
+
+func TestPayers(t *testing.T) {
+	u1, u2 := uuid.New(), uuid.New()
+
+	t.Run("Single payer request", func(t *testing.T) {
+		expense := &models.Expense{PayerID: u1, Amount: decimal.NewFromInt(100)}
+		NormalizePayers(expense)
+		assert.Equal(t, 1, len(expense.Payers))
+		assert.Equal(t, u1, expense.Payers[0].UserID)
+		assert.True(t, expense.Payers[0].Amount.Equal(decimal.NewFromInt(100)))
+		assert.NoError(t, ValidatePayers(expense))
+	})
+
+	t.Run("Two cards", func(t *testing.T) {
+		expense := &models.Expense{
+			Amount: decimal.NewFromInt(300),
+			Payers: []models.ExpensePayer{
+				{UserID: u1, Amount: decimal.NewFromInt(200)},
+				{UserID: u2, Amount: decimal.NewFromInt(100)},
+			},
+		}
+		NormalizePayers(expense)
+		assert.Equal(t, u1, expense.PayerID)
+		assert.NoError(t, ValidatePayers(expense))
+
+		expense.Payers[1].Amount = decimal.NewFromInt(50)
+		assert.EqualError(t, ValidatePayers(expense), "sum of payer amounts does not equal total amount")
+	})
+
+	t.Run("Payer ID not among the payers", func(t *testing.T) {
+		expense := &models.Expense{
+			PayerID: u2,
+			Amount:  decimal.NewFromInt(100),
+			Payers:  []models.ExpensePayer{{UserID: u1, Amount: decimal.NewFromInt(100)}},
+		}
+		NormalizePayers(expense)
+		assert.EqualError(t, ValidatePayers(expense), "payer_id must be one of the payers")
+	})
+
+	t.Run("Duplicate payer", func(t *testing.T) {
+		expense := &models.Expense{
+			Amount: decimal.NewFromInt(100),
+			Payers: []models.ExpensePayer{
+				{UserID: u1, Amount: decimal.NewFromInt(50)},
+				{UserID: u1, Amount: decimal.NewFromInt(50)},
+			},
+		}
+		assert.EqualError(t, ValidatePayers(expense), "duplicate payer found")
+	})
+
+	t.Run("No payer", func(t *testing.T) {
+		expense := &models.Expense{Amount: decimal.NewFromInt(100)}
+		NormalizePayers(expense)
+		assert.EqualError(t, ValidatePayers(expense), "expense must have at least one payer")
+	})
+}
+
+func TestValidateSplitsCurrencyPrecision(t *testing.T) {
+	u1, u2 := uuid.New(), uuid.New()
+
+	expense := &models.Expense{
+		Amount:   decimal.NewFromInt(1001),
+		Currency: "JPY",
+		Splits: []models.ExpenseSplit{
+			{UserID: u1, Amount: decimal.NewFromFloat(500.5)},
+			{UserID: u2, Amount: decimal.NewFromFloat(500.5)},
+		},
+	}
+	assert.EqualError(t, ValidateSplits(expense), "JPY amounts allow at most 0 decimal places")
+
+	expense.Amount = decimal.NewFromFloat(10.5)
+	expense.Currency = "JPY"
+	assert.EqualError(t, ValidateSplits(expense), "JPY amounts allow at most 0 decimal places")
+
+	expense.Currency = "ABC"
+	assert.Error(t, ValidateSplits(expense))
+}
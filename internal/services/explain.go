@@ -0,0 +1,314 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/shopspring/decimal"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+// ErrNonMemberParticipant is returned when an expense or payment involves someone who
+// is not a member of the group. Their share would have nowhere to go, so balances
+// can't be worked out until the record is fixed.
+var ErrNonMemberParticipant = apperrors.Conflict("non_member_participant", "participant is not a member of the group")
+
+// groupLedger is every expense and payment's effect on each member's balance, in the
+// group's base currency. Balances, breakdowns and explanations are all read from it, so
+// they always agree.
+type groupLedger struct {
+	group   *models.Group
+	members []models.User // Current members and former ones with entries, ordered by username
+	byID    map[uuid.UUID]models.User // Everyone who has ever been a member
+	entries map[uuid.UUID][]models.BalanceEntry // User ID -> entries, oldest first
+}
+
+// ledger reads the group's expenses and payments made from from up to, but not
+// including, to, as DateRange gives them.
+func (s *SettlementService) ledger(ctx context.Context, groupID string, from, to *time.Time) (*groupLedger, error) {
+	group, err := s.repo.GetGroup(ctx, groupID)
+	if err != nil { return nil, err }
+
+	expenses, err := s.repo.GetExpensesByGroup(ctx, groupID, from, to)
+	if err != nil { return nil, err }
+
+	// Former members stay in the ledger for the expenses and payments they were part of
+	memberships, err := s.repo.GetMemberships(ctx, groupID, true)
+	if err != nil { return nil, err }
+
+	l := &groupLedger{
+		group:   group,
+		byID:    make(map[uuid.UUID]models.User, len(memberships)),
+		entries: make(map[uuid.UUID][]models.BalanceEntry),
+	}
+	current := make(map[uuid.UUID]bool)
+	for _, m := range memberships {
+		l.byID[m.ID] = m.User
+		if m.LeftAt == nil && !current[m.ID] {
+			current[m.ID] = true
+			l.members = append(l.members, m.User)
+		}
+	}
+
+	for _, exp := range expenses {
+		exp = ConvertExpense(exp, group.BaseCurrency)
+		payers := exp.Payers
+		if len(payers) == 0 {
+			payers = []models.ExpensePayer{{UserID: exp.PayerID, Amount: exp.Amount}}
+		}
+
+		// One entry per user involved, in the order they first appear
+		var order []uuid.UUID
+		byUser := make(map[uuid.UUID]*models.BalanceEntry)
+		entryFor := func(userID uuid.UUID) (*models.BalanceEntry, error) {
+			if e, ok := byUser[userID]; ok {
+				return e, nil
+			}
+			if _, ok := l.byID[userID]; !ok {
+				return nil, fmt.Errorf("%w: user %s on expense %s (%q)", ErrNonMemberParticipant, userID, exp.ID, exp.Description)
+			}
+			id := exp.ID
+			e := &models.BalanceEntry{
+				Kind: models.EntryExpense, ExpenseID: &id, Description: exp.Description, Date: exp.CreatedAt,
+				Paid: decimal.Zero, Share: decimal.Zero,
+			}
+			byUser[userID] = e
+			order = append(order, userID)
+			return e, nil
+		}
+		var paidBy []models.UserSummary
+		for _, p := range payers {
+			e, err := entryFor(p.UserID)
+			if err != nil { return nil, err }
+			e.Paid = e.Paid.Add(p.Amount)
+			paidBy = append(paidBy, l.byID[p.UserID].Summary())
+		}
+		for _, split := range exp.Splits {
+			e, err := entryFor(split.UserID)
+			if err != nil { return nil, err }
+			e.Share = e.Share.Add(split.Amount)
+		}
+		for _, userID := range order {
+			e := byUser[userID]
+			e.PaidBy = paidBy
+			e.Net = e.Paid.Sub(e.Share)
+			l.entries[userID] = append(l.entries[userID], *e)
+		}
+	}
+
+	payments, err := s.repo.GetSettlementPaymentsByGroup(ctx, groupID, from, to)
+	if err != nil { return nil, err }
+
+	for _, p := range payments {
+		sender, ok := l.byID[p.FromUserID]
+		if !ok {
+			return nil, fmt.Errorf("%w: user %s on payment %s", ErrNonMemberParticipant, p.FromUserID, p.ID)
+		}
+		recipient, ok := l.byID[p.ToUserID]
+		if !ok {
+			return nil, fmt.Errorf("%w: user %s on payment %s", ErrNonMemberParticipant, p.ToUserID, p.ID)
+		}
+		id := p.ID
+		to, from := recipient.Summary(), sender.Summary()
+		l.entries[sender.ID] = append(l.entries[sender.ID], models.BalanceEntry{
+			Kind: models.EntryPaymentSent, PaymentID: &id, Counterparty: &to, Date: p.CreatedAt,
+			Paid: decimal.Zero, Share: decimal.Zero, Net: p.Amount,
+		})
+		l.entries[recipient.ID] = append(l.entries[recipient.ID], models.BalanceEntry{
+			Kind: models.EntryPaymentReceived, PaymentID: &id, Counterparty: &from, Date: p.CreatedAt,
+			Paid: decimal.Zero, Share: decimal.Zero, Net: p.Amount.Neg(),
+		})
+	}
+
+	for userID := range l.entries {
+		if !current[userID] {
+			l.members = append(l.members, l.byID[userID])
+		}
+	}
+	sort.SliceStable(l.members, func(i, j int) bool { return l.members[i].Username < l.members[j].Username })
+
+	for userID, entries := range l.entries {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Date.Before(entries[j].Date) })
+		running := decimal.Zero
+		for i := range entries {
+			running = running.Add(entries[i].Net)
+			entries[i].RunningBalance = running
+		}
+		l.entries[userID] = entries
+	}
+	return l, nil
+}
+
+// balances returns each member's net balance. Members with nothing recorded are
+// included with a zero balance.
+func (l *groupLedger) balances() map[uuid.UUID]decimal.Decimal {
+	balances := make(map[uuid.UUID]decimal.Decimal)
+	for _, m := range l.members {
+		balances[m.ID] = decimal.Zero
+	}
+	for userID, entries := range l.entries {
+		for _, e := range entries {
+			balances[userID] = balances[userID].Add(e.Net)
+		}
+	}
+	return balances
+}
+
+// summary returns the member with the given ID, as the algorithms key them.
+func (l *groupLedger) summary(key string) models.UserSummary {
+	id, _ := uuid.Parse(key)
+	if m, ok := l.byID[id]; ok {
+		return m.Summary()
+	}
+	return models.UserSummary{ID: id}
+}
+
+// name returns a member's username for messages, given their ID as the algorithms key
+// them.
+func (l *groupLedger) name(key string) string {
+	if u := l.summary(key); u.Username != "" {
+		return u.Username
+	}
+	return key
+}
+
+func (l *groupLedger) breakdown(user models.User) models.BalanceBreakdown {
+	b := models.BalanceBreakdown{
+		GroupID: l.group.ID, User: user.Summary(), Currency: l.group.BaseCurrency,
+		Balance: decimal.Zero, TotalPaid: decimal.Zero, TotalShare: decimal.Zero,
+		PaymentsSent: decimal.Zero, PaymentsReceived: decimal.Zero,
+		Entries: []models.BalanceEntry{},
+	}
+	for _, e := range l.entries[user.ID] {
+		b.Balance = b.Balance.Add(e.Net)
+		switch e.Kind {
+		case models.EntryExpense:
+			b.TotalPaid = b.TotalPaid.Add(e.Paid)
+			b.TotalShare = b.TotalShare.Add(e.Share)
+		case models.EntryPaymentSent:
+			b.PaymentsSent = b.PaymentsSent.Add(e.Net)
+		case models.EntryPaymentReceived:
+			b.PaymentsReceived = b.PaymentsReceived.Sub(e.Net)
+		}
+		b.Entries = append(b.Entries, e)
+	}
+	return b
+}
+
+// BalanceBreakdown lists every expense and payment behind a member's balance.
+func (s *SettlementService) BalanceBreakdown(ctx context.Context, groupID, userID string, from, to *time.Time) (*models.BalanceBreakdown, error) {
+	l, err := s.ledger(ctx, groupID, from, to)
+	if err != nil { return nil, err }
+	for _, m := range l.members {
+		if m.ID.String() == userID {
+			b := l.breakdown(m)
+			return &b, nil
+		}
+	}
+	return nil, apperrors.NotFound("member_not_found", "user is not a member of this group")
+}
+
+// ExplainSettlement works out the settlement plan and explains it. Each transfer shows
+// how it moves both people's balances, and which of the sender's expense shares it
+// pays for: shares of expenses the recipient paid come first, then the rest, oldest
+// first. Each share is only used once across the whole plan.
+func (s *SettlementService) ExplainSettlement(ctx context.Context, groupID string, from, to *time.Time, strategyName string) (*models.SettlementExplanation, error) {
+	l, err := s.ledger(ctx, groupID, from, to)
+	if err != nil { return nil, err }
+
+	balances := l.balances()
+	strategy, settlements, err := s.settle(ctx, l, strategyName, balances)
+	if err != nil { return nil, err }
+
+	// What each member still owes on each expense, to be used up by their transfers
+	type owed struct {
+		entry  models.BalanceEntry
+		amount decimal.Decimal
+	}
+	open := make(map[uuid.UUID][]*owed)
+	for userID, entries := range l.entries {
+		for _, e := range entries {
+			if e.Kind == models.EntryExpense && e.Net.IsNegative() {
+				open[userID] = append(open[userID], &owed{entry: e, amount: e.Net.Neg()})
+			}
+		}
+	}
+
+	exp, _ := models.CurrencyExponent(l.group.BaseCurrency)
+	current := copyBalances(balances)
+	explanation := &models.SettlementExplanation{
+		GroupID:   l.group.ID,
+		Strategy:  strategy.Name(),
+		Currency:  l.group.BaseCurrency,
+		Transfers: []models.TransferExplanation{},
+		Balances:  []models.BalanceBreakdown{},
+	}
+	for _, t := range settlements {
+		te := models.TransferExplanation{
+			From: t.From, To: t.To, Amount: t.Amount,
+			FromBalanceBefore: current[t.From.ID], ToBalanceBefore: current[t.To.ID],
+			Covers: []models.ExpenseCover{},
+		}
+		current[t.From.ID] = current[t.From.ID].Add(t.Amount)
+		current[t.To.ID] = current[t.To.ID].Sub(t.Amount)
+		te.FromBalanceAfter, te.ToBalanceAfter = current[t.From.ID], current[t.To.ID]
+
+		queue := open[t.From.ID]
+		sort.SliceStable(queue, func(i, j int) bool {
+			return paidBy(queue[i].entry, t.To) && !paidBy(queue[j].entry, t.To)
+		})
+		left := t.Amount
+		for _, o := range queue {
+			if !left.IsPositive() {
+				break
+			}
+			if !o.amount.IsPositive() {
+				continue
+			}
+			used := decimal.Min(left, o.amount)
+			o.amount = o.amount.Sub(used)
+			left = left.Sub(used)
+			te.Covers = append(te.Covers, models.ExpenseCover{
+				ExpenseID:       *o.entry.ExpenseID,
+				Description:     o.entry.Description,
+				Amount:          used,
+				PaidByRecipient: paidBy(o.entry, t.To),
+			})
+		}
+
+		te.Summary = fmt.Sprintf("%s pays %s %s %s. Afterwards %s, and %s.",
+			t.From.Username, t.To.Username, t.Amount.StringFixed(exp), l.group.BaseCurrency,
+			describeBalance(t.From.Username, te.FromBalanceAfter, exp),
+			describeBalance(t.To.Username, te.ToBalanceAfter, exp))
+		explanation.Transfers = append(explanation.Transfers, te)
+	}
+
+	for _, m := range l.members {
+		explanation.Balances = append(explanation.Balances, l.breakdown(m))
+	}
+	return explanation, nil
+}
+
+func paidBy(e models.BalanceEntry, user models.UserSummary) bool {
+	for _, p := range e.PaidBy {
+		if p.ID == user.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func describeBalance(name string, balance decimal.Decimal, exp int32) string {
+	switch {
+	case balance.IsZero():
+		return fmt.Sprintf("%s is square", name)
+	case balance.IsNegative():
+		return fmt.Sprintf("%s still owes %s", name, balance.Neg().StringFixed(exp))
+	default:
+		return fmt.Sprintf("%s is still owed %s", name, balance.StringFixed(exp))
+	}
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func TestBalanceBreakdown(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob, carol := repo.user("Alice"), repo.user("Bob"), repo.user("Carol")
+	dinner := paid(alice, bob, 60)
+	dinner.Description = "Dinner"
+	dinner.Splits = []models.ExpenseSplit{
+		{UserID: alice, Amount: decimal.NewFromInt(20)},
+		{UserID: bob, Amount: decimal.NewFromInt(20)},
+		{UserID: carol, Amount: decimal.NewFromInt(20)},
+	}
+	repo.expenses = []models.Expense{dinner}
+	repo.payments = []models.SettlementPayment{{GroupID: repo.group.ID, FromUserID: bob, ToUserID: alice, Amount: decimal.NewFromInt(5)}}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	b, err := svc.BalanceBreakdown(ctx, groupID, alice.String(), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "Alice", b.User.Username)
+	assert.True(t, b.TotalPaid.Equal(decimal.NewFromInt(60)))
+	assert.True(t, b.TotalShare.Equal(decimal.NewFromInt(20)))
+	assert.True(t, b.PaymentsReceived.Equal(decimal.NewFromInt(5)))
+	assert.True(t, b.Balance.Equal(decimal.NewFromInt(35)))
+	assert.Len(t, b.Entries, 2)
+	assert.Equal(t, models.EntryExpense, b.Entries[0].Kind)
+	assert.Equal(t, "Bob", b.Entries[1].Counterparty.Username)
+	assert.True(t, b.Entries[1].RunningBalance.Equal(b.Balance))
+
+	// The breakdown always adds up to the balance
+	balances, err := svc.CalculateBalances(ctx, groupID, nil, nil)
+	assert.NoError(t, err)
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		b, err := svc.BalanceBreakdown(ctx, groupID, repo.user(name).String(), nil, nil)
+		assert.NoError(t, err)
+		assert.True(t, b.Balance.Equal(balances[repo.user(name)]), name)
+	}
+
+	_, err = svc.BalanceBreakdown(ctx, groupID, "someone-else", nil, nil)
+	assert.True(t, apperrors.IsNotFound(err))
+}
+
+func TestExplainSettlement(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob, carol := repo.user("Alice"), repo.user("Bob"), repo.user("Carol")
+	taxi := paid(alice, bob, 30)
+	taxi.Description = "Taxi"
+	lunch := paid(carol, bob, 50)
+	lunch.Description = "Lunch"
+	repo.expenses = []models.Expense{taxi, lunch}
+	svc := NewSettlementService(repo, NewFXService(repo))
+
+	ex, err := svc.ExplainSettlement(context.Background(), repo.group.ID.String(), nil, nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "greedy", ex.Strategy)
+	assert.Len(t, ex.Balances, 3)
+	assert.Len(t, ex.Transfers, 2)
+
+	// Bob pays Carol first (the bigger creditor), and that is his share of her lunch
+	first := ex.Transfers[0]
+	assert.Equal(t, "Bob", first.From.Username)
+	assert.Equal(t, "Carol", first.To.Username)
+	assert.True(t, first.FromBalanceBefore.Equal(decimal.NewFromInt(-80)))
+	assert.True(t, first.FromBalanceAfter.Equal(decimal.NewFromInt(-30)))
+	assert.True(t, first.ToBalanceAfter.IsZero())
+	assert.Len(t, first.Covers, 1)
+	assert.Equal(t, "Lunch", first.Covers[0].Description)
+	assert.True(t, first.Covers[0].PaidByRecipient)
+	assert.Equal(t, "Bob pays Carol 50.00 INR. Afterwards Bob still owes 30.00, and Carol is square.", first.Summary)
+
+	second := ex.Transfers[1]
+	assert.Equal(t, "Taxi", second.Covers[0].Description)
+	assert.True(t, second.Covers[0].Amount.Equal(decimal.NewFromInt(30)))
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/user/debt-optimization-engine/internal/models"
+	"github.com/user/debt-optimization-engine/internal/repositories"
+)
+
+// FXService looks up exchange rates from the local rate table and converts amounts
+// between currencies.
+type FXService struct {
+	repo repositories.Repository
+}
+
+func NewFXService(repo repositories.Repository) *FXService {
+	return &FXService{repo: repo}
+}
+
+var one = decimal.NewFromInt(1)
+
+// Rate returns how many units of quote one unit of base buys, using the most recent
+// rate dated on or before the given day. An inverse rate (quote -> base) is used when
+// no direct one has been loaded.
+func (s *FXService) Rate(ctx context.Context, base, quote string, on time.Time) (decimal.Decimal, error) {
+	if base == quote {
+		return one, nil
+	}
+
+	rate, err := s.repo.FindFXRate(ctx, base, quote, on)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if rate != nil {
+		return rate.Rate, nil
+	}
+
+	inverse, err := s.repo.FindFXRate(ctx, quote, base, on)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if inverse != nil {
+		return one.DivRound(inverse.Rate, 10), nil
+	}
+
+	return decimal.Zero, invalid(fmt.Errorf("no %s/%s exchange rate on or before %s", base, quote, on.Format("2006-01-02")))
+}
+
+// LoadRates validates and stores a batch of rates, replacing any already loaded for
+// the same day and currency pair.
+func (s *FXService) LoadRates(ctx context.Context, rates []models.FXRate) error {
+	for i := range rates {
+		r := &rates[i]
+		r.Base = models.NormalizeCurrency(r.Base)
+		r.Quote = models.NormalizeCurrency(r.Quote)
+		if _, ok := models.CurrencyExponent(r.Base); !ok {
+			return invalid(fmt.Errorf("%w: %q", models.ErrUnknownCurrency, r.Base))
+		}
+		if _, ok := models.CurrencyExponent(r.Quote); !ok {
+			return invalid(fmt.Errorf("%w: %q", models.ErrUnknownCurrency, r.Quote))
+		}
+		if r.Base == r.Quote {
+			return invalid(errors.New("rate base and quote must differ"))
+		}
+		if !r.Rate.IsPositive() {
+			return invalid(errors.New("rate must be positive"))
+		}
+		if _, err := time.Parse("2006-01-02", r.Date); err != nil {
+			return invalid(errors.New("rate date must be YYYY-MM-DD"))
+		}
+	}
+	return s.repo.UpsertFXRates(ctx, rates)
+}
+
+// ConvertExpense returns a copy of the expense with its amount, payers and splits
+// expressed in the base currency using the expense's stored exchange rate. The total
+// is rounded once and then shared out in proportion to the original amounts, so the
+// converted payers and splits still add up to the converted total.
+func ConvertExpense(exp models.Expense, base string) models.Expense {
+	currency := models.NormalizeCurrency(exp.Currency)
+	if currency == base || exp.ExchangeRate.IsZero() {
+		return exp
+	}
+
+	total := models.Money{Amount: exp.Amount.Mul(exp.ExchangeRate), Currency: base}
+	total.Amount = total.Amount.Round(total.Exponent())
+	policy, _ := LookupRoundingPolicy(RoundLargestRemainder)
+
+	out := exp
+	out.Amount = total.Amount
+	out.Currency = base
+
+	weights := make([]decimal.Decimal, len(exp.Payers))
+	for i, p := range exp.Payers {
+		weights[i] = p.Amount
+	}
+	amounts := Allocate(total, weights, policy, RoundingContext{})
+	out.Payers = make([]models.ExpensePayer, len(exp.Payers))
+	for i, p := range exp.Payers {
+		p.Amount = amounts[i]
+		out.Payers[i] = p
+	}
+
+	weights = make([]decimal.Decimal, len(exp.Splits))
+	for i, sp := range exp.Splits {
+		weights[i] = sp.Amount
+	}
+	amounts = Allocate(total, weights, policy, RoundingContext{})
+	out.Splits = make([]models.ExpenseSplit, len(exp.Splits))
+	for i, sp := range exp.Splits {
+		sp.Amount = amounts[i]
+		out.Splits[i] = sp
+	}
+
+	return out
+}
+
+// ConvertAmount converts an amount at the given rate and rounds it to the target
+// currency's precision.
+func ConvertAmount(amount, rate decimal.Decimal, currency string) decimal.Decimal {
+	exp, _ := models.CurrencyExponent(currency)
+	return amount.Mul(rate).Round(exp)
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func TestConvertExpense(t *testing.T) {
+	u1, u2, u3 := uuid.New(), uuid.New(), uuid.New()
+
+	exp := models.Expense{
+		Amount:       decimal.NewFromInt(100),
+		Currency:     "EUR",
+		ExchangeRate: decimal.RequireFromString("90.123"),
+		Payers: []models.ExpensePayer{
+			{UserID: u1, Amount: decimal.NewFromInt(100)},
+		},
+		Splits: []models.ExpenseSplit{
+			{UserID: u1, Amount: decimal.NewFromFloat(33.33)},
+			{UserID: u2, Amount: decimal.NewFromFloat(33.33)},
+			{UserID: u3, Amount: decimal.NewFromFloat(33.34)},
+		},
+	}
+
+	converted := ConvertExpense(exp, "INR")
+	assert.Equal(t, "INR", converted.Currency)
+	assert.True(t, converted.Amount.Equal(decimal.RequireFromString("9012.30")))
+	assert.True(t, converted.Payers[0].Amount.Equal(converted.Amount))
+
+	// Converted splits still add up to the converted total
+	sum := decimal.Zero
+	for _, s := range converted.Splits {
+		sum = sum.Add(s.Amount)
+	}
+	assert.True(t, sum.Equal(converted.Amount))
+
+	// The original is left untouched
+	assert.True(t, exp.Splits[0].Amount.Equal(decimal.NewFromFloat(33.33)))
+
+	// Same-currency expenses pass through
+	exp.Currency = "INR"
+	assert.True(t, ConvertExpense(exp, "INR").Amount.Equal(decimal.NewFromInt(100)))
+}
+
+func TestConvertAmount(t *testing.T) {
+	assert.True(t, ConvertAmount(decimal.NewFromInt(100), decimal.RequireFromString("1.6789"), "JPY").Equal(decimal.NewFromInt(168)))
+	assert.True(t, ConvertAmount(decimal.NewFromInt(100), decimal.RequireFromString("0.0108"), "EUR").Equal(decimal.NewFromFloat(1.08)))
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+// RequireActive refuses changes to the books of a group that has been closed. A
+// settling or archived group has to be reopened before expenses or members can change.
+func RequireActive(group *models.Group) error {
+	if group.Status == models.GroupActive {
+		return nil
+	}
+	return apperrors.Conflict("group_closed", fmt.Sprintf(
+		"the group is %s; reopen it to change its expenses or members", strings.ToLower(string(group.Status))))
+}
+
+// CloseGroup freezes the group's expenses and settles it with a final plan. The group
+// moves to SETTLING until every transfer in that plan is recorded as paid, when it is
+// archived; a group that is already settled up is archived straight away.
+func (s *SettlementService) CloseGroup(ctx context.Context, groupID string, actor uuid.UUID) (*models.GroupClosure, error) {
+	gid, err := ParseID("group_id", groupID)
+	if err != nil { return nil, err }
+
+	m, err := loadMembership(ctx, s.repo, gid)
+	if err != nil { return nil, err }
+	if errs := m.check(nil, "changed_by", actor); len(errs) > 0 {
+		return nil, invalid(errs)
+	}
+	if err := RequireActive(m.group); err != nil { return nil, err }
+
+	// Work the plan out before freezing anything, so a group that can't be settled stays
+	// active. The freeze and the plan are saved together; an expense that slips in
+	// between is picked up when the plan is next refreshed.
+	plan, err := s.newPlan(ctx, groupID, "")
+	if err != nil { return nil, err }
+	group := m.group
+	if err := s.repo.CloseGroup(ctx, group, plan, actor); err != nil {
+		return nil, err
+	}
+	if plan.Status == models.PlanCompleted {
+		if err := s.repo.SetGroupStatus(ctx, group, models.GroupArchived, nil, "nothing left to settle"); err != nil {
+			return nil, err
+		}
+	}
+	return &models.GroupClosure{Group: *group, Plan: plan}, nil
+}
+
+// ReopenGroup makes a settling or archived group active again, for example to add an
+// expense that was forgotten. The reason is kept in the group's status log. A final
+// plan still being paid stays in place and is recomputed as expenses change.
+func (s *SettlementService) ReopenGroup(ctx context.Context, groupID string, actor uuid.UUID, reason string) (*models.Group, error) {
+	gid, err := ParseID("group_id", groupID)
+	if err != nil { return nil, err }
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, Required("reason")
+	}
+
+	m, err := loadMembership(ctx, s.repo, gid)
+	if err != nil { return nil, err }
+	if errs := m.check(nil, "changed_by", actor); len(errs) > 0 {
+		return nil, invalid(errs)
+	}
+	if m.group.Status == models.GroupActive {
+		return nil, apperrors.Conflict("group_active", "the group is already active")
+	}
+	if err := s.repo.SetGroupStatus(ctx, m.group, models.GroupActive, &actor, reason); err != nil {
+		return nil, err
+	}
+	return m.group, nil
+}
+
+// GroupHistory returns every change of the group's status, oldest first.
+func (s *SettlementService) GroupHistory(ctx context.Context, groupID string) ([]models.GroupStatusChange, error) {
+	if _, err := ParseID("group_id", groupID); err != nil { return nil, err }
+	if _, err := s.repo.GetGroup(ctx, groupID); err != nil { return nil, err }
+	return s.repo.GetGroupStatusChanges(ctx, groupID)
+}
+
+// archiveIfSettled archives a settling group once its current plan has been paid in
+// full, whether through the plan's transfers or payments recorded directly.
+func (s *SettlementService) archiveIfSettled(ctx context.Context, groupID string) error {
+	group, err := s.repo.GetGroup(ctx, groupID)
+	if err != nil { return err }
+	if group.Status != models.GroupSettling {
+		return nil
+	}
+	plan, err := s.repo.GetCurrentSettlementPlan(ctx, groupID)
+	if err != nil || plan == nil { return err }
+	if plan, err = s.refreshPlan(ctx, plan); err != nil { return err }
+	if plan.Status != models.PlanCompleted {
+		return nil
+	}
+	return s.repo.SetGroupStatus(ctx, group, models.GroupArchived, nil, "final settlement plan paid")
+}
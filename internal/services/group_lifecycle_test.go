@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/algorithms"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func TestCloseGroupArchivesOncePlanIsPaid(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+	expenses := NewExpenseService(repo, NewFXService(repo))
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	expense := dinner(repo, 90, "Alice", "Alice", "Bob", "Carol")
+	assert.NoError(t, expenses.CreateExpense(ctx, expense, nil))
+
+	closure, err := svc.CloseGroup(ctx, groupID, alice)
+	assert.NoError(t, err)
+	assert.Equal(t, models.GroupSettling, closure.Group.Status)
+	assert.Len(t, closure.Plan.Transfers, 2)
+
+	// The books are frozen while the group settles
+	err = expenses.CreateExpense(ctx, dinner(repo, 30, "Bob", "Alice", "Bob"), nil)
+	e, ok := apperrors.As(err)
+	if assert.True(t, ok) {
+		assert.Equal(t, "group_closed", e.Code)
+	}
+	_, err = expenses.DeleteExpense(ctx, groupID, expense.ID.String(), alice)
+	assert.Equal(t, apperrors.KindConflict, apperrors.KindOf(err))
+	_, err = svc.CloseGroup(ctx, groupID, alice)
+	assert.Equal(t, apperrors.KindConflict, apperrors.KindOf(err))
+
+	// One transfer through the plan, the other as a payment recorded directly
+	plan := closure.Plan
+	first, second := plan.Transfers[0], plan.Transfers[1]
+	_, err = svc.UpdateTransfer(ctx, groupID, plan.ID.String(), first.ID.String(), models.TransferUpdate{Status: models.TransferPaid})
+	assert.NoError(t, err)
+	assert.Equal(t, models.GroupSettling, repo.group.Status)
+
+	assert.NoError(t, svc.RecordPayment(ctx, &models.SettlementPayment{
+		GroupID: repo.group.ID, FromUserID: second.From.ID, ToUserID: second.To.ID, Amount: second.Amount,
+	}))
+	assert.Equal(t, models.GroupArchived, repo.group.Status)
+
+	err = svc.RecordPayment(ctx, &models.SettlementPayment{GroupID: repo.group.ID, FromUserID: bob, ToUserID: alice, Amount: decimal.NewFromInt(1)})
+	assert.Equal(t, apperrors.KindConflict, apperrors.KindOf(err))
+
+	history, err := svc.GroupHistory(ctx, groupID)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, alice, *history[0].ChangedBy)
+		assert.Equal(t, models.GroupArchived, history[1].To)
+		assert.Nil(t, history[1].ChangedBy)
+	}
+}
+
+func TestCloseSettledGroupArchivesIt(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	svc := NewSettlementService(repo, NewFXService(repo))
+
+	closure, err := svc.CloseGroup(context.Background(), repo.group.ID.String(), repo.user("Bob"))
+	assert.NoError(t, err)
+	assert.Equal(t, models.GroupArchived, closure.Group.Status)
+	assert.Empty(t, closure.Plan.Transfers)
+}
+
+func TestCloseGroupThatCantSettleStaysActive(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+	repo.expenses = []models.Expense{paid(alice, bob, 50)}
+	repo.constraints = models.PaymentConstraints{Pairs: []models.PairConstraint{{UserA: alice, UserB: bob, Kind: models.PairForbidden}}}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+
+	_, err := svc.CloseGroup(ctx, repo.group.ID.String(), alice)
+	assert.ErrorIs(t, err, algorithms.ErrNoValidPlan)
+	assert.Equal(t, models.GroupActive, repo.group.Status)
+	assert.Empty(t, repo.plans)
+	history, err := svc.GroupHistory(ctx, repo.group.ID.String())
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+func TestReopenGroupIsLogged(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+	expenses := NewExpenseService(repo, NewFXService(repo))
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	_, err := svc.ReopenGroup(ctx, groupID, alice, "forgot the taxi")
+	assert.Equal(t, apperrors.KindConflict, apperrors.KindOf(err))
+
+	_, err = svc.CloseGroup(ctx, groupID, alice)
+	assert.NoError(t, err)
+
+	var fields FieldErrors
+	_, err = svc.ReopenGroup(ctx, groupID, bob, " ")
+	assert.ErrorAs(t, err, &fields)
+	assert.Equal(t, "reason", fields[0].Field)
+
+	group, err := svc.ReopenGroup(ctx, groupID, bob, "forgot the taxi")
+	assert.NoError(t, err)
+	assert.Equal(t, models.GroupActive, group.Status)
+	assert.NoError(t, expenses.CreateExpense(ctx, dinner(repo, 40, "Bob", "Alice", "Bob"), nil))
+
+	history, err := svc.GroupHistory(ctx, groupID)
+	assert.NoError(t, err)
+	last := history[len(history)-1]
+	assert.Equal(t, models.GroupArchived, last.From)
+	assert.Equal(t, models.GroupActive, last.To)
+	assert.Equal(t, bob, *last.ChangedBy)
+	assert.Equal(t, "forgot the taxi", last.Reason)
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+// Itemized turns the line items and adjustments of an ITEMIZED expense into the
+// final per-person splits. Each item is shared equally by its participants; tax,
+// service charge, tip and discounts are spread in proportion to what each person consumed.
+// If the expense amount is left empty it is set to the receipt total.
+func (sp Splitter) Itemized(expense *models.Expense) error {
+	if len(expense.Items) == 0 {
+		return errors.New("itemized expense must have at least one item")
+	}
+
+	// Participants in order of first appearance, so the splits come out stable
+	var order []uuid.UUID
+	consumed := make(map[uuid.UUID]decimal.Decimal)
+	subtotal := decimal.Zero
+
+	for i := range expense.Items {
+		item := &expense.Items[i]
+		if !item.Amount.IsPositive() {
+			return errors.New("item amount must be positive")
+		}
+		if err := expense.In(item.Amount).Validate(); err != nil {
+			return err
+		}
+		if len(item.Participants) == 0 {
+			return errors.New("item must have at least one participant")
+		}
+
+		seen := make(map[uuid.UUID]bool)
+		for _, uid := range item.Participants {
+			if seen[uid] {
+				return errors.New("duplicate participant found in item")
+			}
+			seen[uid] = true
+		}
+
+		// Move the rotation along per item so one person doesn't take every leftover cent
+		itemSplitter := sp
+		itemSplitter.Context.Sequence += int64(i)
+		amounts := itemSplitter.Equal(expense.In(item.Amount), item.Participants)
+		item.Shares = make([]models.ChargeShare, len(item.Participants))
+		for j, uid := range item.Participants {
+			item.Shares[j] = models.ChargeShare{UserID: uid, Amount: amounts[j]}
+			if _, ok := consumed[uid]; !ok {
+				order = append(order, uid)
+				consumed[uid] = decimal.Zero
+			}
+			consumed[uid] = consumed[uid].Add(amounts[j])
+		}
+		subtotal = subtotal.Add(item.Amount)
+	}
+
+	weights := make([]decimal.Decimal, len(order))
+	for i, uid := range order {
+		weights[i] = consumed[uid]
+	}
+
+	owed := make(map[uuid.UUID]decimal.Decimal, len(order))
+	for uid, amt := range consumed {
+		owed[uid] = amt
+	}
+	total := subtotal
+
+	for i := range expense.Adjustments {
+		adj := &expense.Adjustments[i]
+		if !adj.Amount.IsPositive() {
+			return errors.New("adjustment amount must be positive")
+		}
+		if err := expense.In(adj.Amount).Validate(); err != nil {
+			return err
+		}
+
+		sign := decimal.NewFromInt(1)
+		switch adj.Kind {
+		case models.AdjustmentTax, models.AdjustmentServiceCharge, models.AdjustmentTip:
+		case models.AdjustmentDiscount:
+			sign = sign.Neg()
+		default:
+			return errors.New("unsupported adjustment kind")
+		}
+
+		amounts := sp.allocate(expense.In(adj.Amount), order, weights)
+		adj.Shares = make([]models.ChargeShare, len(order))
+		for j, uid := range order {
+			adj.Shares[j] = models.ChargeShare{UserID: uid, Amount: amounts[j]}
+			owed[uid] = owed[uid].Add(amounts[j].Mul(sign))
+		}
+		total = total.Add(adj.Amount.Mul(sign))
+	}
+
+	if !total.IsPositive() {
+		return errors.New("discounts cannot exceed the receipt total")
+	}
+	if expense.Amount.IsZero() {
+		expense.Amount = total
+	} else if !expense.Amount.Equal(total) {
+		return errors.New("items and adjustments do not add up to the expense amount")
+	}
+
+	expense.Splits = make([]models.ExpenseSplit, len(order))
+	for i, uid := range order {
+		if owed[uid].IsNegative() {
+			return errors.New("discount leaves a participant with a negative share")
+		}
+		expense.Splits[i] = models.ExpenseSplit{UserID: uid, Amount: owed[uid]}
+	}
+
+	return nil
+}
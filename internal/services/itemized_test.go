@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func TestSplitterItemized(t *testing.T) {
+	u1, u2, u3 := uuid.New(), uuid.New(), uuid.New()
+
+	newExpense := func() *models.Expense {
+		return &models.Expense{
+			SplitType: models.SplitItemized,
+			Items: []models.ExpenseItem{
+				{Description: "Pasta", Amount: decimal.NewFromInt(600), Participants: []uuid.UUID{u1}},
+				{Description: "Wine", Amount: decimal.NewFromInt(900), Participants: []uuid.UUID{u1, u2, u3}},
+			},
+			Adjustments: []models.Adjustment{
+				{Kind: models.AdjustmentTax, Amount: decimal.NewFromInt(75)},
+				{Kind: models.AdjustmentTip, Amount: decimal.NewFromInt(150)},
+				{Kind: models.AdjustmentDiscount, Amount: decimal.NewFromInt(100)},
+			},
+		}
+	}
+
+	t.Run("Proportional adjustments", func(t *testing.T) {
+		expense := newExpense()
+		assert.NoError(t, DefaultSplitter().PrepareSplits(expense))
+
+		// Consumed 900/300/300; tax, tip and discount follow the same 3:1:1 ratio
+		assert.True(t, expense.Amount.Equal(decimal.NewFromInt(1625)))
+		assert.Equal(t, 3, len(expense.Splits))
+		assert.Equal(t, u1, expense.Splits[0].UserID)
+		assert.True(t, expense.Splits[0].Amount.Equal(decimal.NewFromInt(975)))
+		assert.True(t, expense.Splits[1].Amount.Equal(decimal.NewFromInt(325)))
+		assert.True(t, expense.Splits[2].Amount.Equal(decimal.NewFromInt(325)))
+		assert.True(t, expense.Adjustments[0].Shares[0].Amount.Equal(decimal.NewFromInt(45)))
+		assert.NoError(t, ValidateSplits(expense))
+	})
+
+	t.Run("Amount must match receipt", func(t *testing.T) {
+		expense := newExpense()
+		expense.Amount = decimal.NewFromInt(1600)
+		assert.EqualError(t, DefaultSplitter().PrepareSplits(expense), "items and adjustments do not add up to the expense amount")
+	})
+
+	t.Run("Rounding stays balanced", func(t *testing.T) {
+		expense := &models.Expense{
+			SplitType: models.SplitItemized,
+			Items: []models.ExpenseItem{
+				{Amount: decimal.NewFromInt(10), Participants: []uuid.UUID{u1, u2, u3}},
+				{Amount: decimal.NewFromFloat(3.5), Participants: []uuid.UUID{u2}},
+			},
+			Adjustments: []models.Adjustment{
+				{Kind: models.AdjustmentServiceCharge, Amount: decimal.NewFromFloat(1.01)},
+			},
+		}
+		assert.NoError(t, DefaultSplitter().PrepareSplits(expense))
+		assert.True(t, expense.Amount.Equal(decimal.NewFromFloat(14.51)))
+		assert.NoError(t, ValidateSplits(expense))
+	})
+
+	t.Run("Item without participants", func(t *testing.T) {
+		expense := newExpense()
+		expense.Items[0].Participants = nil
+		assert.EqualError(t, DefaultSplitter().PrepareSplits(expense), "item must have at least one participant")
+	})
+}
+
+func TestCreateItemizedExpenseWithoutAmount(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+	svc := NewExpenseService(repo, NewFXService(repo))
+
+	// The amount comes from the receipt, and the lone payer covers all of it
+	expense := &models.Expense{
+		GroupID:   repo.group.ID,
+		PayerID:   alice,
+		SplitType: models.SplitItemized,
+		Items: []models.ExpenseItem{
+			{Description: "Pasta", Amount: decimal.NewFromInt(600), Participants: []uuid.UUID{alice}},
+			{Description: "Wine", Amount: decimal.NewFromInt(900), Participants: []uuid.UUID{alice, bob}},
+		},
+	}
+	assert.NoError(t, svc.CreateExpense(context.Background(), expense, nil))
+	assert.True(t, expense.Amount.Equal(decimal.NewFromInt(1500)))
+	if assert.Len(t, expense.Payers, 1) {
+		assert.True(t, expense.Payers[0].Amount.Equal(decimal.NewFromInt(1500)))
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+// RemoveMember takes a user out of a group. actor is the member doing it, which is the
+// user themself when they leave. A member who is owed or owes money can only go if
+// their balance is transferred to another member or written off; either way it is
+// cleared with payments recorded alongside the removal. The member's past expenses
+// and payments are kept and still count towards everyone else's balances.
+func (s *SettlementService) RemoveMember(ctx context.Context, groupID, userID string, actor uuid.UUID, opts models.MemberRemoval) (*models.RemovedMember, error) {
+	gid, err := ParseID("group_id", groupID)
+	if err != nil { return nil, err }
+	uid, err := ParseID("user_id", userID)
+	if err != nil { return nil, err }
+
+	m, err := loadMembership(ctx, s.repo, gid)
+	if err != nil { return nil, err }
+	if errs := m.check(nil, "removed_by", actor); len(errs) > 0 {
+		return nil, invalid(errs)
+	}
+	if err := RequireActive(m.group); err != nil { return nil, err }
+	if !m.members[uid] {
+		return nil, apperrors.NotFound("member_not_found", "user is not a member of this group")
+	}
+	if opts.TransferTo != nil && opts.WriteOff {
+		return nil, invalid(fmt.Errorf("choose either transfer_to or write_off, not both"))
+	}
+	if opts.TransferTo != nil {
+		if *opts.TransferTo == uid {
+			return nil, invalid(FieldErrors{{Field: "transfer_to", Code: CodeInvalidValue, Message: "must be another member"}})
+		}
+		if errs := m.check(nil, "transfer_to", *opts.TransferTo); len(errs) > 0 {
+			return nil, invalid(errs)
+		}
+	}
+
+	// The repository refuses the removal if the ledger changes after this point
+	stamp, err := s.repo.GetLedgerStamp(ctx, groupID)
+	if err != nil { return nil, err }
+	l, err := s.ledger(ctx, groupID, nil, nil)
+	if err != nil { return nil, err }
+	balance := l.balances()[uid]
+
+	var payments []models.SettlementPayment
+	switch {
+	case balance.IsZero():
+	case opts.TransferTo != nil:
+		payments = []models.SettlementPayment{clearingPayment(gid, uid, *opts.TransferTo, balance, models.PaymentBalanceTransfer)}
+	case opts.WriteOff:
+		if payments, err = writeOff(l, m, uid, balance); err != nil { return nil, err }
+	default:
+		exp, _ := models.CurrencyExponent(m.group.BaseCurrency)
+		return nil, apperrors.Conflict("outstanding_balance", fmt.Sprintf(
+			"%s has a balance of %s %s; transfer it to another member or write it off first",
+			l.byID[uid].Username, balance.StringFixed(exp), m.group.BaseCurrency))
+	}
+
+	leftAt, err := s.repo.RemoveMember(ctx, groupID, userID, actor, payments, stamp)
+	if err != nil { return nil, err }
+	if payments == nil {
+		payments = []models.SettlementPayment{}
+	}
+	return &models.RemovedMember{
+		GroupID:  gid,
+		User:     l.byID[uid].Summary(),
+		LeftAt:   leftAt,
+		Balance:  balance,
+		Payments: payments,
+	}, nil
+}
+
+// clearingPayment brings a leaving member's balance to zero by moving it onto other.
+// Someone who is owed money is "paid" by the member taking over their claim; someone
+// who owes it "pays" the member taking over their debt.
+func clearingPayment(groupID, leaving, other uuid.UUID, balance decimal.Decimal, kind models.PaymentKind) models.SettlementPayment {
+	p := models.SettlementPayment{GroupID: groupID, FromUserID: leaving, ToUserID: other, Amount: balance.Neg(), Kind: kind}
+	if balance.IsPositive() {
+		p.FromUserID, p.ToUserID, p.Amount = other, leaving, balance
+	}
+	return p
+}
+
+// writeOff shares a leaving member's balance equally between the members who stay,
+// in username order, using the group's rounding policy for leftover cents.
+func writeOff(l *groupLedger, m *membership, leaving uuid.UUID, balance decimal.Decimal) ([]models.SettlementPayment, error) {
+	var staying []uuid.UUID
+	for _, u := range l.members {
+		if u.ID != leaving && m.members[u.ID] {
+			staying = append(staying, u.ID)
+		}
+	}
+	if len(staying) == 0 {
+		return nil, apperrors.Conflict("no_remaining_members", "there is nobody left in the group to write the balance off against")
+	}
+
+	policy, ok := LookupRoundingPolicy(m.group.RoundingPolicy)
+	if !ok {
+		return nil, fmt.Errorf("group has an unknown rounding policy: %s", m.group.RoundingPolicy)
+	}
+	splitter := Splitter{Policy: policy}
+	shares := splitter.Equal(models.Money{Amount: balance.Abs(), Currency: m.group.BaseCurrency}, staying)
+
+	var payments []models.SettlementPayment
+	for i, id := range staying {
+		if shares[i].IsZero() {
+			continue
+		}
+		share := shares[i]
+		if balance.IsNegative() {
+			share = share.Neg()
+		}
+		payments = append(payments, clearingPayment(m.group.ID, leaving, id, share, models.PaymentWriteOff))
+	}
+	return payments, nil
+}
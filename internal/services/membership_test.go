@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func TestRemoveMemberWithBalance(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob, carol := repo.user("Alice"), repo.user("Bob"), repo.user("Carol")
+	expenses := NewExpenseService(repo, NewFXService(repo))
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	assert.NoError(t, expenses.CreateExpense(ctx, dinner(repo, 90, "Alice", "Alice", "Bob", "Carol"), nil))
+
+	// Bob owes 30, so he can't just leave
+	_, err := svc.RemoveMember(ctx, groupID, bob.String(), bob, models.MemberRemoval{})
+	e, ok := apperrors.As(err)
+	if assert.True(t, ok) {
+		assert.Equal(t, "outstanding_balance", e.Code)
+	}
+
+	// Carol takes his debt over
+	removed, err := svc.RemoveMember(ctx, groupID, bob.String(), alice, models.MemberRemoval{TransferTo: &carol})
+	assert.NoError(t, err)
+	assert.True(t, decimal.NewFromInt(-30).Equal(removed.Balance))
+	assert.Len(t, removed.Payments, 1)
+	assert.Equal(t, models.PaymentBalanceTransfer, removed.Payments[0].Kind)
+
+	balances, err := svc.CalculateBalances(ctx, groupID, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, decimal.NewFromInt(60).Equal(balances[alice]))
+	assert.True(t, balances[bob].IsZero())
+	assert.True(t, decimal.NewFromInt(-60).Equal(balances[carol]))
+
+	// Bob stays on the old dinner but can't be put on new expenses
+	var fields FieldErrors
+	err = expenses.CreateExpense(ctx, &models.Expense{
+		GroupID: repo.group.ID, PayerID: alice, Amount: decimal.NewFromInt(10), SplitType: models.SplitEqual,
+		Splits: []models.ExpenseSplit{{UserID: alice}, {UserID: bob}},
+	}, nil)
+	assert.ErrorAs(t, err, &fields)
+	assert.Equal(t, "splits[1].user_id", fields[0].Field)
+
+	_, err = svc.RemoveMember(ctx, groupID, bob.String(), alice, models.MemberRemoval{})
+	assert.True(t, apperrors.IsNotFound(err))
+}
+
+func TestLeaveGroupWritingOffBalance(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob, carol := repo.user("Alice"), repo.user("Bob"), repo.user("Carol")
+	expenses := NewExpenseService(repo, NewFXService(repo))
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	assert.NoError(t, expenses.CreateExpense(ctx, dinner(repo, 90, "Alice", "Alice", "Bob", "Carol"), nil))
+
+	// Bob leaves and the others absorb his 30, 15 each
+	removed, err := svc.RemoveMember(ctx, groupID, bob.String(), bob, models.MemberRemoval{WriteOff: true})
+	assert.NoError(t, err)
+	assert.Len(t, removed.Payments, 2)
+	for _, p := range removed.Payments {
+		assert.Equal(t, models.PaymentWriteOff, p.Kind)
+		assert.Equal(t, bob, p.FromUserID)
+		assert.True(t, decimal.NewFromInt(15).Equal(p.Amount))
+	}
+
+	balances, err := svc.GroupBalances(ctx, groupID, nil, nil)
+	assert.NoError(t, err)
+	got := make(map[string]string)
+	for _, b := range balances.Balances {
+		got[b.User.Username] = b.Balance.String()
+	}
+	assert.Equal(t, map[string]string{"Alice": "45", "Bob": "0", "Carol": "-45"}, got)
+
+	settlement, err := svc.GetSettlement(ctx, groupID, nil, nil, "", "")
+	assert.NoError(t, err)
+	if assert.Len(t, settlement.Transactions, 1) {
+		tx := settlement.Transactions[0]
+		assert.Equal(t, carol, tx.From.ID)
+		assert.Equal(t, alice, tx.To.ID)
+		assert.True(t, decimal.NewFromInt(45).Equal(tx.Amount))
+	}
+}
+
+func TestLeaveGroupWithoutBalance(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	bob := repo.user("Bob")
+	svc := NewSettlementService(repo, NewFXService(repo))
+
+	removed, err := svc.RemoveMember(context.Background(), repo.group.ID.String(), bob.String(), bob, models.MemberRemoval{WriteOff: true})
+	assert.NoError(t, err)
+	assert.Empty(t, removed.Payments)
+	assert.Len(t, repo.members, 1)
+	assert.Equal(t, bob, *repo.former[0].RemovedBy)
+}
+
+func TestLeaveGroupWhileExpenseLands(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+	svc := NewSettlementService(repo, NewFXService(repo))
+
+	// Bob's balance is zero when it is checked, but an expense lands before he is removed
+	repo.beforeRemove = func() { repo.expenses = append(repo.expenses, paid(alice, bob, 40)) }
+	_, err := svc.RemoveMember(context.Background(), repo.group.ID.String(), bob.String(), bob, models.MemberRemoval{})
+	assert.Equal(t, "balance_changed", codeOf(err))
+	assert.Len(t, repo.members, 2)
+	assert.Empty(t, repo.payments)
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+	"github.com/user/debt-optimization-engine/internal/repositories"
+)
+
+// Action is something done in a group that needs a minimum role. Its value reads as
+// the end of "viewers can't ...".
+type Action string
+
+const (
+	ActionView           Action = "view the group"
+	ActionAddExpense     Action = "add expenses"
+	ActionSettleUp       Action = "record payments or settlement plans"
+	ActionEditAnyExpense Action = "change other members' expenses"
+	ActionManageMembers  Action = "add or remove members"
+	ActionManageGroup    Action = "change the group's settings"
+)
+
+// requiredRoles is the lowest role allowed to take each action.
+var requiredRoles = map[Action]models.Role{
+	ActionView:           models.RoleViewer,
+	ActionAddExpense:     models.RoleMember,
+	ActionSettleUp:       models.RoleMember,
+	ActionEditAnyExpense: models.RoleAdmin,
+	ActionManageMembers:  models.RoleAdmin,
+	ActionManageGroup:    models.RoleAdmin,
+}
+
+var errNotGroupMember = apperrors.Forbidden("not_group_member", "you are not a member of this group")
+
+var errNoSharedGroup = apperrors.Forbidden("permission_denied", "you don't share a group with this user")
+
+// PermissionService decides what each member may do in a group, based on their role.
+type PermissionService struct {
+	repo repositories.Repository
+}
+
+func NewPermissionService(repo repositories.Repository) *PermissionService {
+	return &PermissionService{repo: repo}
+}
+
+// Authorize checks that userID is a current member of the group whose role allows
+// action, and returns their membership. A group that doesn't exist is reported as
+// missing before anything else.
+func (p *PermissionService) Authorize(ctx context.Context, groupID string, userID uuid.UUID, action Action) (*models.Member, error) {
+	if _, err := ParseID("group_id", groupID); err != nil {
+		return nil, err
+	}
+	if _, err := p.repo.GetGroup(ctx, groupID); err != nil {
+		return nil, err
+	}
+	m, err := p.repo.GetMember(ctx, groupID, userID.String())
+	if apperrors.IsNotFound(err) {
+		return nil, errNotGroupMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !m.Role.AtLeast(requiredRoles[action]) {
+		return nil, apperrors.Forbidden("permission_denied", fmt.Sprintf("%ss can't %s", strings.ToLower(string(m.Role)), action))
+	}
+	return m, nil
+}
+
+// JoiningRole is the role a new member gets: MEMBER unless another is asked for.
+// Nobody joins as the owner.
+func JoiningRole(role models.Role) (models.Role, error) {
+	if role == "" {
+		return models.RoleMember, nil
+	}
+	if !role.Valid() || role == models.RoleOwner {
+		return "", invalid(FieldErrors{{Field: "role", Code: CodeInvalidValue, Message: "must be ADMIN, MEMBER or VIEWER"}})
+	}
+	return role, nil
+}
+
+// AuthorizeExpenseEdit checks that userID may change, delete or restore an expense:
+// members may change the expenses they added, admins any expense. Expenses whose
+// creator was never recorded can only be changed by admins.
+func (p *PermissionService) AuthorizeExpenseEdit(ctx context.Context, groupID, expenseID string, userID uuid.UUID) error {
+	m, err := p.Authorize(ctx, groupID, userID, ActionAddExpense)
+	if err != nil {
+		return err
+	}
+	if m.Role.AtLeast(requiredRoles[ActionEditAnyExpense]) {
+		return nil
+	}
+	if _, err := ParseID("expense_id", expenseID); err != nil {
+		return err
+	}
+	expense, err := p.repo.GetExpense(ctx, expenseID)
+	if err != nil {
+		return err
+	}
+	if expense.GroupID.String() != groupID {
+		return errExpenseNotFound
+	}
+	if expense.CreatedBy == nil || *expense.CreatedBy != userID {
+		return apperrors.Forbidden("not_expense_creator", "only the member who added this expense or an admin can change it")
+	}
+	return nil
+}
+
+// AuthorizeRemoval checks that actor may take target out of the group. Anyone may
+// leave; removing someone else is for admins. The owner can do neither until they
+// have handed ownership to another member.
+func (p *PermissionService) AuthorizeRemoval(ctx context.Context, groupID string, actor, target uuid.UUID) error {
+	action := ActionManageMembers
+	if actor == target {
+		action = ActionView
+	}
+	if _, err := p.Authorize(ctx, groupID, actor, action); err != nil {
+		return err
+	}
+	m, err := p.repo.GetMember(ctx, groupID, target.String())
+	if err != nil {
+		return err
+	}
+	if m.Role != models.RoleOwner {
+		return nil
+	}
+	if actor == target {
+		return apperrors.Conflict("owner_cannot_leave", "hand ownership to another member before leaving the group")
+	}
+	return apperrors.Forbidden("permission_denied", "the group's owner can't be removed")
+}
+
+// SetRole changes a member's role. Admins may make other members admins, members or
+// viewers; only the owner can make someone else the owner, which makes themself an
+// admin.
+func (p *PermissionService) SetRole(ctx context.Context, groupID, userID string, actor uuid.UUID, role models.Role) (*models.Member, error) {
+	if !role.Valid() {
+		return nil, invalid(FieldErrors{{Field: "role", Code: CodeInvalidValue, Message: fmt.Sprintf("unknown role %q", role)}})
+	}
+	if _, err := ParseID("user_id", userID); err != nil {
+		return nil, err
+	}
+	a, err := p.Authorize(ctx, groupID, actor, ActionManageMembers)
+	if err != nil {
+		return nil, err
+	}
+	m, err := p.repo.GetMember(ctx, groupID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if role == models.RoleOwner && a.Role != models.RoleOwner {
+		return nil, apperrors.Forbidden("permission_denied", "only the owner can hand ownership to another member")
+	}
+	if m.Role == models.RoleOwner {
+		return nil, apperrors.Conflict("owner_role", "the owner keeps their role until they hand ownership to another member")
+	}
+	if err := p.repo.SetMemberRole(ctx, groupID, userID, role); err != nil {
+		return nil, err
+	}
+	m.Role = role
+	return m, nil
+}
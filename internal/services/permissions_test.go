@@ -0,0 +1,107 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func codeOf(err error) string {
+	if e, ok := apperrors.As(err); ok {
+		return e.Code
+	}
+	return ""
+}
+
+func TestAuthorizeByRole(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob, carol := repo.user("Alice"), repo.user("Bob"), repo.user("Carol")
+	repo.roles = map[uuid.UUID]models.Role{alice: models.RoleOwner, carol: models.RoleViewer}
+	perms := NewPermissionService(repo)
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	_, err := perms.Authorize(ctx, groupID, bob, ActionAddExpense)
+	assert.NoError(t, err)
+	_, err = perms.Authorize(ctx, groupID, bob, ActionManageMembers)
+	assert.Equal(t, apperrors.KindForbidden, apperrors.KindOf(err))
+	assert.Equal(t, "members can't add or remove members", err.Error())
+
+	_, err = perms.Authorize(ctx, groupID, carol, ActionView)
+	assert.NoError(t, err)
+	_, err = perms.Authorize(ctx, groupID, carol, ActionSettleUp)
+	assert.Equal(t, "permission_denied", codeOf(err))
+
+	_, err = perms.Authorize(ctx, groupID, alice, ActionManageGroup)
+	assert.NoError(t, err)
+	_, err = perms.Authorize(ctx, groupID, uuid.New(), ActionView)
+	assert.Equal(t, "not_group_member", codeOf(err))
+	_, err = perms.Authorize(ctx, uuid.NewString(), alice, ActionView)
+	assert.True(t, apperrors.IsNotFound(err))
+}
+
+func TestOnlyCreatorOrAdminEditsExpense(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob, carol := repo.user("Alice"), repo.user("Bob"), repo.user("Carol")
+	repo.roles = map[uuid.UUID]models.Role{alice: models.RoleAdmin}
+	expenses := NewExpenseService(repo, NewFXService(repo))
+	perms := NewPermissionService(repo)
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	// Carol paid, but Bob added it
+	expense := dinner(repo, 90, "Carol", "Alice", "Bob", "Carol")
+	assert.NoError(t, expenses.CreateExpense(ctx, expense, &bob))
+	assert.Equal(t, bob, *expense.CreatedBy)
+	expenseID := expense.ID.String()
+
+	assert.NoError(t, perms.AuthorizeExpenseEdit(ctx, groupID, expenseID, bob))
+	assert.NoError(t, perms.AuthorizeExpenseEdit(ctx, groupID, expenseID, alice))
+	assert.Equal(t, "not_expense_creator", codeOf(perms.AuthorizeExpenseEdit(ctx, groupID, expenseID, carol)))
+
+	// Editing keeps who added it
+	updated, err := expenses.UpdateExpense(ctx, groupID, expenseID, alice, dinner(repo, 60, "Carol", "Alice", "Bob", "Carol"))
+	assert.NoError(t, err)
+	assert.Equal(t, bob, *updated.CreatedBy)
+
+	// Demoted to viewer, Bob can't touch it any more
+	_, err = perms.SetRole(ctx, groupID, bob.String(), alice, models.RoleViewer)
+	assert.NoError(t, err)
+	assert.Equal(t, "permission_denied", codeOf(perms.AuthorizeExpenseEdit(ctx, groupID, expenseID, bob)))
+}
+
+func TestOwnershipAndRemoval(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob, carol := repo.user("Alice"), repo.user("Bob"), repo.user("Carol")
+	repo.roles = map[uuid.UUID]models.Role{alice: models.RoleOwner, bob: models.RoleAdmin}
+	perms := NewPermissionService(repo)
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	assert.NoError(t, perms.AuthorizeRemoval(ctx, groupID, carol, carol))
+	assert.Equal(t, "permission_denied", codeOf(perms.AuthorizeRemoval(ctx, groupID, carol, bob)))
+	assert.NoError(t, perms.AuthorizeRemoval(ctx, groupID, bob, carol))
+	assert.Equal(t, apperrors.KindForbidden, apperrors.KindOf(perms.AuthorizeRemoval(ctx, groupID, bob, alice)))
+	assert.Equal(t, "owner_cannot_leave", codeOf(perms.AuthorizeRemoval(ctx, groupID, alice, alice)))
+
+	// Only the owner hands ownership on, and becomes an admin
+	_, err := perms.SetRole(ctx, groupID, carol.String(), bob, models.RoleOwner)
+	assert.Equal(t, apperrors.KindForbidden, apperrors.KindOf(err))
+	_, err = perms.SetRole(ctx, groupID, alice.String(), bob, models.RoleMember)
+	assert.Equal(t, "owner_role", codeOf(err))
+
+	m, err := perms.SetRole(ctx, groupID, carol.String(), alice, models.RoleOwner)
+	assert.NoError(t, err)
+	assert.Equal(t, models.RoleOwner, m.Role)
+	assert.Equal(t, models.RoleAdmin, repo.role(alice))
+	assert.NoError(t, perms.AuthorizeRemoval(ctx, groupID, alice, alice))
+
+	var fields FieldErrors
+	_, err = perms.SetRole(ctx, groupID, bob.String(), carol, "SUPERUSER")
+	assert.ErrorAs(t, err, &fields)
+	assert.Equal(t, "role", fields[0].Field)
+}
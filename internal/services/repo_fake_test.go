@@ -0,0 +1,631 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+	"github.com/user/debt-optimization-engine/internal/repositories"
+)
+
+// fakeRepo is an in-memory stand-in for the Postgres repository. Methods the tests
+// don't need fall through to the embedded nil interface and panic if called.
+type fakeRepo struct {
+	repositories.Repository
+	group     models.Group
+	members   []models.User
+	former    []models.Member
+	roles     map[uuid.UUID]models.Role // Members not listed are MEMBERs
+	expenses  []models.Expense
+	revisions []models.ExpenseRevision
+	payments  []models.SettlementPayment
+	statuses  []models.GroupStatusChange
+
+	constraints models.PaymentConstraints
+	methods     []models.PaymentMethod
+	plans       []models.SettlementPlan
+	rates       []models.FXRate
+
+	passwords   map[uuid.UUID]string
+	loginCodes  []models.LoginCode
+	codesUsed   map[uuid.UUID]bool
+	tokens      []models.APIToken
+	tokenHashes map[string]uuid.UUID
+
+	beforeRemove func() // Runs when RemoveMember starts, to simulate a concurrent write
+}
+
+func newFakeRepo(usernames ...string) *fakeRepo {
+	r := &fakeRepo{group: models.Group{ID: uuid.New(), Name: "Trip", BaseCurrency: "INR", RoundingPolicy: DefaultRoundingPolicy, Status: models.GroupActive}}
+	for _, name := range usernames {
+		r.members = append(r.members, models.User{ID: uuid.New(), Username: name})
+	}
+	return r
+}
+
+func (r *fakeRepo) user(name string) uuid.UUID {
+	for _, m := range r.members {
+		if m.Username == name {
+			return m.ID
+		}
+	}
+	panic("unknown user " + name)
+}
+
+func (r *fakeRepo) GetGroup(ctx context.Context, groupID string) (*models.Group, error) {
+	if groupID != r.group.ID.String() {
+		return nil, apperrors.NotFound("group_not_found", "group does not exist")
+	}
+	g := r.group
+	return &g, nil
+}
+
+func (r *fakeRepo) CloseGroup(ctx context.Context, group *models.Group, plan *models.SettlementPlan, closedBy uuid.UUID) error {
+	if r.group.Status != group.Status {
+		return apperrors.Conflict("group_status_changed", "the group's status was changed at the same time")
+	}
+	if err := r.CreateSettlementPlan(ctx, plan); err != nil {
+		return err
+	}
+	return r.SetGroupStatus(ctx, group, models.GroupSettling, &closedBy, "closed")
+}
+
+func (r *fakeRepo) SetGroupStatus(ctx context.Context, group *models.Group, to models.GroupStatus, changedBy *uuid.UUID, reason string) error {
+	if r.group.Status != group.Status {
+		return apperrors.Conflict("group_status_changed", "the group's status was changed at the same time")
+	}
+	r.statuses = append(r.statuses, models.GroupStatusChange{
+		ID: uuid.New(), GroupID: r.group.ID, From: group.Status, To: to, ChangedBy: changedBy, Reason: reason, ChangedAt: time.Now(),
+	})
+	r.group.Status = to
+	group.Status = to
+	return nil
+}
+
+func (r *fakeRepo) GetGroupStatusChanges(ctx context.Context, groupID string) ([]models.GroupStatusChange, error) {
+	return r.statuses, nil
+}
+
+func (r *fakeRepo) GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error) {
+	return r.members, nil
+}
+
+func (r *fakeRepo) GetMemberships(ctx context.Context, groupID string, includeFormer bool) ([]models.Member, error) {
+	var out []models.Member
+	if includeFormer {
+		out = append(out, r.former...)
+	}
+	for _, u := range r.members {
+		out = append(out, models.Member{User: u, Role: r.role(u.ID)})
+	}
+	return out, nil
+}
+
+func (r *fakeRepo) role(id uuid.UUID) models.Role {
+	if role, ok := r.roles[id]; ok {
+		return role
+	}
+	return models.RoleMember
+}
+
+func (r *fakeRepo) GetMember(ctx context.Context, groupID, userID string) (*models.Member, error) {
+	for _, u := range r.members {
+		if u.ID.String() == userID {
+			return &models.Member{User: u, Role: r.role(u.ID)}, nil
+		}
+	}
+	return nil, apperrors.NotFound("member_not_found", "user is not a member of this group")
+}
+
+func (r *fakeRepo) SetMemberRole(ctx context.Context, groupID, userID string, role models.Role) error {
+	m, err := r.GetMember(ctx, groupID, userID)
+	if err != nil {
+		return err
+	}
+	if r.roles == nil {
+		r.roles = make(map[uuid.UUID]models.Role)
+	}
+	if role == models.RoleOwner {
+		for id, current := range r.roles {
+			if current == models.RoleOwner {
+				r.roles[id] = models.RoleAdmin
+			}
+		}
+	}
+	r.roles[m.ID] = role
+	return nil
+}
+
+// GetLedgerStamp is the number of expenses and payments, plus the expenses' versions.
+func (r *fakeRepo) GetLedgerStamp(ctx context.Context, groupID string) (string, error) {
+	versions := 0
+	for _, e := range r.expenses {
+		versions += e.Version
+	}
+	return fmt.Sprintf("%d.%d/%d", len(r.expenses), versions, len(r.payments)), nil
+}
+
+func (r *fakeRepo) RemoveMember(ctx context.Context, groupID, userID string, removedBy uuid.UUID, payments []models.SettlementPayment, ledgerStamp string) (time.Time, error) {
+	if r.beforeRemove != nil {
+		r.beforeRemove()
+	}
+	if stamp, _ := r.GetLedgerStamp(ctx, groupID); stamp != ledgerStamp {
+		return time.Time{}, apperrors.Conflict("balance_changed", "an expense or payment was added or changed at the same time")
+	}
+	for i, u := range r.members {
+		if u.ID.String() != userID {
+			continue
+		}
+		for j := range payments {
+			r.CreateSettlementPayment(ctx, &payments[j])
+		}
+		now := time.Now()
+		r.former = append(r.former, models.Member{User: u, LeftAt: &now, RemovedBy: &removedBy})
+		r.members = append(r.members[:i:i], r.members[i+1:]...)
+		return now, nil
+	}
+	return time.Time{}, apperrors.NotFound("member_not_found", "user is not a member of this group")
+}
+
+func (r *fakeRepo) GetExpensesByGroup(ctx context.Context, groupID string, from, to *time.Time) ([]models.Expense, error) {
+	var out []models.Expense
+	for _, e := range r.expenses {
+		if e.DeletedAt == nil {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// ListExpenses only applies the filter's order, cursor and limit.
+func (r *fakeRepo) ListExpenses(ctx context.Context, groupID string, filter models.ExpenseFilter) ([]models.Expense, error) {
+	before := func(a, b models.Expense) bool {
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt) == filter.Ascending
+		}
+		if a.ID == b.ID {
+			return false
+		}
+		return (a.ID.String() < b.ID.String()) == filter.Ascending
+	}
+	sorted := append([]models.Expense{}, r.expenses...)
+	sort.SliceStable(sorted, func(i, j int) bool { return before(sorted[i], sorted[j]) })
+
+	out := []models.Expense{}
+	for _, e := range sorted {
+		if filter.After != nil && !before(models.Expense{CreatedAt: filter.After.CreatedAt, ID: filter.After.ID}, e) {
+			continue
+		}
+		if filter.From != nil && e.CreatedAt.Before(*filter.From) || filter.Before != nil && !e.CreatedAt.Before(*filter.Before) {
+			continue
+		}
+		if len(out) == filter.Limit {
+			break
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (r *fakeRepo) GetSettlementPaymentsByGroup(ctx context.Context, groupID string, from, to *time.Time) ([]models.SettlementPayment, error) {
+	return r.payments, nil
+}
+
+func (r *fakeRepo) CountExpensesByGroup(ctx context.Context, groupID string) (int64, error) {
+	return int64(len(r.expenses)), nil
+}
+
+func (r *fakeRepo) CreateExpense(ctx context.Context, expense *models.Expense, revision *models.ExpenseRevision) error {
+	expense.CreatedAt = time.Now()
+	expense.UpdatedAt = expense.CreatedAt
+	if expense.Version == 0 {
+		expense.Version = 1
+	}
+	r.expenses = append(r.expenses, *expense)
+	if revision != nil {
+		revision.ExpenseID = expense.ID
+		revision.Expense = *expense
+		r.addRevisions(*revision)
+	}
+	return nil
+}
+
+func (r *fakeRepo) GetExpense(ctx context.Context, expenseID string) (*models.Expense, error) {
+	for _, e := range r.expenses {
+		if e.ID.String() == expenseID {
+			return &e, nil
+		}
+	}
+	return nil, apperrors.NotFound("expense_not_found", "expense does not exist")
+}
+
+func (r *fakeRepo) UpdateExpense(ctx context.Context, expense *models.Expense, revisions []models.ExpenseRevision) error {
+	for i := range r.expenses {
+		if r.expenses[i].ID != expense.ID {
+			continue
+		}
+		if r.expenses[i].Version != expense.Version-1 {
+			return apperrors.Conflict("expense_changed", "the expense was changed at the same time")
+		}
+		expense.UpdatedAt = time.Now()
+		r.expenses[i] = *expense
+		for j := range revisions {
+			if revisions[j].Version == expense.Version {
+				revisions[j].Expense = *expense
+			}
+		}
+		r.addRevisions(revisions...)
+		return nil
+	}
+	return apperrors.NotFound("expense_not_found", "expense does not exist")
+}
+
+func (r *fakeRepo) addRevisions(revisions ...models.ExpenseRevision) {
+	for _, rev := range revisions {
+		rev.ID = uuid.New()
+		rev.ChangedAt = time.Now()
+		r.revisions = append(r.revisions, rev)
+	}
+}
+
+func (r *fakeRepo) GetExpenseRevisions(ctx context.Context, expenseID string) ([]models.ExpenseRevision, error) {
+	var out []models.ExpenseRevision
+	for _, rev := range r.revisions {
+		if rev.ExpenseID.String() == expenseID {
+			out = append(out, rev)
+		}
+	}
+	return out, nil
+}
+
+func (r *fakeRepo) CreateSettlementPayment(ctx context.Context, payment *models.SettlementPayment) error {
+	payment.ID = uuid.New()
+	payment.CreatedAt = time.Now()
+	r.payments = append(r.payments, *payment)
+	return nil
+}
+
+func (r *fakeRepo) GetPaymentConstraints(ctx context.Context, groupID string) (*models.PaymentConstraints, error) {
+	c := r.constraints
+	return &c, nil
+}
+
+func (r *fakeRepo) ReplacePaymentConstraints(ctx context.Context, groupID string, constraints *models.PaymentConstraints) error {
+	r.constraints = *constraints
+	return nil
+}
+
+func (r *fakeRepo) GetPaymentMethodsByUser(ctx context.Context, userID string) ([]models.PaymentMethod, error) {
+	var out []models.PaymentMethod
+	for _, m := range r.methods {
+		if m.UserID.String() == userID {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+// GetGroupsByUser treats every member as being in just this group.
+func (r *fakeRepo) GetGroupsByUser(ctx context.Context, userID string, includeArchived bool) ([]models.Group, error) {
+	for _, m := range r.members {
+		if m.ID.String() == userID {
+			return []models.Group{r.group}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *fakeRepo) FindFXRate(ctx context.Context, base, quote string, on time.Time) (*models.FXRate, error) {
+	for i := range r.rates {
+		if r.rates[i].Base == base && r.rates[i].Quote == quote {
+			return &r.rates[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *fakeRepo) GetPaymentMethodsByGroup(ctx context.Context, groupID string) ([]models.PaymentMethod, error) {
+	return r.methods, nil
+}
+
+func (r *fakeRepo) ReplacePaymentMethods(ctx context.Context, userID string, methods []models.PaymentMethod) error {
+	var kept []models.PaymentMethod
+	for _, m := range r.methods {
+		if m.UserID.String() != userID {
+			kept = append(kept, m)
+		}
+	}
+	for _, m := range methods {
+		m.ID = uuid.New()
+		kept = append(kept, m)
+	}
+	r.methods = kept
+	return nil
+}
+
+func (r *fakeRepo) CreateSettlementPlan(ctx context.Context, plan *models.SettlementPlan) error {
+	for i := range r.plans {
+		r.plans[i].Status = models.PlanSuperseded
+	}
+	plan.ID = uuid.New()
+	plan.CreatedAt = time.Now()
+	plan.UpdatedAt = plan.CreatedAt
+	return r.SaveSettlementPlan(ctx, plan)
+}
+
+func (r *fakeRepo) GetSettlementPlan(ctx context.Context, planID string) (*models.SettlementPlan, error) {
+	for _, p := range r.plans {
+		if p.ID.String() == planID {
+			return clonePlan(p), nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *fakeRepo) GetCurrentSettlementPlan(ctx context.Context, groupID string) (*models.SettlementPlan, error) {
+	for _, p := range r.plans {
+		if p.Status != models.PlanSuperseded {
+			return clonePlan(p), nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *fakeRepo) SaveSettlementPlan(ctx context.Context, plan *models.SettlementPlan) error {
+	for i := range plan.Transfers {
+		plan.Transfers[i].PlanID = plan.ID
+		plan.Transfers[i].Position = i
+	}
+	for i := range r.plans {
+		if r.plans[i].ID == plan.ID {
+			if r.plans[i].Version != plan.Version-1 {
+				return apperrors.Conflict("settlement_plan_changed", "the settlement plan was changed at the same time")
+			}
+			r.plans[i] = *clonePlan(*plan)
+			return nil
+		}
+	}
+	r.plans = append(r.plans, *clonePlan(*plan))
+	return nil
+}
+
+func (r *fakeRepo) UpdatePlanTransfer(ctx context.Context, plan *models.SettlementPlan, transfer *models.PlanTransfer, payment *models.SettlementPayment) error {
+	if err := r.SaveSettlementPlan(ctx, plan); err != nil {
+		return err
+	}
+	if payment != nil {
+		r.CreateSettlementPayment(ctx, payment)
+	}
+	return nil
+}
+
+// clonePlan copies a plan so the service can't change what the fake has stored.
+func clonePlan(p models.SettlementPlan) *models.SettlementPlan {
+	p.Transfers = append([]models.PlanTransfer{}, p.Transfers...)
+	return &p
+}
+
+// fakeRepos spreads group queries over one fakeRepo per group, for tests that cross
+// groups. Members are shared by giving each group the same users.
+type fakeRepos struct {
+	repositories.Repository
+	groups []*fakeRepo
+}
+
+func (r *fakeRepos) group(groupID string) *fakeRepo {
+	for _, g := range r.groups {
+		if g.group.ID.String() == groupID {
+			return g
+		}
+	}
+	panic("unknown group " + groupID)
+}
+
+func (r *fakeRepos) GetGroupsByUser(ctx context.Context, userID string, includeArchived bool) ([]models.Group, error) {
+	var out []models.Group
+	for _, g := range r.groups {
+		if g.group.Status == models.GroupArchived && !includeArchived {
+			continue
+		}
+		for _, m := range g.members {
+			if m.ID.String() == userID {
+				out = append(out, g.group)
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+func (r *fakeRepos) GetGroup(ctx context.Context, groupID string) (*models.Group, error) {
+	return r.group(groupID).GetGroup(ctx, groupID)
+}
+
+func (r *fakeRepos) GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error) {
+	return r.group(groupID).GetGroupMembers(ctx, groupID)
+}
+
+func (r *fakeRepos) GetMemberships(ctx context.Context, groupID string, includeFormer bool) ([]models.Member, error) {
+	return r.group(groupID).GetMemberships(ctx, groupID, includeFormer)
+}
+
+func (r *fakeRepos) GetExpensesByGroup(ctx context.Context, groupID string, from, to *time.Time) ([]models.Expense, error) {
+	return r.group(groupID).GetExpensesByGroup(ctx, groupID, from, to)
+}
+
+func (r *fakeRepos) GetSettlementPaymentsByGroup(ctx context.Context, groupID string, from, to *time.Time) ([]models.SettlementPayment, error) {
+	return r.group(groupID).GetSettlementPaymentsByGroup(ctx, groupID, from, to)
+}
+
+func (r *fakeRepos) GetPaymentConstraints(ctx context.Context, groupID string) (*models.PaymentConstraints, error) {
+	return r.group(groupID).GetPaymentConstraints(ctx, groupID)
+}
+
+func (r *fakeRepos) GetPaymentMethodsByGroup(ctx context.Context, groupID string) ([]models.PaymentMethod, error) {
+	return r.group(groupID).GetPaymentMethodsByGroup(ctx, groupID)
+}
+
+func (r *fakeRepos) CreateSettlementPayments(ctx context.Context, payments []models.SettlementPayment) error {
+	for i := range payments {
+		p := &payments[i]
+		if err := r.group(p.GroupID.String()).CreateSettlementPayment(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateUser, GetUser, GetUserByLogin and the login code and API token methods treat the group's
+// members as every user there is.
+func (r *fakeRepo) CreateUser(ctx context.Context, user *models.User, passwordHash string) error {
+	for _, u := range r.members {
+		if strings.EqualFold(u.Username, user.Username) {
+			return apperrors.Conflict("username_taken", "username is already taken")
+		}
+	}
+	user.ID = uuid.New()
+	r.members = append(r.members, *user)
+	if passwordHash != "" {
+		return r.SetPasswordHash(ctx, user.ID.String(), passwordHash)
+	}
+	return nil
+}
+
+func (r *fakeRepo) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	for _, u := range r.members {
+		if u.ID.String() == userID {
+			return &u, nil
+		}
+	}
+	return nil, apperrors.NotFound("user_not_found", "user does not exist")
+}
+
+func (r *fakeRepo) GetUserByLogin(ctx context.Context, login string) (*models.User, string, error) {
+	byEmail := strings.Contains(login, "@")
+	for _, u := range r.members {
+		if (!byEmail && strings.EqualFold(u.Username, login)) || (byEmail && strings.EqualFold(u.Email, login)) {
+			return &u, r.passwords[u.ID], nil
+		}
+	}
+	return nil, "", apperrors.NotFound("user_not_found", "user does not exist")
+}
+
+func (r *fakeRepo) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	for _, u := range r.members {
+		if strings.EqualFold(u.Email, email) {
+			return &u, nil
+		}
+	}
+	return nil, apperrors.NotFound("user_not_found", "user does not exist")
+}
+
+func (r *fakeRepo) SetPasswordHash(ctx context.Context, userID, hash string) error {
+	u, err := r.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if r.passwords == nil {
+		r.passwords = make(map[uuid.UUID]string)
+	}
+	r.passwords[u.ID] = hash
+	return nil
+}
+
+func (r *fakeRepo) CreateLoginCode(ctx context.Context, code *models.LoginCode) error {
+	code.ID = uuid.New()
+	code.CreatedAt = time.Now()
+	r.loginCodes = append(r.loginCodes, *code)
+	return nil
+}
+
+func (r *fakeRepo) GetLatestLoginCode(ctx context.Context, userID string) (*models.LoginCode, error) {
+	for i := len(r.loginCodes) - 1; i >= 0; i-- {
+		c := r.loginCodes[i]
+		if c.UserID.String() != userID {
+			continue
+		}
+		if r.codesUsed[c.ID] || !time.Now().Before(c.ExpiresAt) {
+			return nil, nil
+		}
+		return &c, nil
+	}
+	return nil, nil
+}
+
+func (r *fakeRepo) CountLoginCodes(ctx context.Context, userID string, since time.Time) (int, error) {
+	n := 0
+	for _, c := range r.loginCodes {
+		if c.UserID.String() == userID && !c.CreatedAt.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *fakeRepo) AddLoginCodeAttempt(ctx context.Context, codeID string, max int) (bool, error) {
+	for i := range r.loginCodes {
+		if r.loginCodes[i].ID.String() == codeID && r.loginCodes[i].Attempts < max {
+			r.loginCodes[i].Attempts++
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeRepo) UseLoginCode(ctx context.Context, codeID string) error {
+	id := uuid.MustParse(codeID)
+	if r.codesUsed[id] {
+		return apperrors.Unauthenticated("invalid_login_code", "the login code is wrong or has expired")
+	}
+	if r.codesUsed == nil {
+		r.codesUsed = make(map[uuid.UUID]bool)
+	}
+	r.codesUsed[id] = true
+	return nil
+}
+
+func (r *fakeRepo) CreateAPIToken(ctx context.Context, token *models.APIToken, hash string) error {
+	token.ID = uuid.New()
+	token.CreatedAt = time.Now()
+	r.tokens = append(r.tokens, *token)
+	if r.tokenHashes == nil {
+		r.tokenHashes = make(map[string]uuid.UUID)
+	}
+	r.tokenHashes[hash] = token.ID
+	return nil
+}
+
+func (r *fakeRepo) GetAPITokenByHash(ctx context.Context, hash string) (*models.APIToken, error) {
+	for _, t := range r.tokens {
+		if t.ID == r.tokenHashes[hash] {
+			return &t, nil
+		}
+	}
+	return nil, apperrors.NotFound("api_token_not_found", "API token does not exist")
+}
+
+func (r *fakeRepo) RevokeAPIToken(ctx context.Context, userID, tokenID string) error {
+	for i, t := range r.tokens {
+		if t.ID.String() == tokenID && t.UserID.String() == userID && t.RevokedAt == nil {
+			now := time.Now()
+			r.tokens[i].RevokedAt = &now
+			return nil
+		}
+	}
+	return apperrors.NotFound("api_token_not_found", "API token does not exist")
+}
+
+func (r *fakeRepo) TouchAPIToken(ctx context.Context, tokenID string) error {
+	for i, t := range r.tokens {
+		if t.ID.String() == tokenID {
+			now := time.Now()
+			r.tokens[i].LastUsedAt = &now
+		}
+	}
+	return nil
+}
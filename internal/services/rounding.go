@@ -0,0 +1,213 @@
+package services
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+// RoundingContext carries what a rounding policy may use to decide who absorbs the
+// leftover minor units of a split.
+type RoundingContext struct {
+	ExpenseID  uuid.UUID
+	PayerID    uuid.UUID
+	Sequence   int64 // Number of expenses already recorded in the group
+	payerIndex int
+}
+
+// PayerIndex is the position of the payer among the participants being allocated,
+// or -1 when the payer is not one of them.
+func (rc RoundingContext) PayerIndex() int {
+	return rc.payerIndex
+}
+
+func (rc RoundingContext) withParticipants(userIDs []uuid.UUID) RoundingContext {
+	rc.payerIndex = -1
+	for i, id := range userIDs {
+		if id == rc.PayerID && id != uuid.Nil {
+			rc.payerIndex = i
+			break
+		}
+	}
+	return rc
+}
+
+// RoundingPolicy decides who receives the minor units (cents, paise...) left over
+// after every participant has been given their share rounded down.
+type RoundingPolicy interface {
+	Name() string
+	// Assign returns one participant index per leftover unit. remainders holds the
+	// fraction of a unit each participant lost to rounding; eligible lists, in order,
+	// the participants with a non-zero weight.
+	Assign(remainders []decimal.Decimal, eligible []int, units int, rc RoundingContext) []int
+}
+
+const (
+	RoundLastParticipant  = "LAST_PARTICIPANT"
+	RoundLargestRemainder = "LARGEST_REMAINDER"
+	RoundRotate           = "ROTATE"
+	RoundSeededRandom     = "SEEDED_RANDOM"
+	RoundPayerAbsorbs     = "PAYER_ABSORBS"
+)
+
+// DefaultRoundingPolicy matches the original behaviour: everyone but the last person
+// gets their share rounded half up, and the last person gets what is left.
+const DefaultRoundingPolicy = RoundLastParticipant
+
+var roundingPolicies = map[string]RoundingPolicy{
+	RoundLastParticipant:  lastParticipant{},
+	RoundLargestRemainder: largestRemainder{},
+	RoundRotate:           rotate{},
+	RoundSeededRandom:     seededRandom{},
+	RoundPayerAbsorbs:     payerAbsorbs{},
+}
+
+// LookupRoundingPolicy returns the policy registered under name. An empty name selects
+// the default policy.
+func LookupRoundingPolicy(name string) (RoundingPolicy, bool) {
+	if name == "" {
+		name = DefaultRoundingPolicy
+	}
+	p, ok := roundingPolicies[name]
+	return p, ok
+}
+
+// RoundingPolicyNames lists the registered policies in alphabetical order.
+func RoundingPolicyNames() []string {
+	names := make([]string, 0, len(roundingPolicies))
+	for name := range roundingPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Allocate splits money in proportion to weights at the precision of its currency.
+// Everyone first gets their share rounded down to the minor unit and the policy hands
+// out the leftover units, so the result always adds up to the full amount.
+func Allocate(money models.Money, weights []decimal.Decimal, policy RoundingPolicy, rc RoundingContext) []decimal.Decimal {
+	amount, places := money.Amount, money.Exponent()
+	total := decimal.Zero
+	var eligible []int
+	for i, w := range weights {
+		if w.IsPositive() {
+			eligible = append(eligible, i)
+			total = total.Add(w)
+		}
+	}
+
+	splits := make([]decimal.Decimal, len(weights))
+	if len(eligible) == 0 {
+		return splits
+	}
+
+	remainders := make([]decimal.Decimal, len(weights))
+	allocated := decimal.Zero
+	for _, i := range eligible {
+		exact := amount.Mul(weights[i]).Div(total)
+		splits[i] = exact.RoundFloor(places)
+		remainders[i] = exact.Sub(splits[i]).Shift(places)
+		allocated = allocated.Add(splits[i])
+	}
+
+	unit := money.MinorUnit()
+	units := int(amount.Sub(allocated).Shift(places).IntPart())
+	for _, i := range policy.Assign(remainders, eligible, units, rc) {
+		splits[i] = splits[i].Add(unit)
+	}
+
+	return splits
+}
+
+// lastParticipant rounds everyone but the last person half up and gives the last
+// person the rest. Shares are never rounded up past the units there are to hand out,
+// so the last person can't end up below their rounded-down share.
+type lastParticipant struct{}
+
+func (lastParticipant) Name() string { return RoundLastParticipant }
+
+func (lastParticipant) Assign(remainders []decimal.Decimal, eligible []int, units int, _ RoundingContext) []int {
+	half := decimal.NewFromFloat(0.5)
+	last := eligible[len(eligible)-1]
+	out := make([]int, 0, units)
+	for _, i := range eligible[:len(eligible)-1] {
+		if len(out) < units && remainders[i].GreaterThanOrEqual(half) {
+			out = append(out, i)
+		}
+	}
+	for len(out) < units {
+		out = append(out, last)
+	}
+	return out
+}
+
+// largestRemainder gives the extra units to whoever lost the most to rounding,
+// breaking ties by list order (Hamilton's method).
+type largestRemainder struct{}
+
+func (largestRemainder) Name() string { return RoundLargestRemainder }
+
+func (largestRemainder) Assign(remainders []decimal.Decimal, eligible []int, units int, _ RoundingContext) []int {
+	order := append([]int(nil), eligible...)
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]].GreaterThan(remainders[order[b]])
+	})
+	return cycle(order, 0, units)
+}
+
+// rotate moves the starting point along by one for every expense in the group, so the
+// extra cent takes turns across expenses.
+type rotate struct{}
+
+func (rotate) Name() string { return RoundRotate }
+
+func (rotate) Assign(_ []decimal.Decimal, eligible []int, units int, rc RoundingContext) []int {
+	start := int(rc.Sequence % int64(len(eligible)))
+	return cycle(eligible, start, units)
+}
+
+// seededRandom shuffles the participants with a seed derived from the expense ID, so
+// the choice looks random but is reproducible.
+type seededRandom struct{}
+
+func (seededRandom) Name() string { return RoundSeededRandom }
+
+func (seededRandom) Assign(_ []decimal.Decimal, eligible []int, units int, rc RoundingContext) []int {
+	h := fnv.New64a()
+	h.Write(rc.ExpenseID[:])
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+
+	order := make([]int, len(eligible))
+	for k, p := range rng.Perm(len(eligible)) {
+		order[k] = eligible[p]
+	}
+	return cycle(order, 0, units)
+}
+
+// payerAbsorbs gives every extra unit to the payer. When the payer is not sharing in
+// this allocation it falls back to largest remainder.
+type payerAbsorbs struct{}
+
+func (payerAbsorbs) Name() string { return RoundPayerAbsorbs }
+
+func (payerAbsorbs) Assign(remainders []decimal.Decimal, eligible []int, units int, rc RoundingContext) []int {
+	payer := rc.PayerIndex()
+	for _, i := range eligible {
+		if i == payer {
+			return cycle([]int{payer}, 0, units)
+		}
+	}
+	return largestRemainder{}.Assign(remainders, eligible, units, rc)
+}
+
+func cycle(order []int, start, units int) []int {
+	out := make([]int, units)
+	for k := range out {
+		out[k] = order[(start+k)%len(order)]
+	}
+	return out
+}
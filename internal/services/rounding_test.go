@@ -0,0 +1,133 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func splitterFor(t *testing.T, name string, rc RoundingContext) Splitter {
+	policy, ok := LookupRoundingPolicy(name)
+	assert.True(t, ok)
+	return Splitter{Policy: policy, Context: rc}
+}
+
+func assertSplits(t *testing.T, want []string, got []decimal.Decimal) {
+	assert.Equal(t, len(want), len(got))
+	for i := range want {
+		assert.True(t, got[i].Equal(decimal.RequireFromString(want[i])), "split %d: want %s, got %s", i, want[i], got[i])
+	}
+}
+
+func TestRoundingPolicies(t *testing.T) {
+	users := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	amount := decimal.NewFromInt(200) // 66.666... each, two cents left over
+
+	t.Run("Last participant", func(t *testing.T) {
+		sp := splitterFor(t, RoundLastParticipant, RoundingContext{})
+		assertSplits(t, []string{"66.67", "66.67", "66.66"}, sp.Equal(inr(amount), users))
+		assertSplits(t, []string{"33.33", "33.33", "33.34"}, sp.Equal(inr(decimal.NewFromInt(100)), users))
+	})
+
+	t.Run("Largest remainder", func(t *testing.T) {
+		sp := splitterFor(t, RoundLargestRemainder, RoundingContext{})
+		assertSplits(t, []string{"66.67", "66.67", "66.66"}, sp.Equal(inr(amount), users))
+
+		// 10 by 1:1:1.5 shares -> 2.857, 2.857, 4.285; largest remainders are the first two
+		splits, err := sp.Shares(inr(decimal.NewFromInt(10)), users, []decimal.Decimal{decimal.NewFromInt(1), decimal.NewFromInt(1), decimal.NewFromFloat(1.5)})
+		assert.NoError(t, err)
+		assertSplits(t, []string{"2.86", "2.86", "4.28"}, splits)
+	})
+
+	t.Run("Rotate across expenses", func(t *testing.T) {
+		first := splitterFor(t, RoundRotate, RoundingContext{Sequence: 0})
+		second := splitterFor(t, RoundRotate, RoundingContext{Sequence: 1})
+		third := splitterFor(t, RoundRotate, RoundingContext{Sequence: 2})
+		assertSplits(t, []string{"33.34", "33.33", "33.33"}, first.Equal(inr(decimal.NewFromInt(100)), users))
+		assertSplits(t, []string{"33.33", "33.34", "33.33"}, second.Equal(inr(decimal.NewFromInt(100)), users))
+		assertSplits(t, []string{"33.33", "33.33", "33.34"}, third.Equal(inr(decimal.NewFromInt(100)), users))
+	})
+
+	t.Run("Seeded random is reproducible", func(t *testing.T) {
+		rc := RoundingContext{ExpenseID: uuid.New()}
+		a := splitterFor(t, RoundSeededRandom, rc).Equal(inr(decimal.NewFromInt(100)), users)
+		b := splitterFor(t, RoundSeededRandom, rc).Equal(inr(decimal.NewFromInt(100)), users)
+		assert.Equal(t, a, b)
+
+		sum := decimal.Zero
+		for _, s := range a {
+			sum = sum.Add(s)
+		}
+		assert.True(t, sum.Equal(decimal.NewFromInt(100)))
+	})
+
+	t.Run("Payer absorbs", func(t *testing.T) {
+		sp := splitterFor(t, RoundPayerAbsorbs, RoundingContext{PayerID: users[1]})
+		assertSplits(t, []string{"66.66", "66.68", "66.66"}, sp.Equal(inr(amount), users))
+
+		// Payer not sharing: falls back to largest remainder
+		sp = splitterFor(t, RoundPayerAbsorbs, RoundingContext{PayerID: uuid.New()})
+		assertSplits(t, []string{"66.67", "66.67", "66.66"}, sp.Equal(inr(amount), users))
+	})
+
+	t.Run("Unknown policy", func(t *testing.T) {
+		_, ok := LookupRoundingPolicy("BANKERS")
+		assert.False(t, ok)
+	})
+}
+
+func inr(amount decimal.Decimal) models.Money {
+	return models.Money{Amount: amount, Currency: "INR"}
+}
+
+// The default policy must split exactly as the engine did before policies existed:
+// round each share half up to the paisa and give the last person the rest.
+func TestDefaultMatchesRoundThenRemainder(t *testing.T) {
+	users := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	sp := DefaultSplitter()
+
+	baseline := func(amount decimal.Decimal, weights []decimal.Decimal) []decimal.Decimal {
+		total := decimal.Sum(weights[0], weights[1:]...)
+		out := make([]decimal.Decimal, len(weights))
+		rest := amount
+		for i := 0; i < len(weights)-1; i++ {
+			out[i] = amount.Mul(weights[i]).DivRound(total, 2)
+			rest = rest.Sub(out[i])
+		}
+		out[len(out)-1] = rest
+		return out
+	}
+	asStrings := func(ds []decimal.Decimal) []string {
+		out := make([]string, len(ds))
+		for i, d := range ds {
+			out[i] = d.String()
+		}
+		return out
+	}
+	one := decimal.NewFromInt(1)
+
+	for _, s := range []string{"200", "100", "10", "0.05", "1234.57", "99.99"} {
+		amount := decimal.RequireFromString(s)
+		equal := []decimal.Decimal{one, one, one}
+		assertSplits(t, asStrings(baseline(amount, equal)), sp.Equal(inr(amount), users))
+
+		weights := []decimal.Decimal{one, one, decimal.NewFromFloat(1.5)}
+		splits, err := sp.Shares(inr(amount), users, weights)
+		assert.NoError(t, err)
+		assertSplits(t, asStrings(baseline(amount, weights)), splits)
+	}
+}
+
+func TestAllocateCurrencyPrecision(t *testing.T) {
+	users := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	sp := DefaultSplitter()
+
+	jpy := sp.Equal(models.Money{Amount: decimal.NewFromInt(1000), Currency: "JPY"}, users)
+	assertSplits(t, []string{"333", "333", "334"}, jpy)
+
+	kwd := sp.Equal(models.Money{Amount: decimal.NewFromInt(10), Currency: "KWD"}, users)
+	assertSplits(t, []string{"3.333", "3.333", "3.334"}, kwd)
+}
@@ -0,0 +1,255 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/shopspring/decimal"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+var errPlanNotFound = apperrors.NotFound("settlement_plan_not_found", "settlement plan not found")
+
+// CreatePlan saves the group's current settlement as a plan members can pay off,
+// superseding any plan before it.
+func (s *SettlementService) CreatePlan(ctx context.Context, groupID, strategyName string) (*models.SettlementPlan, error) {
+	plan, err := s.newPlan(ctx, groupID, strategyName)
+	if err != nil { return nil, err }
+	if err := s.repo.CreateSettlementPlan(ctx, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// newPlan works out a plan for the group's current balances without saving it.
+func (s *SettlementService) newPlan(ctx context.Context, groupID, strategyName string) (*models.SettlementPlan, error) {
+	l, err := s.ledger(ctx, groupID, nil, nil)
+	if err != nil { return nil, err }
+
+	strategy, settlements, err := s.settle(ctx, l, strategyName, l.balances())
+	if err != nil { return nil, err }
+
+	plan := &models.SettlementPlan{
+		GroupID:   l.group.ID,
+		Strategy:  strategy.Name(),
+		Currency:  l.group.BaseCurrency,
+		Version:   1,
+		Transfers: []models.PlanTransfer{},
+	}
+	for _, t := range settlements {
+		plan.Transfers = append(plan.Transfers, models.PlanTransfer{
+			ID:         uuid.New(),
+			From:       t.From,
+			To:         t.To,
+			Amount:     t.Amount,
+			PaidAmount: decimal.Zero,
+			Status:     models.TransferPending,
+		})
+	}
+	plan.Status = planStatus(plan.Transfers)
+	return plan, nil
+}
+
+// CurrentPlan returns the group's plan, bringing it up to date first.
+func (s *SettlementService) CurrentPlan(ctx context.Context, groupID string) (*models.SettlementPlan, error) {
+	plan, err := s.repo.GetCurrentSettlementPlan(ctx, groupID)
+	if err != nil { return nil, err }
+	if plan == nil {
+		return nil, apperrors.NotFound("settlement_plan_not_found", "the group has no settlement plan yet")
+	}
+	return s.refreshPlan(ctx, plan)
+}
+
+// GetPlan returns one of the group's plans. Plans that are still current are brought
+// up to date first; superseded ones are returned as they were left.
+func (s *SettlementService) GetPlan(ctx context.Context, groupID, planID string) (*models.SettlementPlan, error) {
+	plan, err := s.findPlan(ctx, groupID, planID)
+	if err != nil { return nil, err }
+	if plan.Status == models.PlanSuperseded {
+		return plan, nil
+	}
+	return s.refreshPlan(ctx, plan)
+}
+
+// refreshPlan recomputes the plan's pending transfers if the group's balances no longer
+// match what the plan still has to pay, for example after a new expense. Transfers that
+// are paid, partly paid or disputed are kept exactly as they are, so nobody's transfer
+// changes while they are paying it; the rest of the balances are settled again with the
+// plan's strategy.
+func (s *SettlementService) refreshPlan(ctx context.Context, plan *models.SettlementPlan) (*models.SettlementPlan, error) {
+	l, err := s.ledger(ctx, plan.GroupID.String(), nil, nil)
+	if err != nil { return nil, err }
+	balances := l.balances()
+
+	// What would be left if every outstanding transfer were paid
+	left := copyBalances(balances)
+	for _, t := range plan.Transfers {
+		applyOutstanding(left, t)
+	}
+	if allZero(left) {
+		return plan, nil
+	}
+
+	residual := copyBalances(balances)
+	var kept []models.PlanTransfer
+	for _, t := range plan.Transfers {
+		if t.Status == models.TransferPending {
+			continue
+		}
+		kept = append(kept, t)
+		applyOutstanding(residual, t)
+	}
+
+	_, settlements, err := s.settle(ctx, l, plan.Strategy, residual)
+	if err != nil { return nil, err }
+
+	for _, t := range settlements {
+		kept = append(kept, models.PlanTransfer{
+			ID:         uuid.New(),
+			PlanID:     plan.ID,
+			From:       t.From,
+			To:         t.To,
+			Amount:     t.Amount,
+			PaidAmount: decimal.Zero,
+			Status:     models.TransferPending,
+		})
+	}
+	if kept == nil {
+		kept = []models.PlanTransfer{}
+	}
+	plan.Transfers = kept
+	plan.Status = planStatus(kept)
+	plan.Version++
+
+	if err := s.repo.SaveSettlementPlan(ctx, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// UpdateTransfer marks a transfer in a plan as paid, partly paid, disputed, or back to
+// pending after a dispute. Money marked as paid is recorded as a settlement payment at
+// the same time, so the group's balances follow the plan. If the plan changes between
+// reading and saving it, nothing is saved and the caller gets a conflict. Paying off the final plan of
+// a settling group archives it.
+func (s *SettlementService) UpdateTransfer(ctx context.Context, groupID, planID, transferID string, update models.TransferUpdate) (*models.SettlementPlan, error) {
+	plan, err := s.findPlan(ctx, groupID, planID)
+	if err != nil { return nil, err }
+	if plan.Status == models.PlanSuperseded {
+		return nil, invalid(errors.New("this settlement plan has been superseded"))
+	}
+
+	var t *models.PlanTransfer
+	for i := range plan.Transfers {
+		if plan.Transfers[i].ID.String() == transferID {
+			t = &plan.Transfers[i]
+		}
+	}
+	if t == nil {
+		return nil, apperrors.NotFound("transfer_not_found", "transfer not found in this settlement plan")
+	}
+	if t.Status == models.TransferPaid {
+		return nil, invalid(errors.New("transfer is already paid"))
+	}
+
+	paid := t.PaidAmount
+	switch update.Status {
+	case models.TransferPaid:
+		paid = t.Amount
+		t.Note = ""
+	case models.TransferPartiallyPaid:
+		if update.PaidAmount == nil {
+			return nil, invalid(errors.New("paid_amount is required for a partly paid transfer"))
+		}
+		paid = *update.PaidAmount
+		if !paid.GreaterThan(t.PaidAmount) || !paid.LessThan(t.Amount) {
+			return nil, invalid(fmt.Errorf("paid_amount must be more than %s and less than %s", t.PaidAmount, t.Amount))
+		}
+		if err := (models.Money{Amount: paid, Currency: plan.Currency}).Validate(); err != nil {
+			return nil, invalid(err)
+		}
+		t.Note = ""
+	case models.TransferDisputed:
+		t.Note = update.Note
+	case models.TransferPending:
+		if t.Status != models.TransferDisputed {
+			return nil, invalid(errors.New("only a disputed transfer can be set back to pending"))
+		}
+		t.Note = ""
+	default:
+		return nil, invalid(fmt.Errorf("unknown transfer status %q", update.Status))
+	}
+
+	var payment *models.SettlementPayment
+	if delta := paid.Sub(t.PaidAmount); delta.IsPositive() {
+		payment = &models.SettlementPayment{
+			GroupID:    plan.GroupID,
+			FromUserID: t.From.ID,
+			ToUserID:   t.To.ID,
+			Amount:     delta,
+		}
+	}
+	t.PaidAmount = paid
+	t.Status = update.Status
+	if t.Status == models.TransferPending && t.PaidAmount.IsPositive() {
+		t.Status = models.TransferPartiallyPaid
+	}
+	plan.Status = planStatus(plan.Transfers)
+	plan.Version++
+
+	if err := s.repo.UpdatePlanTransfer(ctx, plan, t, payment); err != nil {
+		return nil, err
+	}
+	if plan.Status == models.PlanCompleted {
+		if err := s.archiveIfSettled(ctx, groupID); err != nil { return nil, err }
+	}
+	return plan, nil
+}
+
+func (s *SettlementService) findPlan(ctx context.Context, groupID, planID string) (*models.SettlementPlan, error) {
+	if _, err := uuid.Parse(planID); err != nil {
+		return nil, errPlanNotFound
+	}
+	plan, err := s.repo.GetSettlementPlan(ctx, planID)
+	if err != nil { return nil, err }
+	if plan == nil || plan.GroupID.String() != groupID {
+		return nil, errPlanNotFound
+	}
+	return plan, nil
+}
+
+func planStatus(transfers []models.PlanTransfer) models.PlanStatus {
+	for _, t := range transfers {
+		if t.Status != models.TransferPaid {
+			return models.PlanActive
+		}
+	}
+	return models.PlanCompleted
+}
+
+// applyOutstanding adjusts balances as if the rest of the transfer had been paid.
+func applyOutstanding(balances map[uuid.UUID]decimal.Decimal, t models.PlanTransfer) {
+	o := t.Outstanding()
+	balances[t.From.ID] = balances[t.From.ID].Add(o)
+	balances[t.To.ID] = balances[t.To.ID].Sub(o)
+}
+
+func copyBalances(balances map[uuid.UUID]decimal.Decimal) map[uuid.UUID]decimal.Decimal {
+	out := make(map[uuid.UUID]decimal.Decimal, len(balances))
+	for user, amount := range balances {
+		out[user] = amount
+	}
+	return out
+}
+
+func allZero(balances map[uuid.UUID]decimal.Decimal) bool {
+	for _, amount := range balances {
+		if !amount.IsZero() {
+			return false
+		}
+	}
+	return true
+}
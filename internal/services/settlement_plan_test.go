@@ -0,0 +1,149 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/apperrors"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func TestSettlementPlanLifecycle(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob, carol := repo.user("Alice"), repo.user("Bob"), repo.user("Carol")
+	repo.expenses = []models.Expense{paid(alice, bob, 60), paid(alice, carol, 40)}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	plan, err := svc.CreatePlan(ctx, groupID, "")
+	assert.NoError(t, err)
+	assert.Equal(t, models.PlanActive, plan.Status)
+	assert.Equal(t, "greedy", plan.Strategy)
+	assert.Len(t, plan.Transfers, 2)
+	bobPays, carolPays := plan.Transfers[0], plan.Transfers[1]
+	assert.Equal(t, bob, bobPays.From.ID)
+	assert.Equal(t, carol, carolPays.From.ID)
+
+	// Nothing changed, so the plan is returned as it was
+	current, err := svc.CurrentPlan(ctx, groupID)
+	assert.NoError(t, err)
+	assert.Equal(t, plan.ID, current.ID)
+	assert.Equal(t, 1, current.Version)
+
+	// Bob pays part of his transfer; a payment is recorded and the plan still matches
+	half := decimal.NewFromInt(25)
+	plan, err = svc.UpdateTransfer(ctx, groupID, plan.ID.String(), bobPays.ID.String(),
+		models.TransferUpdate{Status: models.TransferPartiallyPaid, PaidAmount: &half})
+	assert.NoError(t, err)
+	assert.Len(t, repo.payments, 1)
+	assert.True(t, repo.payments[0].Amount.Equal(half))
+
+	current, err = svc.CurrentPlan(ctx, groupID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, current.Version)
+
+	// A new expense only changes the pending part: Bob's transfer stays as it is
+	repo.expenses = append(repo.expenses, paid(alice, carol, 20))
+	current, err = svc.CurrentPlan(ctx, groupID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, current.Version)
+	assert.Equal(t, bobPays.ID, current.Transfers[0].ID)
+	assert.True(t, current.Transfers[0].Amount.Equal(decimal.NewFromInt(60)))
+	assert.Len(t, current.Transfers, 2)
+	assert.Equal(t, carol, current.Transfers[1].From.ID)
+	assert.True(t, current.Transfers[1].Amount.Equal(decimal.NewFromInt(60)))
+
+	// Carol disputes, then everything is paid
+	carolPays = current.Transfers[1]
+	current, err = svc.UpdateTransfer(ctx, groupID, current.ID.String(), carolPays.ID.String(),
+		models.TransferUpdate{Status: models.TransferDisputed, Note: "I only had the salad"})
+	assert.NoError(t, err)
+	assert.Equal(t, models.TransferDisputed, current.Transfers[1].Status)
+
+	for _, tr := range current.Transfers {
+		current, err = svc.UpdateTransfer(ctx, groupID, current.ID.String(), tr.ID.String(),
+			models.TransferUpdate{Status: models.TransferPaid})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, models.PlanCompleted, current.Status)
+	balances, err := svc.CalculateBalances(ctx, groupID, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, allZero(balances))
+
+	var verr *ValidationError
+	_, err = svc.UpdateTransfer(ctx, groupID, current.ID.String(), carolPays.ID.String(),
+		models.TransferUpdate{Status: models.TransferPaid})
+	assert.ErrorAs(t, err, &verr)
+
+	// A new plan supersedes the old one, which can no longer be changed
+	newPlan, err := svc.CreatePlan(ctx, groupID, "")
+	assert.NoError(t, err)
+	assert.Empty(t, newPlan.Transfers)
+	old, err := svc.GetPlan(ctx, groupID, current.ID.String())
+	assert.NoError(t, err)
+	assert.Equal(t, models.PlanSuperseded, old.Status)
+}
+
+func TestUpdateTransferValidation(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	repo.expenses = []models.Expense{paid(repo.user("Alice"), repo.user("Bob"), 10)}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	plan, err := svc.CreatePlan(ctx, groupID, "")
+	assert.NoError(t, err)
+	tr := plan.Transfers[0].ID.String()
+
+	var verr *ValidationError
+	tooMuch := decimal.NewFromInt(10)
+	_, err = svc.UpdateTransfer(ctx, groupID, plan.ID.String(), tr, models.TransferUpdate{Status: models.TransferPartiallyPaid, PaidAmount: &tooMuch})
+	assert.ErrorAs(t, err, &verr)
+	fine := decimal.RequireFromString("2.505")
+	_, err = svc.UpdateTransfer(ctx, groupID, plan.ID.String(), tr, models.TransferUpdate{Status: models.TransferPartiallyPaid, PaidAmount: &fine})
+	assert.ErrorAs(t, err, &verr)
+	_, err = svc.UpdateTransfer(ctx, groupID, plan.ID.String(), tr, models.TransferUpdate{Status: models.TransferPending})
+	assert.ErrorAs(t, err, &verr)
+	_, err = svc.UpdateTransfer(ctx, groupID, "not-a-plan", tr, models.TransferUpdate{Status: models.TransferPaid})
+	assert.True(t, apperrors.IsNotFound(err))
+	_, err = svc.UpdateTransfer(ctx, groupID, plan.ID.String(), "not-a-transfer", models.TransferUpdate{Status: models.TransferPaid})
+	assert.True(t, apperrors.IsNotFound(err))
+	assert.Empty(t, repo.payments)
+}
+
+func TestStalePlanIsNotSaved(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob, carol := repo.user("Alice"), repo.user("Bob"), repo.user("Carol")
+	repo.expenses = []models.Expense{paid(alice, bob, 60), paid(alice, carol, 40)}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	plan, err := svc.CreatePlan(ctx, groupID, "")
+	assert.NoError(t, err)
+	bobPays := plan.Transfers[0].ID.String()
+	stale, _ := repo.GetSettlementPlan(ctx, plan.ID.String())
+
+	_, err = svc.UpdateTransfer(ctx, groupID, plan.ID.String(), bobPays, models.TransferUpdate{Status: models.TransferPaid})
+	assert.NoError(t, err)
+
+	// A second request that read the plan before Bob's payment was saved records nothing
+	_, err = svc.UpdateTransfer(ctx, groupID, plan.ID.String(), bobPays, models.TransferUpdate{Status: models.TransferPaid})
+	assert.Error(t, err)
+	assert.Len(t, repo.payments, 1)
+	racing := clonePlan(*stale)
+	racing.Version++
+	assert.Equal(t, "settlement_plan_changed", codeOf(repo.UpdatePlanTransfer(ctx, racing, &racing.Transfers[0], &models.SettlementPayment{})))
+	assert.Len(t, repo.payments, 1)
+
+	// Nor can a refresh that started before it write back Bob's transfer as pending
+	repo.expenses = append(repo.expenses, paid(alice, carol, 20))
+	_, err = svc.refreshPlan(ctx, stale)
+	assert.Equal(t, "settlement_plan_changed", codeOf(err))
+	current, err := svc.CurrentPlan(ctx, groupID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.TransferPaid, current.Transfers[0].Status)
+}
@@ -2,9 +2,12 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 	"github.com/user/debt-optimization-engine/internal/algorithms"
 	"github.com/user/debt-optimization-engine/internal/models"
@@ -13,43 +16,94 @@ import (
 
 type SettlementService struct {
 	repo repositories.Repository
+	fx   *FXService
 }
 
-func NewSettlementService(repo repositories.Repository) *SettlementService {
-	return &SettlementService{repo: repo}
+func NewSettlementService(repo repositories.Repository, fx *FXService) *SettlementService {
+	return &SettlementService{repo: repo, fx: fx}
 }
 
-func (s *SettlementService) CalculateBalances(ctx context.Context, groupID string, from, to *time.Time) (map[string]decimal.Decimal, error) {
-	expenses, err := s.repo.GetExpensesByGroup(ctx, groupID, from, to)
+// CalculateBalances returns each member's outstanding net balance in the group's base
+// currency. Expenses in other currencies are converted at the rate stored with the
+// expense, and recorded settlement payments are taken off what is owed.
+func (s *SettlementService) CalculateBalances(ctx context.Context, groupID string, from, to *time.Time) (map[uuid.UUID]decimal.Decimal, error) {
+	l, err := s.ledger(ctx, groupID, from, to)
 	if err != nil { return nil, err }
+	return l.balances(), nil
+}
 
-	members, err := s.repo.GetGroupMembers(ctx, groupID)
+// GroupBalances returns every member's balance with who they are, ordered by username.
+func (s *SettlementService) GroupBalances(ctx context.Context, groupID string, from, to *time.Time) (*models.GroupBalances, error) {
+	l, err := s.ledger(ctx, groupID, from, to)
 	if err != nil { return nil, err }
+	return &models.GroupBalances{
+		GroupID:  l.group.ID,
+		Currency: l.group.BaseCurrency,
+		Balances: l.userBalances(l.balances()),
+	}, nil
+}
 
-	userMap := make(map[string]string)
-	balances := make(map[string]decimal.Decimal)
-	for _, m := range members {
-		userMap[m.ID.String()] = m.Username
-		balances[m.Username] = decimal.Zero
+// RecordPayment stores a payment made between two members to settle up. The amount is
+// in the group's base currency. A payment that pays off a settling group's final plan
+// archives the group; an archived group takes no more payments.
+func (s *SettlementService) RecordPayment(ctx context.Context, payment *models.SettlementPayment) error {
+	if !payment.Amount.IsPositive() {
+		return invalid(errors.New("payment amount must be positive"))
+	}
+	if payment.FromUserID == payment.ToUserID {
+		return invalid(errors.New("payer and recipient must be different"))
 	}
 
-	for _, exp := range expenses {
-		payerName := userMap[exp.PayerID.String()]
-		balances[payerName] = balances[payerName].Add(exp.Amount)
-		for _, split := range exp.Splits {
-			userName := userMap[split.UserID.String()]
-			balances[userName] = balances[userName].Sub(split.Amount)
-		}
+	m, err := loadMembership(ctx, s.repo, payment.GroupID)
+	if err != nil { return err }
+	if m.group.Status == models.GroupArchived {
+		return RequireActive(m.group)
+	}
+	if err := (models.Money{Amount: payment.Amount, Currency: m.group.BaseCurrency}).Validate(); err != nil {
+		return invalid(err)
+	}
+
+	errs := m.check(nil, "from_user_id", payment.FromUserID)
+	errs = m.check(errs, "to_user_id", payment.ToUserID)
+	if len(errs) > 0 {
+		return invalid(errs)
 	}
 
-	return balances, nil
+	payment.Kind = models.PaymentSettlement
+	if err := s.repo.CreateSettlementPayment(ctx, payment); err != nil { return err }
+	return s.archiveIfSettled(ctx, payment.GroupID.String())
 }
 
-func (s *SettlementService) GetSettlement(ctx context.Context, groupID string, from, to *time.Time) (*models.SettlementResponse, error) {
-	balances, err := s.CalculateBalances(ctx, groupID, from, to)
+// GetSettlement builds the payment plan with the named strategy. When no strategy is
+// named the default is used, or the constrained one if the group has payment
+// constraints. Transfers are in the group's base currency unless another currency is
+// asked for, in which case they are converted at today's rate.
+func (s *SettlementService) GetSettlement(ctx context.Context, groupID string, from, to *time.Time, currency, strategyName string) (*models.SettlementResponse, error) {
+	group, err := s.repo.GetGroup(ctx, groupID)
 	if err != nil { return nil, err }
 
-	optimized := algorithms.SettleOptimized(balances)
+	l, err := s.ledger(ctx, groupID, from, to)
+	if err != nil { return nil, err }
+	balances := l.balances()
+
+	strategy, optimized, err := s.settle(ctx, l, strategyName, balances)
+	if err != nil { return nil, err }
+
+	var rateStr string
+	settleCurrency := group.BaseCurrency
+	if currency != "" && models.NormalizeCurrency(currency) != group.BaseCurrency {
+		settleCurrency = models.NormalizeCurrency(currency)
+		if _, ok := models.CurrencyExponent(settleCurrency); !ok {
+			return nil, invalid(fmt.Errorf("%w: %q", models.ErrUnknownCurrency, settleCurrency))
+		}
+		rate, err := s.fx.Rate(ctx, group.BaseCurrency, settleCurrency, time.Now())
+		if err != nil { return nil, err }
+		for i := range optimized {
+			optimized[i].Amount = ConvertAmount(optimized[i].Amount, rate, settleCurrency)
+			optimized[i].Fee = ConvertAmount(optimized[i].Fee, rate, settleCurrency)
+		}
+		rateStr = rate.String()
+	}
 
 	rawCount := 0
 	expenses, _ := s.repo.GetExpensesByGroup(ctx, groupID, from, to)
@@ -66,39 +120,385 @@ func (s *SettlementService) GetSettlement(ctx context.Context, groupID string, f
 		Transactions:      optimized,
 		TotalTransactions: len(optimized),
 		OptimizationGain:  gain,
-		RawBalances:       balances,
+		Strategy:          strategy.Name(),
+		Currency:          settleCurrency,
+		ExchangeRate:      rateStr,
+		TotalFees:         totalFees(optimized).String(),
+		RawBalances:       l.userBalances(balances),
 	}, nil
 }
 
+// settle runs the named strategy (or the group's default) on the balances, honouring
+// the group's payment network. It returns the strategy used and the network so callers
+// can price the plan.
+func (s *SettlementService) settle(ctx context.Context, l *groupLedger, strategyName string, balances map[uuid.UUID]decimal.Decimal) (algorithms.Strategy, []models.Transfer, error) {
+	network, err := s.paymentNetwork(ctx, l.group)
+	if err != nil { return nil, nil, err }
+	if strategyName == "" && !network.Empty() {
+		strategyName = constrainedStrategy
+	}
+
+	strategy, ok := algorithms.Lookup(strategyName)
+	if !ok {
+		return nil, nil, invalid(fmt.Errorf("unknown settlement strategy %q", strategyName))
+	}
+
+	var settlements []algorithms.Settlement
+	if ns, ok := strategy.(algorithms.NetworkStrategy); ok {
+		settlements, err = ns.SettleNetwork(keyed(balances), network)
+		var planErr *algorithms.NoValidPlanError
+		if errors.As(err, &planErr) {
+			named := &algorithms.NoValidPlanError{Unsettled: make(map[string]decimal.Decimal)}
+			for key, amount := range planErr.Unsettled {
+				named.Unsettled[l.name(key)] = amount
+			}
+			return nil, nil, invalid(named)
+		}
+		if err != nil { return nil, nil, err }
+	} else {
+		settlements = strategy.Settle(keyed(balances))
+		for _, t := range settlements {
+			if !network.Allows(t.From, t.To) {
+				return nil, nil, invalid(fmt.Errorf("settlement strategy %q cannot honour the group's payment constraints (%s cannot pay %s)", strategy.Name(), l.name(t.From), l.name(t.To)))
+			}
+		}
+	}
+	price(settlements, network, l.group)
+	return strategy, l.transfers(settlements), nil
+}
+
+// price fills in the method and fee of every transfer, rounding fees to the group's
+// currency. Everything that shows a fee prices it here so the totals agree.
+func price(settlements []algorithms.Settlement, network algorithms.Network, group *models.Group) {
+	algorithms.Price(settlements, network)
+	exp, _ := models.CurrencyExponent(group.BaseCurrency)
+	for i := range settlements {
+		settlements[i].Fee = settlements[i].Fee.Round(exp)
+	}
+}
+
+// keyed converts balances to the string keys the algorithms work with.
+func keyed(balances map[uuid.UUID]decimal.Decimal) map[string]decimal.Decimal {
+	out := make(map[string]decimal.Decimal, len(balances))
+	for id, amount := range balances {
+		out[id.String()] = amount
+	}
+	return out
+}
+
+// transfers turns the algorithms' settlements back into transfers between members.
+func (l *groupLedger) transfers(settlements []algorithms.Settlement) []models.Transfer {
+	out := make([]models.Transfer, 0, len(settlements))
+	for _, t := range settlements {
+		out = append(out, models.Transfer{
+			From:   l.summary(t.From),
+			To:     l.summary(t.To),
+			Amount: t.Amount,
+			Method:     t.Method,
+			Fee:        t.Fee,
+			FeeUnknown: t.FeeUnknown,
+		})
+	}
+	return out
+}
+
+// userBalances lists the balances with who they belong to, ordered by username.
+func (l *groupLedger) userBalances(balances map[uuid.UUID]decimal.Decimal) []models.UserBalance {
+	out := make([]models.UserBalance, 0, len(balances))
+	for _, m := range l.members {
+		if amount, ok := balances[m.ID]; ok {
+			out = append(out, models.UserBalance{User: m.Summary(), Balance: amount})
+		}
+	}
+	return out
+}
+
+func totalFees(transfers []models.Transfer) decimal.Decimal {
+	total := decimal.Zero
+	for _, t := range transfers {
+		total = total.Add(t.Fee)
+	}
+	return total
+}
+
+// baselineStrategy is the strategy every other one is measured against in comparisons.
+const baselineStrategy = "naive"
+
+// constrainedStrategy is used by default for groups with payment constraints.
+const constrainedStrategy = "constrained"
+
+// CompareStrategies runs every registered strategy on the group's balances. Strategies
+// that ignore the group's payment constraints report how many of their transfers break
+// them.
 func (s *SettlementService) CompareStrategies(ctx context.Context, groupID string) (*models.SettlementComparison, error) {
-	balances, err := s.CalculateBalances(ctx, groupID, nil, nil)
+	l, err := s.ledger(ctx, groupID, nil, nil)
 	if err != nil { return nil, err }
+	balances := keyed(l.balances())
 
-	optimized := algorithms.SettleOptimized(balances)
-	naive := algorithms.SettleNaive(balances)
-
-	optStats := s.calculateStats(optimized)
-	naiveStats := s.calculateStats(naive)
+	network, err := s.paymentNetwork(ctx, l.group)
+	if err != nil { return nil, err }
 
-	if naiveStats.TransactionCount > 0 {
-		gain := float64(naiveStats.TransactionCount-optStats.TransactionCount) / float64(naiveStats.TransactionCount) * 100
-		if gain < 0 { gain = 0 }
-		optStats.OptimizationGain = fmt.Sprintf("%.1f%%", gain)
+	var baseline *models.SettlementStats
+	var stats []models.SettlementStats
+	for _, strategy := range algorithms.Strategies() {
+		var st models.SettlementStats
+		if ns, ok := strategy.(algorithms.NetworkStrategy); ok {
+			txs, err := ns.SettleNetwork(balances, network)
+			price(txs, network, l.group)
+			st = s.calculateStats(txs)
+			if err != nil {
+				st.Error = err.Error()
+			}
+		} else {
+			txs := strategy.Settle(balances)
+			price(txs, network, l.group)
+			st = s.calculateStats(txs)
+			for _, t := range txs {
+				if !network.Allows(t.From, t.To) {
+					st.Violations++
+				}
+			}
+		}
+		st.Strategy = strategy.Name()
+		st.Description = strategy.Description()
+		stats = append(stats, st)
+	}
+	for i := range stats {
+		if stats[i].Strategy == baselineStrategy {
+			baseline = &stats[i]
+		}
+	}
+	if baseline != nil && baseline.TransactionCount > 0 {
+		for i := range stats {
+			stats[i].OptimizationGain = gainOver(*baseline, stats[i])
+		}
 	}
 
 	return &models.SettlementComparison{
-		Greedy:   optStats,
-		Baseline: naiveStats,
+		Baseline:   baselineStrategy,
+		Strategies: stats,
 	}, nil
 }
 
+func gainOver(baseline, stats models.SettlementStats) string {
+	gain := float64(baseline.TransactionCount-stats.TransactionCount) / float64(baseline.TransactionCount) * 100
+	if gain < 0 { gain = 0 }
+	return fmt.Sprintf("%.1f%%", gain)
+}
+
 func (s *SettlementService) calculateStats(txs []algorithms.Settlement) models.SettlementStats {
 	vol := decimal.Zero
+	sent := make(map[string]int)
+	maxSent := 0
 	for _, t := range txs {
 		vol = vol.Add(t.Amount)
+		sent[t.From]++
+		if sent[t.From] > maxSent {
+			maxSent = sent[t.From]
+		}
 	}
 	return models.SettlementStats{
-		TransactionCount: len(txs),
-		TotalVolume:      vol,
+		TransactionCount:      len(txs),
+		TotalVolume:           vol,
+		MaxTransfersPerPerson: maxSent,
+		TotalFees:             algorithms.TotalFees(txs),
 	}
 }
+
+// GetPaymentConstraints returns the group's payment network.
+func (s *SettlementService) GetPaymentConstraints(ctx context.Context, groupID string) (*models.PaymentConstraints, error) {
+	return s.repo.GetPaymentConstraints(ctx, groupID)
+}
+
+// SetPaymentConstraints validates and replaces the group's payment network. Every user
+// named must be a member, and each pair may only be constrained once.
+func (s *SettlementService) SetPaymentConstraints(ctx context.Context, groupID string, constraints *models.PaymentConstraints) error {
+	members, err := s.repo.GetGroupMembers(ctx, groupID)
+	if err != nil { return err }
+	isMember := make(map[string]bool)
+	for _, m := range members {
+		isMember[m.ID.String()] = true
+	}
+
+	seen := make(map[[2]string]bool)
+	for i := range constraints.Pairs {
+		c := &constraints.Pairs[i]
+		if c.Kind != models.PairForbidden && c.Kind != models.PairPreferred {
+			return invalid(fmt.Errorf("unknown pair constraint kind %q", c.Kind))
+		}
+		if c.UserA == c.UserB {
+			return invalid(errors.New("a pair constraint needs two different users"))
+		}
+		if !isMember[c.UserA.String()] || !isMember[c.UserB.String()] {
+			return invalid(errors.New("pair constraints may only name group members"))
+		}
+		// Pairs are unordered; store them the same way round every time
+		if c.UserA.String() > c.UserB.String() {
+			c.UserA, c.UserB = c.UserB, c.UserA
+		}
+		key := [2]string{c.UserA.String(), c.UserB.String()}
+		if seen[key] {
+			return invalid(errors.New("each pair may only be constrained once"))
+		}
+		seen[key] = true
+	}
+
+	hasHub := make(map[string]bool)
+	for _, h := range constraints.ReceiveVia {
+		if h.UserID == h.HubUserID {
+			return invalid(errors.New("a member cannot receive via themselves"))
+		}
+		if !isMember[h.UserID.String()] || !isMember[h.HubUserID.String()] {
+			return invalid(errors.New("receiving hubs may only name group members"))
+		}
+		if hasHub[h.UserID.String()] {
+			return invalid(errors.New("each member may only have one receiving hub"))
+		}
+		hasHub[h.UserID.String()] = true
+	}
+
+	return s.repo.ReplacePaymentConstraints(ctx, groupID, constraints)
+}
+
+// paymentNetwork loads the group's constraints and its members' payment methods, keyed
+// by user ID the way the algorithms see balances. Method fees are converted into the
+// group's base currency at today's rate. A method in a currency with no rate is left
+// unpriced rather than failing, so one member's settings can't break the group.
+func (s *SettlementService) paymentNetwork(ctx context.Context, group *models.Group) (algorithms.Network, error) {
+	var network algorithms.Network
+	groupID := group.ID.String()
+	constraints, err := s.repo.GetPaymentConstraints(ctx, groupID)
+	if err != nil { return network, err }
+	methods, err := s.repo.GetPaymentMethodsByGroup(ctx, groupID)
+	if err != nil { return network, err }
+
+	for _, c := range constraints.Pairs {
+		a, b := c.UserA.String(), c.UserB.String()
+		switch c.Kind {
+		case models.PairForbidden:
+			network.Forbid(a, b)
+		case models.PairPreferred:
+			network.Prefer(a, b)
+		}
+	}
+	for _, h := range constraints.ReceiveVia {
+		network.ReceiveVia(h.UserID.String(), h.HubUserID.String())
+	}
+
+	for _, m := range methods {
+		rate, err := s.fx.Rate(ctx, models.NormalizeCurrency(m.Currency), group.BaseCurrency, time.Now())
+		var noRate *ValidationError
+		if errors.As(err, &noRate) {
+			network.AddMethod(m.UserID.String(), algorithms.Method{Name: m.Name, Unpriced: true})
+			continue
+		}
+		if err != nil { return network, err }
+		network.AddMethod(m.UserID.String(), algorithms.Method{
+			Name: m.Name,
+			Fee: algorithms.FeeModel{
+				Flat:     m.FlatFee.Mul(rate),
+				Percent:  m.Percent,
+				FreeUpTo: m.FreeLimit.Mul(rate),
+			},
+		})
+	}
+	return network, nil
+}
+
+// GetPaymentMethods returns the ways a user can send and receive money. Only the user
+// and the people they share a group with, who may have to pay them, can see them.
+func (s *SettlementService) GetPaymentMethods(ctx context.Context, viewer uuid.UUID, userID string) ([]models.PaymentMethod, error) {
+	if viewer.String() != userID {
+		shared, err := s.shareGroup(ctx, viewer, userID)
+		if err != nil { return nil, err }
+		if !shared {
+			return nil, errNoSharedGroup
+		}
+	}
+	return s.repo.GetPaymentMethodsByUser(ctx, userID)
+}
+
+// shareGroup reports whether two users are both members of a group that isn't archived.
+func (s *SettlementService) shareGroup(ctx context.Context, a uuid.UUID, b string) (bool, error) {
+	theirs, err := s.repo.GetGroupsByUser(ctx, b, false)
+	if err != nil { return false, err }
+	ours, err := s.repo.GetGroupsByUser(ctx, a.String(), false)
+	if err != nil { return false, err }
+	for _, g := range ours {
+		for _, t := range theirs {
+			if g.ID == t.ID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// SetPaymentMethods validates and replaces all of a user's payment methods. Each kind
+// of fee only uses its own fields: FLAT a flat_fee, PERCENT a percent, and FREE_UP_TO a
+// free_limit with a percent charged above it.
+func (s *SettlementService) SetPaymentMethods(ctx context.Context, userID uuid.UUID, methods []models.PaymentMethod) error {
+	seen := make(map[string]bool)
+	for i := range methods {
+		m := &methods[i]
+		m.UserID = userID
+		m.Name = strings.TrimSpace(m.Name)
+		if m.Name == "" {
+			return invalid(errors.New("payment method name is required"))
+		}
+		if seen[m.Name] {
+			return invalid(fmt.Errorf("payment method %q listed twice", m.Name))
+		}
+		seen[m.Name] = true
+
+		if m.Currency == "" {
+			m.Currency = models.DefaultCurrency
+		}
+		m.Currency = models.NormalizeCurrency(m.Currency)
+		if _, ok := models.CurrencyExponent(m.Currency); !ok {
+			return invalid(fmt.Errorf("%w: %q", models.ErrUnknownCurrency, m.Currency))
+		}
+		if m.FlatFee.IsNegative() || m.Percent.IsNegative() || m.FreeLimit.IsNegative() {
+			return invalid(fmt.Errorf("payment method %q: fees cannot be negative", m.Name))
+		}
+		if m.Percent.GreaterThan(decimal.NewFromInt(100)) {
+			return invalid(fmt.Errorf("payment method %q: percent cannot be over 100", m.Name))
+		}
+
+		switch m.FeeKind {
+		case models.FeeFlat:
+			if !m.Percent.IsZero() || !m.FreeLimit.IsZero() {
+				return invalid(fmt.Errorf("payment method %q: a FLAT fee only takes flat_fee", m.Name))
+			}
+		case models.FeePercent:
+			if !m.FlatFee.IsZero() || !m.FreeLimit.IsZero() {
+				return invalid(fmt.Errorf("payment method %q: a PERCENT fee only takes percent", m.Name))
+			}
+		case models.FeeFreeUpTo:
+			if !m.FlatFee.IsZero() || !m.FreeLimit.IsPositive() {
+				return invalid(fmt.Errorf("payment method %q: a FREE_UP_TO fee needs a positive free_limit and no flat_fee", m.Name))
+			}
+		default:
+			return invalid(fmt.Errorf("payment method %q: unknown fee kind %q", m.Name, m.FeeKind))
+		}
+	}
+
+	// Fees must be convertible into every group the user is in to be priced there
+	groups, err := s.repo.GetGroupsByUser(ctx, userID.String(), false)
+	if err != nil {
+		return err
+	}
+	for _, m := range methods {
+		for _, g := range groups {
+			if _, err := s.fx.Rate(ctx, m.Currency, g.BaseCurrency, time.Now()); err != nil {
+				var noRate *ValidationError
+				if errors.As(err, &noRate) {
+					return invalid(fmt.Errorf("payment method %q: no exchange rate from %s to %s, the currency of group %q", m.Name, m.Currency, g.BaseCurrency, g.Name))
+				}
+				return err
+			}
+		}
+	}
+
+	return s.repo.ReplacePaymentMethods(ctx, userID.String(), methods)
+}
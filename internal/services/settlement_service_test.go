@@ -0,0 +1,348 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/algorithms"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func TestCalculateBalancesAppliesPayments(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Charlie")
+	alice, bob, charlie := repo.user("Alice"), repo.user("Bob"), repo.user("Charlie")
+	repo.expenses = []models.Expense{{
+		PayerID: alice,
+		Amount:  decimal.NewFromInt(90),
+		Payers:  []models.ExpensePayer{{UserID: alice, Amount: decimal.NewFromInt(90)}},
+		Splits: []models.ExpenseSplit{
+			{UserID: alice, Amount: decimal.NewFromInt(30)},
+			{UserID: bob, Amount: decimal.NewFromInt(30)},
+			{UserID: charlie, Amount: decimal.NewFromInt(30)},
+		},
+	}}
+
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+
+	err := svc.RecordPayment(ctx, &models.SettlementPayment{GroupID: repo.group.ID, FromUserID: bob, ToUserID: alice, Amount: decimal.NewFromInt(30)})
+	assert.NoError(t, err)
+
+	balances, err := svc.CalculateBalances(ctx, repo.group.ID.String(), nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, balances[alice].Equal(decimal.NewFromInt(30)))
+	assert.True(t, balances[bob].IsZero())
+	assert.True(t, balances[charlie].Equal(decimal.NewFromInt(-30)))
+
+	settlement, err := svc.GetSettlement(ctx, repo.group.ID.String(), nil, nil, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, settlement.TotalTransactions)
+}
+
+func TestBalancesAreKeyedByUserID(t *testing.T) {
+	// Two members sharing a username still get separate balances
+	repo := newFakeRepo("Alice", "Bob")
+	repo.members = append(repo.members, models.User{ID: uuid.New(), Username: "Alice"})
+	alice, bob, otherAlice := repo.members[0].ID, repo.members[1].ID, repo.members[2].ID
+	repo.expenses = []models.Expense{{
+		PayerID: bob,
+		Amount:  decimal.NewFromInt(60),
+		Splits: []models.ExpenseSplit{
+			{UserID: alice, Amount: decimal.NewFromInt(20)},
+			{UserID: bob, Amount: decimal.NewFromInt(20)},
+			{UserID: otherAlice, Amount: decimal.NewFromInt(20)},
+		},
+	}}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+
+	balances, err := svc.GroupBalances(ctx, repo.group.ID.String(), nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, balances.Balances, 3)
+	for _, b := range balances.Balances {
+		if b.User.ID == bob {
+			assert.True(t, b.Balance.Equal(decimal.NewFromInt(40)))
+		} else {
+			assert.Equal(t, "Alice", b.User.Username)
+			assert.True(t, b.Balance.Equal(decimal.NewFromInt(-20)))
+		}
+	}
+
+	resp, err := svc.GetSettlement(ctx, repo.group.ID.String(), nil, nil, "", "")
+	assert.NoError(t, err)
+	assert.Len(t, resp.Transactions, 2)
+	for _, tx := range resp.Transactions {
+		assert.Equal(t, bob, tx.To.ID)
+		assert.Equal(t, "Bob", tx.To.Username)
+	}
+}
+
+func TestBalancesRejectNonMembers(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+	repo.expenses = []models.Expense{{
+		PayerID: alice,
+		Amount:  decimal.NewFromInt(30),
+		Splits: []models.ExpenseSplit{
+			{UserID: alice, Amount: decimal.NewFromInt(10)},
+			{UserID: bob, Amount: decimal.NewFromInt(10)},
+			{UserID: uuid.New(), Amount: decimal.NewFromInt(10)},
+		},
+	}}
+	svc := NewSettlementService(repo, NewFXService(repo))
+
+	_, err := svc.CalculateBalances(context.Background(), repo.group.ID.String(), nil, nil)
+	assert.ErrorIs(t, err, ErrNonMemberParticipant)
+
+	repo.expenses = nil
+	repo.payments = []models.SettlementPayment{{ID: uuid.New(), GroupID: repo.group.ID, FromUserID: uuid.New(), ToUserID: bob, Amount: decimal.NewFromInt(5)}}
+	_, err = svc.GetSettlement(context.Background(), repo.group.ID.String(), nil, nil, "", "")
+	assert.ErrorIs(t, err, ErrNonMemberParticipant)
+}
+
+func TestRecordPaymentValidation(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	svc := NewSettlementService(repo, NewFXService(repo))
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+
+	err := svc.RecordPayment(context.Background(), &models.SettlementPayment{GroupID: repo.group.ID, FromUserID: alice, ToUserID: alice, Amount: decimal.NewFromInt(10)})
+	assert.EqualError(t, err, "payer and recipient must be different")
+
+	err = svc.RecordPayment(context.Background(), &models.SettlementPayment{GroupID: repo.group.ID, FromUserID: alice, ToUserID: bob, Amount: decimal.NewFromFloat(10.005)})
+	assert.EqualError(t, err, "INR amounts allow at most 2 decimal places")
+
+	var verr *ValidationError
+	assert.ErrorAs(t, err, &verr)
+	assert.Empty(t, repo.payments)
+}
+
+func TestSettlementStrategies(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Charlie")
+	alice, bob, charlie := repo.user("Alice"), repo.user("Bob"), repo.user("Charlie")
+	repo.expenses = []models.Expense{{
+		PayerID: alice,
+		Amount:  decimal.NewFromInt(90),
+		Payers:  []models.ExpensePayer{{UserID: alice, Amount: decimal.NewFromInt(90)}},
+		Splits: []models.ExpenseSplit{
+			{UserID: alice, Amount: decimal.NewFromInt(30)},
+			{UserID: bob, Amount: decimal.NewFromInt(30)},
+			{UserID: charlie, Amount: decimal.NewFromInt(30)},
+		},
+	}}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	resp, err := svc.GetSettlement(ctx, groupID, nil, nil, "", "minimal")
+	assert.NoError(t, err)
+	assert.Equal(t, "minimal", resp.Strategy)
+	assert.Equal(t, 2, resp.TotalTransactions)
+
+	_, err = svc.GetSettlement(ctx, groupID, nil, nil, "", "quantum")
+	var verr *ValidationError
+	assert.ErrorAs(t, err, &verr)
+
+	cmp, err := svc.CompareStrategies(ctx, groupID)
+	assert.NoError(t, err)
+	assert.Equal(t, "naive", cmp.Baseline)
+	assert.Equal(t, len(algorithms.Strategies()), len(cmp.Strategies))
+	for _, st := range cmp.Strategies {
+		assert.Equal(t, 2, st.TransactionCount, st.Strategy)
+		assert.Equal(t, 1, st.MaxTransfersPerPerson, st.Strategy)
+		assert.True(t, st.TotalVolume.Equal(decimal.NewFromInt(60)), st.Strategy)
+	}
+}
+
+func TestSettlementHonoursPaymentConstraints(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Charlie")
+	alice, bob, charlie := repo.user("Alice"), repo.user("Bob"), repo.user("Charlie")
+	repo.expenses = []models.Expense{{
+		PayerID: alice,
+		Amount:  decimal.NewFromInt(90),
+		Payers:  []models.ExpensePayer{{UserID: alice, Amount: decimal.NewFromInt(90)}},
+		Splits: []models.ExpenseSplit{
+			{UserID: alice, Amount: decimal.NewFromInt(30)},
+			{UserID: bob, Amount: decimal.NewFromInt(30)},
+			{UserID: charlie, Amount: decimal.NewFromInt(30)},
+		},
+	}}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	err := svc.SetPaymentConstraints(ctx, groupID, &models.PaymentConstraints{
+		ReceiveVia: []models.ReceiveHub{{UserID: alice, HubUserID: charlie}},
+	})
+	assert.NoError(t, err)
+
+	resp, err := svc.GetSettlement(ctx, groupID, nil, nil, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "constrained", resp.Strategy)
+	for _, tx := range resp.Transactions {
+		if tx.To.ID == alice {
+			assert.Equal(t, charlie, tx.From.ID)
+		}
+	}
+
+	// Asking for a strategy that ignores the network is an error
+	_, err = svc.GetSettlement(ctx, groupID, nil, nil, "", "greedy")
+	var verr *ValidationError
+	assert.ErrorAs(t, err, &verr)
+
+	cmp, err := svc.CompareStrategies(ctx, groupID)
+	assert.NoError(t, err)
+	for _, st := range cmp.Strategies {
+		if st.Strategy == "greedy" {
+			assert.Equal(t, 1, st.Violations)
+		}
+	}
+
+	// Charlie can't pay Alice any more, so nobody can reach her
+	err = svc.SetPaymentConstraints(ctx, groupID, &models.PaymentConstraints{
+		Pairs:      []models.PairConstraint{{UserA: charlie, UserB: alice, Kind: models.PairForbidden}},
+		ReceiveVia: []models.ReceiveHub{{UserID: alice, HubUserID: charlie}},
+	})
+	assert.NoError(t, err)
+	assert.True(t, repo.constraints.Pairs[0].UserA.String() < repo.constraints.Pairs[0].UserB.String())
+	_, err = svc.GetSettlement(ctx, groupID, nil, nil, "", "")
+	assert.ErrorAs(t, err, &verr)
+	assert.ErrorIs(t, err, algorithms.ErrNoValidPlan)
+
+	err = svc.SetPaymentConstraints(ctx, groupID, &models.PaymentConstraints{
+		ReceiveVia: []models.ReceiveHub{{UserID: alice, HubUserID: alice}},
+	})
+	assert.ErrorAs(t, err, &verr)
+}
+
+func TestSettlementReportsFees(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob", "Carol")
+	alice, bob, carol := repo.user("Alice"), repo.user("Bob"), repo.user("Carol")
+	repo.expenses = []models.Expense{{
+		PayerID: carol,
+		Amount:  decimal.NewFromInt(100),
+		Payers:  []models.ExpensePayer{{UserID: carol, Amount: decimal.NewFromInt(100)}},
+		Splits:  []models.ExpenseSplit{{UserID: alice, Amount: decimal.NewFromInt(100)}},
+	}}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	wire := models.PaymentMethod{Name: "wire", FeeKind: models.FeePercent, Percent: decimal.NewFromInt(3)}
+	wallet := models.PaymentMethod{Name: "wallet", FeeKind: models.FeeFlat, FlatFee: decimal.RequireFromString("0.50")}
+	upi := models.PaymentMethod{Name: "upi", FeeKind: models.FeeFreeUpTo, FreeLimit: decimal.NewFromInt(1000), Percent: decimal.NewFromInt(1)}
+	assert.NoError(t, svc.SetPaymentMethods(ctx, alice, []models.PaymentMethod{wire, wallet}))
+	assert.NoError(t, svc.SetPaymentMethods(ctx, bob, []models.PaymentMethod{wallet, upi}))
+	assert.NoError(t, svc.SetPaymentMethods(ctx, carol, []models.PaymentMethod{wire, upi}))
+
+	resp, err := svc.GetSettlement(ctx, groupID, nil, nil, "", "greedy")
+	assert.NoError(t, err)
+	txs := resp.Transactions
+	assert.Equal(t, "wire", txs[0].Method)
+	assert.Equal(t, "3.00", txs[0].Fee.StringFixed(2))
+	assert.Equal(t, "3", resp.TotalFees)
+
+	resp, err = svc.GetSettlement(ctx, groupID, nil, nil, "", "min_fee")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, resp.TotalTransactions)
+	assert.Equal(t, "0.5", resp.TotalFees)
+
+	cmp, err := svc.CompareStrategies(ctx, groupID)
+	assert.NoError(t, err)
+	for _, st := range cmp.Strategies {
+		if st.Strategy == "min_fee" {
+			assert.True(t, st.TotalFees.Equal(decimal.RequireFromString("0.5")))
+		}
+	}
+
+	var verr *ValidationError
+	err = svc.SetPaymentMethods(ctx, alice, []models.PaymentMethod{{Name: "wire", FeeKind: models.FeeFlat, Percent: decimal.NewFromInt(1)}})
+	assert.ErrorAs(t, err, &verr)
+	err = svc.SetPaymentMethods(ctx, alice, []models.PaymentMethod{wire, wire})
+	assert.ErrorAs(t, err, &verr)
+	err = svc.SetPaymentMethods(ctx, alice, []models.PaymentMethod{{Name: "upi", FeeKind: models.FeeFreeUpTo}})
+	assert.ErrorAs(t, err, &verr)
+}
+
+func TestFeesAreRoundedTheSameEverywhere(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+	amount := decimal.RequireFromString("33.33")
+	repo.expenses = []models.Expense{{
+		PayerID: bob,
+		Amount:  amount,
+		Payers:  []models.ExpensePayer{{UserID: bob, Amount: amount}},
+		Splits:  []models.ExpenseSplit{{UserID: alice, Amount: amount}},
+	}}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+
+	// 1.5% of 33.33 is 0.49995, which can only be charged as 0.50
+	wire := models.PaymentMethod{Name: "wire", FeeKind: models.FeePercent, Percent: decimal.RequireFromString("1.5")}
+	assert.NoError(t, svc.SetPaymentMethods(ctx, alice, []models.PaymentMethod{wire}))
+	assert.NoError(t, svc.SetPaymentMethods(ctx, bob, []models.PaymentMethod{wire}))
+
+	resp, err := svc.GetSettlement(ctx, repo.group.ID.String(), nil, nil, "", "min_fee")
+	assert.NoError(t, err)
+	assert.Equal(t, "0.5", resp.TotalFees)
+
+	cmp, err := svc.CompareStrategies(ctx, repo.group.ID.String())
+	assert.NoError(t, err)
+	for _, st := range cmp.Strategies {
+		assert.Equal(t, "0.5", st.TotalFees.String(), st.Strategy)
+	}
+}
+
+func TestMethodWithoutRateLeavesFeeUnknown(t *testing.T) {
+	repo := newFakeRepo("Alice", "Carol")
+	alice, carol := repo.user("Alice"), repo.user("Carol")
+	repo.expenses = []models.Expense{{
+		PayerID: carol,
+		Amount:  decimal.NewFromInt(100),
+		Payers:  []models.ExpensePayer{{UserID: carol, Amount: decimal.NewFromInt(100)}},
+		Splits:  []models.ExpenseSplit{{UserID: alice, Amount: decimal.NewFromInt(100)}},
+	}}
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+	groupID := repo.group.ID.String()
+
+	wise := models.PaymentMethod{Name: "wise", FeeKind: models.FeePercent, Percent: decimal.NewFromInt(1), Currency: "EUR"}
+	var verr *ValidationError
+	assert.ErrorAs(t, svc.SetPaymentMethods(ctx, alice, []models.PaymentMethod{wise}), &verr)
+
+	// Saved while a rate was loaded, which has since gone
+	repo.rates = []models.FXRate{{Date: "2026-10-01", Base: "EUR", Quote: "INR", Rate: decimal.NewFromInt(90)}}
+	assert.NoError(t, svc.SetPaymentMethods(ctx, alice, []models.PaymentMethod{wise}))
+	assert.NoError(t, svc.SetPaymentMethods(ctx, carol, []models.PaymentMethod{wise}))
+	repo.rates = nil
+
+	for _, strategy := range []string{"greedy", "min_fee"} {
+		resp, err := svc.GetSettlement(ctx, groupID, nil, nil, "", strategy)
+		if assert.NoError(t, err, strategy) && assert.Len(t, resp.Transactions, 1) {
+			assert.Equal(t, "wise", resp.Transactions[0].Method)
+			assert.True(t, resp.Transactions[0].FeeUnknown)
+		}
+	}
+	_, err := svc.CompareStrategies(ctx, groupID)
+	assert.NoError(t, err)
+}
+
+func TestPaymentMethodsAreOnlyShownToGroupMates(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+	svc := NewSettlementService(repo, NewFXService(repo))
+	ctx := context.Background()
+
+	wire := models.PaymentMethod{Name: "wire", FeeKind: models.FeePercent, Percent: decimal.NewFromInt(3)}
+	assert.NoError(t, svc.SetPaymentMethods(ctx, alice, []models.PaymentMethod{wire}))
+
+	for _, viewer := range []uuid.UUID{alice, bob} {
+		methods, err := svc.GetPaymentMethods(ctx, viewer, alice.String())
+		assert.NoError(t, err)
+		assert.Len(t, methods, 1)
+	}
+	_, err := svc.GetPaymentMethods(ctx, uuid.New(), alice.String())
+	assert.Equal(t, "permission_denied", codeOf(err))
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/user/debt-optimization-engine/internal/models"
+	"github.com/user/debt-optimization-engine/internal/repositories"
+)
+
+// Codes for field errors. Clients match on them, so they must not change.
+const (
+	CodeInvalidID    = "invalid_id"
+	CodeNotMember    = "not_member"
+	CodeRequired     = "required"
+	CodeInvalidValue = "invalid_value"
+)
+
+// FieldError is a problem with one field of a request. Field is the field's path in
+// the request body, such as "splits[2].user_id".
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// FieldErrors lists every field of a request that was rejected. It is returned
+// wrapped in a *ValidationError, so a request with several mistakes reports them all.
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ParseID parses an ID from a request, reporting a malformed one against field.
+func ParseID(field, value string) (uuid.UUID, error) {
+	id, err := uuid.Parse(value)
+	if err != nil {
+		return uuid.Nil, invalid(FieldErrors{{Field: field, Code: CodeInvalidID, Message: fmt.Sprintf("%q is not a valid ID", value)}})
+	}
+	return id, nil
+}
+
+// DateRange parses the optional from and to days (YYYY-MM-DD) of a request. to names
+// the last day to include, so the end returned is the midnight after it, and only
+// times before it are in range.
+func DateRange(from, to string) (start, end *time.Time, err error) {
+	start, end, errs := dateRange(from, to)
+	if len(errs) > 0 {
+		return nil, nil, invalid(errs)
+	}
+	return start, end, nil
+}
+
+func dateRange(from, to string) (start, end *time.Time, errs FieldErrors) {
+	day := func(field, value string) *time.Time {
+		if value == "" {
+			return nil
+		}
+		t, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			errs = append(errs, FieldError{Field: field, Code: CodeInvalidValue, Message: fmt.Sprintf("%q is not a date (YYYY-MM-DD)", value)})
+			return nil
+		}
+		return &t
+	}
+	start = day("from", from)
+	if last := day("to", to); last != nil {
+		next := last.AddDate(0, 0, 1)
+		end = &next
+	}
+	return start, end, errs
+}
+
+// Required reports that field was left out of a request.
+func Required(field string) error {
+	return invalid(FieldErrors{{Field: field, Code: CodeRequired, Message: "is required"}})
+}
+
+// membership is a group and the users in it, loaded once to check a request against.
+type membership struct {
+	group   *models.Group
+	members map[uuid.UUID]bool
+}
+
+func loadMembership(ctx context.Context, repo repositories.Repository, groupID uuid.UUID) (*membership, error) {
+	// A missing group is a 404 (group_not_found), as it is everywhere else
+	group, err := repo.GetGroup(ctx, groupID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := repo.GetGroupMembers(ctx, groupID.String())
+	if err != nil {
+		return nil, err
+	}
+	m := &membership{group: group, members: make(map[uuid.UUID]bool, len(members))}
+	for _, u := range members {
+		m.members[u.ID] = true
+	}
+	return m, nil
+}
+
+// check adds a not_member error for field unless id belongs to the group. Unset IDs
+// are left to the checks that require them.
+func (m *membership) check(errs FieldErrors, field string, id uuid.UUID) FieldErrors {
+	if id == uuid.Nil || m.members[id] {
+		return errs
+	}
+	return append(errs, FieldError{
+		Field:   field,
+		Code:    CodeNotMember,
+		Message: fmt.Sprintf("user %s is not a member of this group", id),
+	})
+}
+
+// checkExpense reports every payer and participant of an expense, as it was sent, who
+// is not a member of the group.
+func (m *membership) checkExpense(e *models.Expense) FieldErrors {
+	var errs FieldErrors
+	errs = m.check(errs, "payer_id", e.PayerID)
+	for i, p := range e.Payers {
+		errs = m.check(errs, fmt.Sprintf("payers[%d].user_id", i), p.UserID)
+	}
+	for i, s := range e.Splits {
+		errs = m.check(errs, fmt.Sprintf("splits[%d].user_id", i), s.UserID)
+	}
+	for i, item := range e.Items {
+		for j, id := range item.Participants {
+			errs = m.check(errs, fmt.Sprintf("items[%d].participants[%d]", i, j), id)
+		}
+	}
+	return errs
+}
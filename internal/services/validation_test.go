@@ -0,0 +1,96 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/user/debt-optimization-engine/internal/models"
+)
+
+func TestCreateExpenseRejectsNonMembers(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	alice, bob := repo.user("Alice"), repo.user("Bob")
+	stranger := uuid.New()
+	svc := NewExpenseService(repo, NewFXService(repo))
+	ctx := context.Background()
+
+	expense := &models.Expense{
+		GroupID:   repo.group.ID,
+		PayerID:   stranger,
+		Amount:    decimal.NewFromInt(90),
+		SplitType: models.SplitEqual,
+		Splits:    []models.ExpenseSplit{{UserID: alice}, {UserID: bob}, {UserID: stranger}},
+	}
+	err := svc.CreateExpense(ctx, expense, nil)
+	var verr *ValidationError
+	assert.ErrorAs(t, err, &verr)
+	var fields FieldErrors
+	assert.ErrorAs(t, err, &fields)
+	assert.Equal(t, FieldErrors{
+		{Field: "payer_id", Code: CodeNotMember, Message: "user " + stranger.String() + " is not a member of this group"},
+		{Field: "splits[2].user_id", Code: CodeNotMember, Message: "user " + stranger.String() + " is not a member of this group"},
+	}, fields)
+	assert.Empty(t, repo.expenses)
+
+	// A missing group is not found, not a bad field
+	expense.GroupID = uuid.New()
+	err = svc.CreateExpense(ctx, expense, nil)
+	assert.NotErrorAs(t, err, &fields)
+	assert.Equal(t, "group_not_found", codeOf(err))
+
+	expense.GroupID = repo.group.ID
+	expense.PayerID = alice
+	expense.Splits = expense.Splits[:2]
+	assert.NoError(t, svc.CreateExpense(ctx, expense, nil))
+	assert.Len(t, repo.expenses, 1)
+}
+
+func TestRecordPaymentRejectsNonMembers(t *testing.T) {
+	repo := newFakeRepo("Alice", "Bob")
+	svc := NewSettlementService(repo, NewFXService(repo))
+
+	err := svc.RecordPayment(context.Background(), &models.SettlementPayment{GroupID: repo.group.ID, FromUserID: repo.user("Alice"), ToUserID: uuid.New(), Amount: decimal.NewFromInt(10)})
+	var fields FieldErrors
+	assert.ErrorAs(t, err, &fields)
+	assert.Len(t, fields, 1)
+	assert.Equal(t, "to_user_id", fields[0].Field)
+	assert.Empty(t, repo.payments)
+}
+
+func TestParseID(t *testing.T) {
+	_, err := ParseID("group_id", "not-a-uuid")
+	var fields FieldErrors
+	assert.ErrorAs(t, err, &fields)
+	assert.Equal(t, CodeInvalidID, fields[0].Code)
+	assert.EqualError(t, err, `group_id: "not-a-uuid" is not a valid ID`)
+
+	id := uuid.New()
+	parsed, err := ParseID("group_id", id.String())
+	assert.NoError(t, err)
+	assert.Equal(t, id, parsed)
+}
+
+func TestDateRange(t *testing.T) {
+	from, to, err := DateRange("2026-10-16", "2026-10-17")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC), *from)
+	// The whole of the 17th is in range
+	assert.Equal(t, time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC), *to)
+
+	from, to, err = DateRange("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, from)
+	assert.Nil(t, to)
+
+	var fields FieldErrors
+	_, _, err = DateRange("yesterday", "17/10/2026")
+	assert.ErrorAs(t, err, &fields)
+	if assert.Len(t, fields, 2) {
+		assert.Equal(t, "from", fields[0].Field)
+		assert.Equal(t, CodeInvalidValue, fields[1].Code)
+	}
+}
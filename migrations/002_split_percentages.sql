@@ -0,0 +1,3 @@
+-- Store the percentages PERCENTAGE expenses were entered with
+
+ALTER TABLE expense_splits ADD COLUMN percentage DECIMAL(7,4) CHECK (percentage >= 0 AND percentage <= 100);
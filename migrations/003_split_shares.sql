@@ -0,0 +1,3 @@
+-- Store the weights SHARES expenses were entered with, so the split can be edited later
+
+ALTER TABLE expense_splits ADD COLUMN shares DECIMAL(12,4) CHECK (shares >= 0);
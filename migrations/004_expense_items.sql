@@ -0,0 +1,34 @@
+-- Itemized receipts: line items, receipt-level adjustments and what each person was charged
+
+CREATE TABLE expense_items (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    expense_id UUID REFERENCES expenses(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    description TEXT,
+    amount DECIMAL(18,2) NOT NULL CHECK (amount > 0)
+);
+
+CREATE TABLE expense_item_shares (
+    item_id UUID REFERENCES expense_items(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    amount DECIMAL(18,2) NOT NULL,
+    PRIMARY KEY (item_id, user_id)
+);
+
+CREATE TABLE expense_adjustments (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    expense_id UUID REFERENCES expenses(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    kind TEXT NOT NULL, -- TAX, SERVICE_CHARGE, TIP, DISCOUNT
+    amount DECIMAL(18,2) NOT NULL CHECK (amount > 0)
+);
+
+CREATE TABLE expense_adjustment_shares (
+    adjustment_id UUID REFERENCES expense_adjustments(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    amount DECIMAL(18,2) NOT NULL,
+    PRIMARY KEY (adjustment_id, user_id)
+);
+
+CREATE INDEX idx_expense_items_expense_id ON expense_items(expense_id);
+CREATE INDEX idx_expense_adjustments_expense_id ON expense_adjustments(expense_id);
@@ -0,0 +1,14 @@
+-- Multi-payer expenses. expenses.payer_id is kept as the primary (first) payer.
+
+CREATE TABLE expense_payers (
+    expense_id UUID REFERENCES expenses(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    amount DECIMAL(18,2) NOT NULL CHECK (amount > 0),
+    PRIMARY KEY (expense_id, user_id)
+);
+
+CREATE INDEX idx_expense_payers_user_id ON expense_payers(user_id);
+
+-- Existing expenses were paid in full by their single payer
+INSERT INTO expense_payers (expense_id, user_id, amount)
+SELECT id, payer_id, amount FROM expenses WHERE payer_id IS NOT NULL;
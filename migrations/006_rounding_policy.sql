@@ -0,0 +1,3 @@
+-- Per-group choice of who absorbs leftover cents when an amount is split
+
+ALTER TABLE groups ADD COLUMN rounding_policy TEXT NOT NULL DEFAULT 'LAST_PARTICIPANT'; -- LAST_PARTICIPANT, LARGEST_REMAINDER, ROTATE, SEEDED_RANDOM, PAYER_ABSORBS
@@ -0,0 +1,13 @@
+-- Per-currency precision: expenses record their ISO-4217 currency, and amount columns
+-- are widened to 3 decimal places so KWD/BHD fit. The API rejects amounts with more
+-- precision than the currency allows before they get here.
+
+ALTER TABLE expenses ADD COLUMN currency TEXT NOT NULL DEFAULT 'INR';
+
+ALTER TABLE expenses ALTER COLUMN amount TYPE DECIMAL(18,3);
+ALTER TABLE expense_splits ALTER COLUMN amount TYPE DECIMAL(18,3);
+ALTER TABLE expense_payers ALTER COLUMN amount TYPE DECIMAL(18,3);
+ALTER TABLE expense_items ALTER COLUMN amount TYPE DECIMAL(18,3);
+ALTER TABLE expense_item_shares ALTER COLUMN amount TYPE DECIMAL(18,3);
+ALTER TABLE expense_adjustments ALTER COLUMN amount TYPE DECIMAL(18,3);
+ALTER TABLE expense_adjustment_shares ALTER COLUMN amount TYPE DECIMAL(18,3);
@@ -0,0 +1,18 @@
+-- Multi-currency groups: each group has a base currency, expenses remember the rate
+-- used to convert them into it, and rates come from a local table keyed by date.
+
+ALTER TABLE groups ADD COLUMN base_currency TEXT NOT NULL DEFAULT 'INR';
+
+-- 1 unit of the expense currency = exchange_rate units of the group's base currency
+ALTER TABLE expenses ADD COLUMN exchange_rate DECIMAL(20,10) NOT NULL DEFAULT 1 CHECK (exchange_rate > 0);
+
+-- 1 unit of base = rate units of quote on rate_date
+CREATE TABLE fx_rates (
+    rate_date DATE NOT NULL,
+    base TEXT NOT NULL,
+    quote TEXT NOT NULL,
+    rate DECIMAL(20,10) NOT NULL CHECK (rate > 0),
+    PRIMARY KEY (rate_date, base, quote)
+);
+
+CREATE INDEX idx_fx_rates_pair_date ON fx_rates(base, quote, rate_date DESC);
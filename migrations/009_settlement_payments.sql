@@ -0,0 +1,14 @@
+-- Payments made to settle up. Amounts are in the group's base currency and are
+-- applied to balances, so balances and settlements show what is still outstanding.
+
+CREATE TABLE settlement_payments (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+    from_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    to_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    amount DECIMAL(18,3) NOT NULL CHECK (amount > 0),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (from_user_id <> to_user_id)
+);
+
+CREATE INDEX idx_settlement_payments_group_id ON settlement_payments(group_id);
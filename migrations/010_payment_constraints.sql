@@ -0,0 +1,20 @@
+-- Who may pay whom when settling up. Pair constraints are stored once per unordered
+-- pair (user_a < user_b) and apply in both directions.
+
+CREATE TABLE payment_pair_constraints (
+    group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+    user_a UUID REFERENCES users(id) ON DELETE CASCADE,
+    user_b UUID REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('FORBIDDEN', 'PREFERRED')),
+    PRIMARY KEY (group_id, user_a, user_b),
+    CHECK (user_a < user_b)
+);
+
+-- A member who only accepts money through another member (the hub), who forwards it.
+CREATE TABLE payment_receive_hubs (
+    group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    hub_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, user_id),
+    CHECK (user_id <> hub_user_id)
+);
@@ -0,0 +1,15 @@
+-- How each user can send and receive money, and what sending costs. Two users can pay
+-- each other with a method if both have one of the same name; the sender's fee applies.
+-- flat_fee and free_limit are in the method's currency.
+
+CREATE TABLE user_payment_methods (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(50) NOT NULL,
+    fee_kind VARCHAR(20) NOT NULL CHECK (fee_kind IN ('FLAT', 'PERCENT', 'FREE_UP_TO')),
+    flat_fee DECIMAL(18,3) NOT NULL DEFAULT 0 CHECK (flat_fee >= 0),
+    percent DECIMAL(7,4) NOT NULL DEFAULT 0 CHECK (percent >= 0 AND percent <= 100),
+    free_limit DECIMAL(18,3) NOT NULL DEFAULT 0 CHECK (free_limit >= 0),
+    currency TEXT NOT NULL DEFAULT 'INR',
+    UNIQUE (user_id, name)
+);
@@ -0,0 +1,30 @@
+-- Saved settlement plans. A group has at most one plan that isn't SUPERSEDED; its
+-- transfers keep their IDs while members pay them off.
+
+CREATE TABLE settlement_plans (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+    strategy TEXT NOT NULL,
+    currency TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'ACTIVE' CHECK (status IN ('ACTIVE', 'COMPLETED', 'SUPERSEDED')),
+    version INT NOT NULL DEFAULT 1,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX idx_settlement_plans_current ON settlement_plans(group_id) WHERE status <> 'SUPERSEDED';
+
+CREATE TABLE settlement_plan_transfers (
+    id UUID PRIMARY KEY,
+    plan_id UUID REFERENCES settlement_plans(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    from_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    to_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    amount DECIMAL(18,3) NOT NULL CHECK (amount > 0),
+    paid_amount DECIMAL(18,3) NOT NULL DEFAULT 0 CHECK (paid_amount >= 0 AND paid_amount <= amount),
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'PARTIALLY_PAID', 'PAID', 'DISPUTED')),
+    note TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_settlement_plan_transfers_plan_id ON settlement_plan_transfers(plan_id);
@@ -0,0 +1,25 @@
+-- Editable expenses. Every change writes the expense as it was afterwards to
+-- expense_revisions, so any two versions can be compared. Deleting only sets
+-- deleted_at; deleted expenses are left out of balances and can be restored.
+
+ALTER TABLE expenses ADD COLUMN version INT NOT NULL DEFAULT 1;
+ALTER TABLE expenses ADD COLUMN updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE expenses ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+UPDATE expenses SET updated_at = created_at;
+
+CREATE TABLE expense_revisions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    expense_id UUID REFERENCES expenses(id) ON DELETE CASCADE,
+    version INT NOT NULL,
+    action VARCHAR(20) NOT NULL CHECK (action IN ('CREATED', 'UPDATED', 'DELETED', 'RESTORED')),
+    changed_by UUID REFERENCES users(id) ON DELETE SET NULL, -- NULL when not known
+    snapshot JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (expense_id, version)
+);
+
+CREATE INDEX idx_expenses_group_live ON expenses(group_id) WHERE deleted_at IS NULL;
+
+-- Expenses created before this migration get their first revision the first time they
+-- are changed, from the expense as it was stored.
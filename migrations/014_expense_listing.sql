@@ -0,0 +1,2 @@
+-- Expense listings page through a group's expenses by (created_at, id).
+CREATE INDEX idx_expenses_group_created ON expenses(group_id, created_at, id);
@@ -0,0 +1,15 @@
+-- Members can leave or be removed. Leaving sets left_at instead of deleting the row,
+-- so former members still show up on the expenses they were part of, and rejoining
+-- adds a new row. Only one row per user may be current.
+
+ALTER TABLE group_members DROP CONSTRAINT group_members_pkey;
+ALTER TABLE group_members ADD COLUMN id UUID PRIMARY KEY DEFAULT uuid_generate_v4();
+ALTER TABLE group_members ADD COLUMN left_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE group_members ADD COLUMN removed_by UUID REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE UNIQUE INDEX group_members_current_key ON group_members(group_id, user_id) WHERE left_at IS NULL;
+
+-- A leaving member's balance is moved onto the members who stay with payments that
+-- say why they were made.
+ALTER TABLE settlement_payments ADD COLUMN kind VARCHAR(20) NOT NULL DEFAULT 'PAYMENT'
+    CHECK (kind IN ('PAYMENT', 'BALANCE_TRANSFER', 'WRITE_OFF'));
@@ -0,0 +1,18 @@
+-- Groups are ACTIVE until their books are closed. Closing creates a final settlement
+-- plan and moves the group to SETTLING; once that plan is paid it is ARCHIVED. Every
+-- change of status, including reopening, is logged.
+
+ALTER TABLE groups ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'ACTIVE'
+    CHECK (status IN ('ACTIVE', 'SETTLING', 'ARCHIVED'));
+
+CREATE TABLE group_status_changes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+    from_status VARCHAR(20) NOT NULL,
+    to_status VARCHAR(20) NOT NULL,
+    changed_by UUID REFERENCES users(id) ON DELETE SET NULL, -- NULL when the change was automatic
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_group_status_changes_group_id ON group_status_changes(group_id);
@@ -0,0 +1,24 @@
+-- Members have a role in their group: OWNER, ADMIN, MEMBER or VIEWER. Each group has
+-- exactly one current owner.
+
+ALTER TABLE group_members ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'MEMBER'
+    CHECK (role IN ('OWNER', 'ADMIN', 'MEMBER', 'VIEWER'));
+
+CREATE UNIQUE INDEX group_members_owner_key ON group_members(group_id) WHERE role = 'OWNER' AND left_at IS NULL;
+
+-- Groups never recorded who created them, so the earliest current member of each
+-- existing group, normally whoever set it up, becomes its owner.
+UPDATE group_members gm SET role = 'OWNER'
+FROM (
+    SELECT DISTINCT ON (group_id) id FROM group_members
+    WHERE left_at IS NULL ORDER BY group_id, joined_at, id
+) first
+WHERE gm.id = first.id;
+
+-- Who added an expense, which decides who may edit it. Existing expenses take the
+-- author of their first revision, where one was recorded.
+ALTER TABLE expenses ADD COLUMN created_by UUID REFERENCES users(id) ON DELETE SET NULL;
+
+UPDATE expenses e SET created_by = r.changed_by
+FROM expense_revisions r
+WHERE r.expense_id = e.id AND r.version = 1;
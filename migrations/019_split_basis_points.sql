@@ -0,0 +1,3 @@
+-- Store the basis points PERCENTAGE expenses were entered with, when given instead of a percentage
+
+ALTER TABLE expense_splits ADD COLUMN basis_points BIGINT CHECK (basis_points >= 0 AND basis_points <= 10000);
@@ -0,0 +1,9 @@
+-- Remember where each expense fell in its group when it was created, so that editing
+-- it later rounds the same way under the ROTATE policy
+
+ALTER TABLE expenses ADD COLUMN rounding_sequence BIGINT NOT NULL DEFAULT 0;
+
+UPDATE expenses e SET rounding_sequence = (
+    SELECT count(*) FROM expenses earlier
+    WHERE earlier.group_id = e.group_id AND (earlier.created_at, earlier.id) < (e.created_at, e.id)
+);